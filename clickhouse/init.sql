@@ -0,0 +1,18 @@
+-- таблица для SINKS=...,clickhouse (JSONEachRow из sink_clickhouse.go)
+
+CREATE TABLE IF NOT EXISTS player_pay_log (
+  created_at DateTime64(3, 'UTC'),
+  event_id String,
+  user_id Int32,
+  domain_id Int32,
+  geo_id Int32,
+  geo_group_id UInt8,
+  domain_type_id Int32,
+  visitor_ip IPv6,
+  file_id Int32,
+  event LowCardinality(String)
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(created_at)
+ORDER BY (domain_id, created_at)
+-- дедуп повторных вставок батча по insert_deduplication_token
+SETTINGS non_replicated_deduplication_window = 1000;
@@ -14,7 +14,19 @@ CREATE TABLE IF NOT EXISTS player_pay_log (
   file_id INT NOT NULL DEFAULT 0,
   event ENUM('load','play','pay','vast_complete','p25','p50','p75','p100','getads','impression','p1','fallback','loaderror')
     COLLATE utf8mb4_unicode_ci NOT NULL,
-  PRIMARY KEY (id)
+  event_id VARCHAR(64) CHARACTER SET ascii DEFAULT NULL,
+  PRIMARY KEY (id),
+  UNIQUE KEY uq_event_id (event_id)
+) ENGINE=InnoDB;
+
+-- позиция WAL для WAL_COMMIT_MODE=db (пишется в одной транзакции с батчем)
+CREATE TABLE IF NOT EXISTS wal_cursor (
+  name VARCHAR(64) CHARACTER SET ascii NOT NULL,
+  seg INT NOT NULL,
+  line INT NOT NULL,
+  off BIGINT NOT NULL DEFAULT 0,
+  updated_at DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+  PRIMARY KEY (name)
 ) ENGINE=InnoDB;
 
 CREATE TABLE IF NOT EXISTS domains (
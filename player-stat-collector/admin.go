@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ---------------- admin ---------------- */
+
+// requireAdmin пускает только с Authorization: Bearer <ADMIN_TOKEN>.
+// Пустой ADMIN_TOKEN — admin-ручки выключены.
+func requireAdmin(token string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if token == "" {
+			http.NotFound(w, r)
+			return
+		}
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// GET /admin/deadletter?from=seg:line&limit=100&reason=unknown_domain
+func handleDeadLetterList(dl *DeadLetter) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		limit := 100
+		if v := q.Get("limit"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n <= 0 {
+				http.Error(w, "bad limit", http.StatusBadRequest)
+				return
+			}
+			limit = min(n, 1000)
+		}
+
+		items, next, err := dl.List(q.Get("from"), limit, q.Get("reason"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if items == nil {
+			items = []DeadLetterEntry{}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(map[string]any{
+			"items": items,
+			"count": len(items),
+			"next":  next,
+		})
+	}
+}
+
+// POST /admin/deadletter/reinject
+// Тело — NDJSON исправленных записей dead-letter (как их отдаёт /admin/deadletter).
+// Событие пересобирается и валидируется заново, принятые пишутся в WAL одним append.
+func handleDeadLetterReinject(wal *ShardedWAL, dc *DomainCache, geo *GeoMapper, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		items, err := parseBatchBody(body, 100_000)
+		if err != nil {
+			http.Error(w, fmt.Errorf("bad request: %v", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := batchResponse{Results: make([]batchItemResult, len(items))}
+		accepted := make([]Event, 0, len(items))
+		for i, raw := range items {
+			var e DeadLetterEntry
+			if err := json.Unmarshal(raw, &e); err != nil {
+				resp.Results[i] = batchItemResult{Error: "bad json: " + err.Error()}
+				continue
+			}
+			ev, err := reinjectEvent(r.Context(), e, dc, geo)
+			if err != nil {
+				resp.Results[i] = batchItemResult{Error: err.Error()}
+				continue
+			}
+			accepted = append(accepted, ev)
+			resp.Results[i] = batchItemResult{OK: true}
+		}
+
+		if len(accepted) > 0 {
+			if _, err := wal.AppendBatch(accepted); err != nil {
+				mWALAppendErr.Inc()
+				http.Error(w, "wal write failed", http.StatusInternalServerError)
+				return
+			}
+			wal.Notify()
+		}
+
+		resp.Accepted = len(accepted)
+		resp.Rejected = len(items) - len(accepted)
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+// reinjectEvent восстанавливает событие из (исправленной) записи dead-letter.
+// event_id сохраняется (или берётся из id записи), так что повторный re-inject
+// не даёт дублей в MySQL.
+func reinjectEvent(ctx context.Context, e DeadLetterEntry, dc *DomainCache, geo *GeoMapper) (Event, error) {
+	var ev Event
+	switch {
+	case e.Event != nil:
+		ev = *e.Event
+	case e.Params != nil:
+		// отказ на входе: пересобираем как обычный запрос (например, домен уже завели)
+		built, err := buildEventFrom(ctx, *e.Params, e.VisitorIP, e.Country, dc, geo)
+		if err != nil {
+			return Event{}, err
+		}
+		ev = built
+		ev.TS = e.TS
+	case e.RawRequest != "":
+		// не сырая строка WAL, а элемент запроса: в событие его не превратить, только руками в params
+		return Event{}, errors.New("raw_request is not re-injectable: move the fixed request into params")
+	case len(e.RawRecord) > 0:
+		// бинарная запись WAL: crc не сошёлся, но payload может быть цел (или исправлен руками)
+		decoded, err := decodeRecord(e.RawRecord)
+		if err != nil {
+			return Event{}, fmt.Errorf("raw_record: %v", err)
+		}
+		ev = decoded
+	case e.Raw != "":
+		// битая строка WAL, исправленная руками
+		if err := json.Unmarshal([]byte(e.Raw), &ev); err != nil {
+			return Event{}, fmt.Errorf("raw: %v", err)
+		}
+	default:
+		return Event{}, errors.New("entry has no event, params, raw or raw_record")
+	}
+
+	if _, ok := allowedEvents[ev.EventName]; !ok {
+		return Event{}, reject(reasonBadEvent, "bad event "+strconv.Quote(ev.EventName))
+	}
+	if ev.DomainID <= 0 || ev.FileID <= 0 {
+		return Event{}, reject(reasonBadRequest, "no domain_id/file_id")
+	}
+	if ev.TS.IsZero() {
+		return Event{}, reject(reasonBadRequest, "no ts")
+	}
+	if ev.EventID == "" && e.ID != "" {
+		ev.EventID = "dl-" + e.ID
+	}
+	if ev.EventID != "" && !validEventID(ev.EventID) {
+		return Event{}, reject(reasonBadRequest, "bad event_id")
+	}
+	return ev, nil
+}
+
+// POST /admin/wal/import
+// Тело — архив `wal export` (tar). Повтор того же архива (по id) — 200 со status already_imported.
+func handleWALImport(hi *handoffImporter, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if hi.wal.shards[0].quota.Policy == quotaReject && hi.wal.overQuota() {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "wal quota exceeded", http.StatusServiceUnavailable)
+			return
+		}
+		// архив на гигабайты не укладывается в таймауты сервера — ручке свои
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Now().Add(30 * time.Minute))
+		_ = rc.SetWriteDeadline(time.Now().Add(35 * time.Minute))
+
+		res, err := hi.Import(r.Context(), http.MaxBytesReader(w, r.Body, maxBody))
+		switch {
+		case err == nil, errors.Is(err, errHandoffImported):
+		case errors.Is(err, errHandoffBad):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		default:
+			mWALAppendErr.Inc()
+			http.Error(w, "import failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// GET /admin/repl — реплики соседей на этом инстансе.
+// POST /admin/repl/promote?source=X — X умер: его реплика уходит в свой WAL и дальше в sink'и.
+// POST /admin/repl/reset?source=X[&force=1] — удалить реплику X (после promote, когда X вернулся).
+func handleReplAdmin(rs *replicaSet) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/admin/repl"), "/")
+		if action == "" {
+			st, err := rs.Status()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			_ = enc.Encode(map[string]any{"replicas": st})
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		source := r.URL.Query().Get("source")
+		if !validReplSource(source) {
+			http.Error(w, "bad source", http.StatusBadRequest)
+			return
+		}
+
+		var res any
+		var err error
+		switch action {
+		case "promote":
+			// реплика за часы простоя — не на один WriteTimeout
+			rc := http.NewResponseController(w)
+			_ = rc.SetWriteDeadline(time.Now().Add(30 * time.Minute))
+			res, err = rs.Promote(r.Context(), source)
+		case "reset":
+			err = rs.Reset(source, r.URL.Query().Get("force") == "1")
+			res = map[string]string{"source": source, "status": "reset"}
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		switch {
+		case err == nil:
+		case errors.Is(err, errReplUnknown):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errReplActive):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
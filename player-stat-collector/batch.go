@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+)
+
+/* ---------------- batch ingest ---------------- */
+
+// POST /batch
+// Тело — JSON-массив событий или NDJSON (один JSON-объект на строку):
+//
+//	[{"event":"p25","domain":"example.com","file_id":123}, ...]
+//
+// Content-Type не проверяем: navigator.sendBeacon шлёт text/plain.
+// Каждое событие валидируется как в buildEvent, принятые пишутся в WAL одним append.
+
+type batchItemResult struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type batchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []batchItemResult `json:"results"`
+}
+
+var errBatchTooManyItems = errors.New("too many items")
+
+// parseBatchBody разбирает тело в сырые элементы. Ошибка разбора отдельного
+// элемента не ломает весь батч — она вернётся в результате этого элемента.
+func parseBatchBody(body []byte, maxItems int) ([]json.RawMessage, error) {
+	trim := bytes.TrimSpace(body)
+	if len(trim) == 0 {
+		return nil, errors.New("empty body")
+	}
+
+	var items []json.RawMessage
+	if trim[0] == '[' {
+		if err := json.Unmarshal(trim, &items); err != nil {
+			return nil, fmt.Errorf("bad json array: %v", err)
+		}
+	} else {
+		sc := bufio.NewScanner(bytes.NewReader(trim))
+		sc.Buffer(make([]byte, 0, 64*1024), len(trim)+1)
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			items = append(items, json.RawMessage(bytes.Clone(line)))
+			if len(items) > maxItems {
+				return nil, errBatchTooManyItems
+			}
+		}
+		if err := sc.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(items) == 0 {
+		return nil, errors.New("no items")
+	}
+	if len(items) > maxItems {
+		return nil, errBatchTooManyItems
+	}
+	return items, nil
+}
+
+func handleBatch(wal *ShardedWAL, dc *DomainCache, geo *GeoMapper, rejects *rejectQueue, maxBody int64, maxItems int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+
+		items, err := parseBatchBody(body, maxItems)
+		if err != nil {
+			if errors.Is(err, errBatchTooManyItems) {
+				http.Error(w, fmt.Sprintf("too many items (max %d)", maxItems), http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, fmt.Errorf("bad request: %v", err).Error(), http.StatusBadRequest)
+			return
+		}
+
+		resp := batchResponse{Results: make([]batchItemResult, len(items))}
+		accepted := make([]Event, 0, len(items))
+		ip16, iso2 := clientIP16(r), r.Header.Get("CF-IPCountry")
+		for i, raw := range items {
+			var p eventParams
+			if err := json.Unmarshal(raw, &p); err != nil {
+				mDropped.Inc()
+				rejects.add(DeadLetterEntry{Reason: reasonBadRequest, Error: err.Error(), RawRequest: string(raw), VisitorIP: ip16, Country: iso2})
+				resp.Results[i] = batchItemResult{Error: "bad json: " + err.Error()}
+				continue
+			}
+			ev, err := buildEventFrom(r.Context(), p, ip16, iso2, dc, geo)
+			if err != nil {
+				mDropped.Inc()
+				deadLetterRequest(rejects, &p, ip16, iso2, err)
+				resp.Results[i] = batchItemResult{Error: err.Error()}
+				continue
+			}
+			if wal.Shed(ev) {
+				mDropped.Inc()
+				resp.Results[i] = batchItemResult{Error: "wal quota exceeded"}
+				continue
+			}
+			accepted = append(accepted, ev)
+			resp.Results[i] = batchItemResult{OK: true}
+		}
+
+		if len(accepted) > 0 {
+			if _, err := wal.AppendDurable(r.Context(), accepted); err != nil {
+				if errors.Is(err, errWALSyncTimeout) {
+					wal.Notify()
+					w.Header().Set("Retry-After", "1")
+					http.Error(w, "wal sync timeout", http.StatusServiceUnavailable)
+					return
+				}
+				mWALAppendErr.Inc()
+				mDropped.Add(float64(len(accepted)))
+				http.Error(w, "wal write failed", http.StatusInternalServerError)
+				return
+			}
+
+			// разбудить flusher'ы (non-blocking)
+			wal.Notify()
+		}
+
+		resp.Accepted = len(accepted)
+		resp.Rejected = len(items) - len(accepted)
+
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseBatchBody(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		body    string
+		max     int
+		items   []string
+		wantErr bool
+		tooMany bool
+	}{
+		{name: "array", body: `[{"a":1}, {"a":2}]`, max: 10, items: []string{`{"a":1}`, `{"a":2}`}},
+		{name: "ndjson", body: "{\"a\":1}\n\n  {\"a\":2}  \n", max: 10, items: []string{`{"a":1}`, `{"a":2}`}},
+		// битый элемент NDJSON не ломает батч: разберётся (и отклонится) уже в handleBatch
+		{name: "ndjson bad item", body: "{\"a\":1}\nnot json\n{\"a\":3}", max: 10, items: []string{`{"a":1}`, `not json`, `{"a":3}`}},
+		{name: "array non-object items", body: `[{"a":1}, 5, "x"]`, max: 10, items: []string{`{"a":1}`, `5`, `"x"`}},
+		{name: "array at limit", body: `[{}, {}]`, max: 2, items: []string{`{}`, `{}`}},
+		{name: "array over limit", body: `[{}, {}, {}]`, max: 2, wantErr: true, tooMany: true},
+		{name: "ndjson over limit", body: "{}\n{}\n{}", max: 2, wantErr: true, tooMany: true},
+		{name: "empty", body: "  \n", max: 10, wantErr: true},
+		{name: "empty array", body: `[]`, max: 10, wantErr: true},
+		{name: "broken array", body: `[{"a":1},`, max: 10, wantErr: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			items, err := parseBatchBody([]byte(tc.body), tc.max)
+			if (err != nil) != tc.wantErr || errors.Is(err, errBatchTooManyItems) != tc.tooMany {
+				t.Fatalf("error %v, want error=%v too many=%v", err, tc.wantErr, tc.tooMany)
+			}
+			if err != nil {
+				return
+			}
+			if len(items) != len(tc.items) {
+				t.Fatalf("%d items, want %d", len(items), len(tc.items))
+			}
+			for i, raw := range items {
+				if string(raw) != tc.items[i] {
+					t.Errorf("item %d: %s, want %s", i, raw, tc.items[i])
+				}
+			}
+		})
+	}
+}
+
+// Результаты /batch — по элементу на входной элемент и в том же порядке; в WAL только принятые.
+func TestHandleBatchResults(t *testing.T) {
+	w := newTestWAL(t, t.TempDir())
+	sw := &ShardedWAL{shards: []*WAL{w}}
+	dl, err := NewDeadLetter(t.TempDir(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects := newRejectQueue(dl, 16, 0)
+	dc := NewDomainCache(nil, time.Minute)
+	dc.m["example.com"] = DomainRow{ID: 100, Domain: "example.com", ParentID: 7}
+
+	h := handleBatch(sw, dc, nil, rejects, 1<<20, 10)
+	body := strings.Join([]string{
+		`{"event":"p25","domain":"example.com","file_id":1}`,
+		`{"event":"p25","domain":`,
+		`{"event":"nope","domain":"example.com","file_id":2}`,
+		`{"event":"p50","domain":"unknown.org","file_id":3}`,
+		`{"event":"p50","domain":"Example.com","file_id":"4"}`,
+	}, "\n")
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(body)))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	var resp batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	wantOK := []bool{true, false, false, false, true}
+	if resp.Accepted != 2 || resp.Rejected != 3 || len(resp.Results) != len(wantOK) {
+		t.Fatalf("response %+v, want 2 accepted, 3 rejected, 5 results", resp)
+	}
+	for i, res := range resp.Results {
+		if res.OK != wantOK[i] || (res.Error == "") != wantOK[i] {
+			t.Errorf("result %d: %+v, want ok=%v", i, res, wantOK[i])
+		}
+	}
+	if !strings.HasPrefix(resp.Results[1].Error, "bad json") {
+		t.Errorf("result 1 error %q, want bad json", resp.Results[1].Error)
+	}
+
+	evs := newCursorReader(w, "mysql", nil).read(nil, 10)
+	if len(evs) != 2 || evs[0].FileID != 1 || evs[1].FileID != 4 {
+		t.Fatalf("wal has %+v, want file_id 1 and 4", evs)
+	}
+
+	rejects.Close()
+	items, _, err := dl.List("", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("dead-letter has %d entries, want 3 rejected items", len(items))
+	}
+	// нечитаемый элемент — в raw_request, а не в raw (raw re-inject считает строкой WAL)
+	var bad *DeadLetterEntry
+	for i := range items {
+		if items[i].Params == nil {
+			bad = &items[i]
+		}
+	}
+	if bad == nil || bad.RawRequest != `{"event":"p25","domain":` || bad.Raw != "" {
+		t.Fatalf("bad json entry %+v, want raw_request", bad)
+	}
+	if _, err := reinjectEvent(context.Background(), *bad, dc, nil); err == nil || !strings.Contains(err.Error(), "raw_request") {
+		t.Errorf("reinject of raw_request: %v, want not re-injectable", err)
+	}
+}
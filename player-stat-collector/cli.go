@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ---------------- cli ---------------- */
+
+// Без аргументов бинарь запускает сервер. С аргументами — служебные команды:
+//
+//	player-stat-collector deadletter list [--dir WAL_DIR] [--from seg:line] [--limit N] [--reason R]
+//	player-stat-collector deadletter reinject [--url http://127.0.0.1:8080] [--token $ADMIN_TOKEN] fixed.jsonl
+//	player-stat-collector wal stat [--dir WAL_DIR] [--shard N] [--json]
+//	player-stat-collector wal dump [--dir WAL_DIR] [--shard N] [--from seg:line] [--limit N] [--format json|csv]
+//	player-stat-collector wal verify [--dir WAL_DIR] [--shard N]
+//	player-stat-collector wal set-commit [--dir WAL_DIR] [--shard N] [--cursor NAME] [--yes] seg:line
+//	player-stat-collector wal crashtest [--dir WORK] [--point P] [--hits 1,2] [-v]
+//	player-stat-collector wal export [--dir WAL_DIR] [--shard N] [--cursor NAME] [--commit] --out FILE
+//	player-stat-collector wal import [--url http://127.0.0.1:8080] [--token $ADMIN_TOKEN] archive.tar
+//	player-stat-collector repl status|promote|reset [--url http://127.0.0.1:8080] [--token $ADMIN_TOKEN] [--source NAME] [--force]
+//	player-stat-collector replay --source DIR|FILE [--from seg:line] [--to seg:line] [--since T] [--until T]
+//	    [--domain-id IDS] [--event NAMES] [--file-id IDS] --sink mysql|clickhouse|kafka --dsn DSN [--progress FILE]
+
+func runCommand(args []string) int {
+	// зашифрованные сегменты читаются теми же ключами, что и у сервиса
+	keys, err := walKeysFromEnv()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	walKeys = keys
+
+	switch args[0] {
+	case "deadletter":
+		return cmdDeadLetter(args[1:])
+	case "wal":
+		return cmdWAL(args[1:])
+	case "repl":
+		return cmdRepl(args[1:])
+	case "replay":
+		return cmdReplay(args[1:])
+	case "help", "-h", "--help":
+		printUsage()
+		return 0
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", args[0])
+		printUsage()
+		return 2
+	}
+}
+
+func printUsage() {
+	fmt.Fprint(os.Stderr, `usage:
+  player-stat-collector                      run server
+  player-stat-collector deadletter list      print dead-letter entries (NDJSON)
+  player-stat-collector deadletter reinject  send repaired entries to a running instance
+  player-stat-collector wal stat             segments, sizes, commit and lag per cursor
+  player-stat-collector wal dump             print events from seg:line (NDJSON or CSV)
+  player-stat-collector wal verify           find corrupt records, torn tails, stale indexes
+  player-stat-collector wal set-commit       move a cursor's commit (service must be stopped)
+  player-stat-collector wal crashtest        simulate a crash at each WAL step and check recovery
+  player-stat-collector wal export           package the uncommitted WAL into a handoff archive (service must be stopped)
+  player-stat-collector wal import           append a handoff archive to a running instance's WAL
+  player-stat-collector repl status          replicas of peers kept by a running instance
+  player-stat-collector repl promote         a peer is dead: append its replica to the local WAL
+  player-stat-collector repl reset           drop a peer's replica (after promote)
+  player-stat-collector replay               re-send events from preserved segments into a sink
+`)
+}
+
+func cmdDeadLetter(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	switch args[0] {
+	case "list":
+		fs := flag.NewFlagSet("deadletter list", flag.ExitOnError)
+		dir := fs.String("dir", env("WAL_DIR", "/var/lib/ingest-wal"), "WAL dir")
+		from := fs.String("from", "", "start after position seg:line")
+		limit := fs.Int("limit", 100, "max entries")
+		reason := fs.String("reason", "", "filter by reason")
+		_ = fs.Parse(args[1:])
+
+		// только чтение: NewDeadLetter не нужен (он создаёт/открывает сегмент на запись)
+		dl := &DeadLetter{dir: filepath.Join(*dir, "deadletter")}
+		items, next, err := dl.List(*from, *limit, *reason)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		enc := json.NewEncoder(os.Stdout)
+		for _, e := range items {
+			_ = enc.Encode(e)
+		}
+		if next != "" {
+			fmt.Fprintf(os.Stderr, "next: --from %s\n", next)
+		}
+		return 0
+
+	case "reinject":
+		fs := flag.NewFlagSet("deadletter reinject", flag.ExitOnError)
+		url := fs.String("url", "http://127.0.0.1:8080", "collector base URL")
+		token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin token")
+		_ = fs.Parse(args[1:])
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "usage: deadletter reinject [--url URL] [--token T] fixed.jsonl")
+			return 2
+		}
+
+		body, err := os.ReadFile(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*url, "/")+"/admin/deadletter/reinject", bytes.NewReader(body))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		req.Header.Set("Authorization", "Bearer "+*token)
+		resp, err := (&http.Client{Timeout: 5 * time.Minute}).Do(req)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer resp.Body.Close()
+		_, _ = io.Copy(os.Stdout, resp.Body)
+		if resp.StatusCode != http.StatusOK {
+			fmt.Fprintf(os.Stderr, "http %d\n", resp.StatusCode)
+			return 1
+		}
+		return 0
+
+	default:
+		fmt.Fprintf(os.Stderr, "unknown deadletter command %q\n", args[0])
+		return 2
+	}
+}
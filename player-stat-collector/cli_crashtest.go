@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* ---------------- cli: wal crashtest ---------------- */
+
+// wal crashtest — восстановление после падения в каждой точке faultPoints: дочерний процесс
+// (wal crashtest-run) пишет WAL с WAL_FAULT=<точка>@N и "падает", потом WAL открывается
+// обычным NewWAL и проверяется:
+//
+//	- commit ни одного курсора не откатился назад от подтверждённого (SetCommit вернул nil
+//	  или уже fsync'нул commit.tmp) и указывает на существующий сегмент;
+//	- в сегментах нет битых записей и оборванных хвостов;
+//	- события идут подряд, без дыр и повторов, и все подтверждённые fsync'ом на месте;
+//	- курсор после commit не получает подтверждённые события повторно;
+//	- запись после восстановления видна курсору (commit не оказался за хвостом).
+
+const (
+	crashBatches   = 60
+	crashBatchSize = 8
+)
+
+func crashOpts(dir string) WALOptions {
+	return WALOptions{
+		Dir:         dir,
+		FsyncEvery:  time.Hour,
+		IndexEvery:  16,
+		Compress:    true,
+		SyncEvents:  []string{"*"},
+		SyncTimeout: 10 * time.Second,
+		Quota: WALQuota{
+			MaxSegments: 4,
+			Policy:      quotaDropOldest,
+			ArchiveDir:  filepath.Join(dir, "archive"),
+		},
+		Cursors: []WALCursor{{Name: "a"}, {Name: "b"}},
+	}
+}
+
+// cmdWALCrashRun — нагрузка дочернего процесса: батчи с fsync, commit курсора a после каждого,
+// b отстаёт (квота уносит сегменты), Compact, ротация по размеру. В stdout — подтверждённое.
+func cmdWALCrashRun(args []string) int {
+	fs := flag.NewFlagSet("wal crashtest-run", flag.ExitOnError)
+	dir := fs.String("dir", "", "WAL dir")
+	_ = fs.Parse(args)
+	if walFault == "" {
+		fmt.Fprintln(os.Stderr, "wal crashtest-run: no fault point set")
+		return 2
+	}
+
+	w, err := NewWAL(crashOpts(*dir))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	w.mu.Lock()
+	w.segMaxBytes = 2048
+	w.mu.Unlock()
+
+	out := bufio.NewWriter(os.Stdout)
+	ack := func(format string, a ...any) {
+		fmt.Fprintf(out, format+"\n", a...)
+		_ = out.Flush() // до следующего шага: упасть можем в любой момент
+	}
+	commit := func(name string, cp CommitPos) error {
+		ack("pending %s %d %d %d", name, cp.Seg, cp.Line, cp.Off)
+		w.setReadPos(name, cp)
+		if err := w.SetCommit(name, cp); err != nil {
+			return err
+		}
+		ack("commit %s %d %d %d", name, cp.Seg, cp.Line, cp.Off)
+		return nil
+	}
+
+	ts := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	seq := 0
+	for i := 1; i <= crashBatches; i++ {
+		evs := make([]Event, crashBatchSize)
+		for j := range evs {
+			seq++
+			evs[j] = Event{TS: ts.Add(time.Duration(seq) * time.Second), EventID: fmt.Sprintf("crash-%d", seq), EventName: "play", FileID: seq}
+		}
+		pos, err := w.AppendDurable(context.Background(), evs)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		ack("durable %d", seq)
+		last := CommitPos(pos[len(pos)-1])
+		if err := commit("a", last); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if i%20 == 0 {
+			if err := commit("b", last); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+		}
+		if i%5 == 0 {
+			_ = w.Compact()
+		}
+	}
+	// индексы и сжатие закрытых сегментов — синхронно, чтобы дойти до их точек
+	if err := w.IndexSegments(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err := w.Close(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+// crashAcks — что дочерний процесс успел подтвердить до падения.
+type crashAcks struct {
+	durable int
+	commits map[string]CommitPos
+	seqs    map[string]int // номер последнего события под подтверждённым commit курсора
+}
+
+// commitSynced — точки, где commit.tmp уже fsync'нут: недописанный SetCommit обязан пережить падение.
+var commitSynced = map[string]bool{"commit.sync": true, "commit.rename": true}
+
+func parseCrashAcks(b []byte, point string) crashAcks {
+	acks := crashAcks{commits: map[string]CommitPos{}, seqs: map[string]int{}}
+	for _, line := range strings.Split(string(b), "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) == 2 && f[0] == "durable":
+			acks.durable, _ = strconv.Atoi(f[1])
+		case len(f) == 5 && (f[0] == "commit" || f[0] == "pending" && commitSynced[point]):
+			var cp CommitPos
+			cp.Seg, _ = strconv.Atoi(f[2])
+			cp.Line, _ = strconv.Atoi(f[3])
+			cp.Off, _ = strconv.ParseInt(f[4], 10, 64)
+			acks.commits[f[1]] = cp
+			acks.seqs[f[1]] = acks.durable // commit — всегда за последним durable батчем
+		}
+	}
+	return acks
+}
+
+func cmdWALCrashTest(args []string) int {
+	fs := flag.NewFlagSet("wal crashtest", flag.ExitOnError)
+	dir := fs.String("dir", "", "work dir (default — temp dir, removed afterwards)")
+	point := fs.String("point", "", "only this fault point")
+	hits := fs.String("hits", "1,2", "crash at these passes of each point")
+	verbose := fs.Bool("v", false, "print WAL logs")
+	_ = fs.Parse(args)
+	if !walFaultBuild {
+		fmt.Fprintln(os.Stderr, "wal crashtest: fault injection is not built in; rebuild with -tags walfault")
+		return 2
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	root := *dir
+	if root == "" {
+		if root, err = os.MkdirTemp("", "wal-crashtest-"); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer os.RemoveAll(root)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	points := faultPoints
+	if *point != "" {
+		points = []string{*point}
+	}
+	failed := 0
+	for _, p := range points {
+		for _, h := range splitList(*hits) {
+			fault := p + "@" + h
+			runDir := filepath.Join(root, strings.ReplaceAll(fault, "@", "-"))
+			if err := os.RemoveAll(runDir); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+
+			var stdout, stderr bytes.Buffer
+			cmd := exec.Command(self, "wal", "crashtest-run", "--dir", runDir)
+			cmd.Env = append(os.Environ(), "WAL_FAULT="+fault)
+			cmd.Stdout, cmd.Stderr = &stdout, &stderr
+			err := cmd.Run()
+			var ee *exec.ExitError
+			switch {
+			case err == nil:
+				fmt.Printf("%-22s not reached\n", fault)
+				continue
+			case errors.As(err, &ee) && ee.ExitCode() == faultExitCode:
+			default:
+				failed++
+				fmt.Printf("%-22s FAIL: writer: %v\n%s", fault, err, stderr.String())
+				continue
+			}
+
+			if err := verifyCrash(runDir, parseCrashAcks(stdout.Bytes(), p)); err != nil {
+				failed++
+				fmt.Printf("%-22s FAIL: %v\n", fault, err)
+				continue
+			}
+			fmt.Printf("%-22s ok\n", fault)
+		}
+	}
+	if failed > 0 {
+		fmt.Printf("%d failure(s)\n", failed)
+		return 1
+	}
+	return 0
+}
+
+// verifyCrash открывает WAL после падения так же, как сервис при старте, и проверяет инварианты.
+func verifyCrash(dir string, acks crashAcks) error {
+	w, err := NewWAL(crashOpts(dir))
+	if err != nil {
+		return fmt.Errorf("recovery: %w", err)
+	}
+	defer w.Close()
+
+	for name, acked := range acks.commits {
+		if cp := w.Commit(name); cp.Less(acked) {
+			return fmt.Errorf("commit %q regressed: acked %+v, recovered %+v", name, acked, cp)
+		}
+	}
+
+	segs, err := w.listSegs()
+	if err != nil {
+		return err
+	}
+	exists := make(map[int]bool, len(segs))
+	for _, seg := range segs {
+		exists[seg] = true
+	}
+	for name := range acks.commits {
+		if cp := w.Commit(name); !exists[cp.Seg] {
+			return fmt.Errorf("commit %q %+v points at a missing segment", name, cp)
+		}
+	}
+	for _, seg := range segs {
+		res, err := verifySegment(w.segPath(seg))
+		switch {
+		case err != nil:
+			return fmt.Errorf("segment %d: %w", seg, err)
+		case len(res.corrupt) > 0, res.badFrame, res.torn > 0:
+			return fmt.Errorf("segment %d: %d corrupt, bad frame %v, torn %d bytes", seg, len(res.corrupt), res.badFrame, res.torn)
+		}
+	}
+
+	prev := 0
+	var scanErr error
+	if _, err := w.scanFrom(CommitPos{Seg: segs[0]}, func(pos CommitPos, ev Event, err error) bool {
+		switch {
+		case err != nil:
+			scanErr = fmt.Errorf("%d:%d: %w", pos.Seg, pos.Line, err)
+		case prev > 0 && ev.FileID != prev+1:
+			scanErr = fmt.Errorf("%d:%d: event %d follows %d", pos.Seg, pos.Line, ev.FileID, prev)
+		}
+		prev = ev.FileID
+		return scanErr == nil
+	}); err != nil {
+		return err
+	}
+	if scanErr != nil {
+		return scanErr
+	}
+	if prev < acks.durable {
+		return fmt.Errorf("lost durable events: last %d, acked %d", prev, acks.durable)
+	}
+
+	// подтверждённое курсору не приходит ему повторно
+	for name, seq := range acks.seqs {
+		var dupErr error
+		if _, err := w.scanFrom(w.Commit(name), func(pos CommitPos, ev Event, err error) bool {
+			if err == nil && ev.FileID <= seq {
+				dupErr = fmt.Errorf("cursor %q redelivers event %d at %d:%d, acked up to %d", name, ev.FileID, pos.Seg, pos.Line, seq)
+			}
+			return false
+		}); err != nil {
+			return err
+		}
+		if dupErr != nil {
+			return dupErr
+		}
+	}
+
+	// запись после восстановления должна быть видна каждому курсору
+	if _, err := w.AppendDurable(context.Background(), []Event{{TS: time.Now(), EventName: "play", FileID: -1}}); err != nil {
+		return fmt.Errorf("append after recovery: %w", err)
+	}
+	for _, name := range []string{"a", "b"} {
+		seen := false
+		if _, err := w.scanFrom(w.Commit(name), func(_ CommitPos, ev Event, _ error) bool {
+			seen = ev.FileID == -1
+			return !seen
+		}); err != nil {
+			return err
+		}
+		if !seen {
+			return fmt.Errorf("cursor %q at %+v does not see records appended after recovery", name, w.Commit(name))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ---------------- cli: wal export / import ---------------- */
+
+// wal export — незакоммиченный хвост WAL (от commit самого отстающего курсора или --cursor до конца)
+// в архив передачи (wal_handoff.go). Сервис должен быть остановлен: берём LOCK каждого шарда.
+// --commit — после записи архива передвинуть commit'ы источника на конец выгрузки: если узел
+// поднимут снова, он не отправит те же события второй раз.
+//
+// wal import — отправить архив в запущенный инстанс (POST /admin/wal/import).
+
+func cmdWALExport(args []string) int {
+	fs := flag.NewFlagSet("wal export", flag.ExitOnError)
+	var wf walFlags
+	wf.register(fs, -1)
+	cursor := fs.String("cursor", "", "export from this cursor's commit (default — the most lagging one)")
+	out := fs.String("out", "", "archive file")
+	commit := fs.Bool("commit", false, "move source commits to the end of the export")
+	_ = fs.Parse(args)
+	if *out == "" {
+		fmt.Fprintln(os.Stderr, "usage: wal export [--dir D] [--shard N] [--cursor NAME] [--commit] --out FILE")
+		return 2
+	}
+
+	work, err := os.MkdirTemp(filepath.Dir(*out), ".wal-export-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer os.RemoveAll(work)
+
+	m := handoffManifest{ID: newHandoffID(), Created: time.Now().UTC(), Host: hostname(), WALDir: wf.dir, Cursor: *cursor}
+	var wals []*WAL
+	for _, shard := range wf.shards() {
+		lock, err := lockWALDir(shardDir(wf.dir, shard), 0)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		defer lock.release()
+
+		w, err := openWALReadOnly(wf, shard)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		sh, err := exportShard(w, *cursor, filepath.Join(work, fmt.Sprintf("shard-%02d.log", shard)))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "shard %d: %v\n", shard, err)
+			return 1
+		}
+		m.Shards = append(m.Shards, sh)
+		m.Events += sh.Events
+		wals = append(wals, w)
+	}
+
+	tmp := *out + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	err = writeHandoffArchive(f, m, work)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, *out)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	_ = syncDir(filepath.Dir(*out))
+
+	for _, sh := range m.Shards {
+		fmt.Printf("shard %d: %d events %d:%d .. %d:%d", sh.Shard, sh.Events, sh.From.Seg, sh.From.Line, sh.To.Seg, sh.To.Line)
+		if sh.Skipped > 0 {
+			fmt.Printf(" (%d corrupt records skipped)", sh.Skipped)
+		}
+		fmt.Println()
+	}
+	fmt.Printf("archive %s: id %s, %d events\n", *out, m.ID, m.Events)
+
+	if *commit {
+		// архив на диске — теперь источник может считать эти события отданными
+		for i, w := range wals {
+			for name, cp := range w.commits {
+				// курсор позади начала выгрузки (при --cursor) — его события не все в архиве, не трогаем
+				if !cp.Less(m.Shards[i].From) && cp.Less(m.Shards[i].To) {
+					w.commits[name] = m.Shards[i].To
+					if err := w.saveCommitLocked(name); err != nil {
+						fmt.Fprintln(os.Stderr, err)
+						return 1
+					}
+				}
+			}
+		}
+		fmt.Println("source commits moved to the end of the export (WAL_COMMIT_MODE=db: the wal_cursor row still wins on start)")
+	}
+	return 0
+}
+
+// exportShard пишет события шарда от commit до конца в path.
+func exportShard(w *WAL, cursor, path string) (handoffShard, error) {
+	sh := handoffShard{Shard: w.shard, File: filepath.Base(path), Commits: w.commits}
+	segs, err := w.listSegs()
+	if err != nil {
+		return sh, err
+	}
+	switch cp, ok := w.commits[cursor]; {
+	case cursor != "" && !ok:
+		return sh, fmt.Errorf("no cursor %q", cursor)
+	case cursor != "":
+		sh.From = cp
+	default:
+		if cp, ok := minPos(w.commits); ok {
+			sh.From = cp
+		} else if len(segs) > 0 {
+			sh.From = CommitPos{Seg: segs[0]}
+		}
+	}
+	sh.To = sh.From
+
+	sw, err := createSegWriter(path)
+	if err != nil {
+		return sh, err
+	}
+	var werr error
+	if _, err := w.scanFrom(sh.From, func(pos CommitPos, ev Event, rerr error) bool {
+		sh.To = pos
+		if rerr != nil {
+			sh.Skipped++
+			return true
+		}
+		sh.Events++
+		werr = sw.add(ev)
+		return werr == nil
+	}); err != nil {
+		_ = sw.close()
+		return sh, err
+	}
+	if err := sw.close(); err != nil || werr != nil {
+		return sh, fmt.Errorf("write %s: %v %v", path, werr, err)
+	}
+	sh.SHA256, sh.Size, err = fileSHA256(path)
+	return sh, err
+}
+
+func cmdWALImport(args []string) int {
+	fs := flag.NewFlagSet("wal import", flag.ExitOnError)
+	url := fs.String("url", "http://127.0.0.1:8080", "collector base URL")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin token")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "usage: wal import [--url URL] [--token T] archive.tar")
+		return 2
+	}
+	f, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(*url, "/")+"/admin/wal/import", f)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	req.Header.Set("Content-Type", "application/x-tar")
+	resp, err := (&http.Client{Timeout: 30 * time.Minute}).Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "http %d\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+/* ---------------- cli: repl ---------------- */
+
+// repl status | promote | reset — реплики соседей на запущенном инстансе (/admin/repl, wal_replica.go).
+// promote — сосед умер: его непрошедшие события дописываются в WAL этого инстанса.
+// reset — удалить реплику соседа (после promote, когда он вернулся; без promote — только с --force).
+
+func cmdRepl(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	fs := flag.NewFlagSet("repl "+args[0], flag.ExitOnError)
+	base := fs.String("url", "http://127.0.0.1:8080", "collector base URL")
+	token := fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin token")
+	source := fs.String("source", "", "peer name (its WAL_CURSOR_NAME)")
+	force := fs.Bool("force", false, "reset a replica that was not promoted")
+	_ = fs.Parse(args[1:])
+
+	method, path := http.MethodPost, "/admin/repl/"+args[0]
+	switch args[0] {
+	case "status":
+		method, path = http.MethodGet, "/admin/repl"
+	case "promote", "reset":
+		if *source == "" {
+			fmt.Fprintf(os.Stderr, "usage: repl %s [--url URL] [--token T] --source NAME\n", args[0])
+			return 2
+		}
+		q := url.Values{"source": {*source}}
+		if *force {
+			q.Set("force", "1")
+		}
+		path += "?" + q.Encode()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown repl command %q\n", args[0])
+		return 2
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(*base, "/")+path, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	req.Header.Set("Authorization", "Bearer "+*token)
+	resp, err := (&http.Client{Timeout: 30 * time.Minute}).Do(req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(os.Stdout, resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintf(os.Stderr, "http %d\n", resp.StatusCode)
+		return 1
+	}
+	return 0
+}
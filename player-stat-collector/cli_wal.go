@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+/* ---------------- cli: wal ---------------- */
+
+// Офлайн-команды над WAL_DIR (set-commit — только при остановленном сервисе: берёт его LOCK):
+//
+//	wal stat       — сегменты, размеры, commit и отставание каждого курсора
+//	wal dump       — события с позиции seg:line как NDJSON или CSV
+//	wal verify     — битые записи, оборванные хвосты, индексы не от своих сегментов
+//	wal set-commit — выставить commit курсора (с подтверждением)
+//	wal crashtest  — восстановление после падения в каждой точке (cli_crashtest.go), на временном каталоге
+//	wal export     — незакоммиченный хвост в архив для другого инстанса, wal import — отправить его (cli_handoff.go)
+//
+// WAL открывается только на чтение: без NewWAL (тот обрезает хвост и открывает сегмент на запись).
+
+func cmdWAL(args []string) int {
+	if len(args) == 0 {
+		printUsage()
+		return 2
+	}
+	switch args[0] {
+	case "stat":
+		return cmdWALStat(args[1:])
+	case "dump":
+		return cmdWALDump(args[1:])
+	case "verify":
+		return cmdWALVerify(args[1:])
+	case "set-commit":
+		return cmdWALSetCommit(args[1:])
+	case "crashtest":
+		return cmdWALCrashTest(args[1:])
+	case "export":
+		return cmdWALExport(args[1:])
+	case "import":
+		return cmdWALImport(args[1:])
+	case "crashtest-run":
+		return cmdWALCrashRun(args[1:])
+	default:
+		fmt.Fprintf(os.Stderr, "unknown wal command %q\n", args[0])
+		return 2
+	}
+}
+
+// walFlags — общие флаги: где лежит WAL и какой шард.
+type walFlags struct {
+	dir, spill string
+	shard      int
+}
+
+func (f *walFlags) register(fs *flag.FlagSet, shard int) {
+	fs.StringVar(&f.dir, "dir", env("WAL_DIR", "/var/lib/ingest-wal"), "WAL dir")
+	fs.StringVar(&f.spill, "spill-dir", env("WAL_SPILL_DIR", ""), "WAL spill dir")
+	fs.IntVar(&f.shard, "shard", shard, "shard (-1 — all)")
+}
+
+// shards — какие шарды смотреть: все существующие или один.
+func (f *walFlags) shards() []int {
+	if f.shard >= 0 {
+		return []int{f.shard}
+	}
+	out := []int{0}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(shardDir(f.dir, i)); err != nil {
+			return out
+		}
+		out = append(out, i)
+	}
+}
+
+// openWALReadOnly — WAL шарда для чтения: сегменты, индексы, commit-файлы. Ничего не пишет.
+func openWALReadOnly(f walFlags, shard int) (*WAL, error) {
+	w := &WAL{shard: shard, dir: shardDir(f.dir, shard), spilled: make(map[int]bool), commits: map[string]CommitPos{}}
+	if _, err := os.Stat(w.dir); err != nil {
+		return nil, err
+	}
+	if f.spill != "" {
+		w.quota.SpillDir = shardDir(f.spill, shard)
+		segs, err := listSegFiles(w.quota.SpillDir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		for _, seg := range segs {
+			w.spilled[seg] = true
+		}
+	}
+	names, err := w.cursorNames()
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		cp, ok, err := w.loadCommit(name)
+		if err != nil {
+			return nil, fmt.Errorf("commit %q: %w", name, err)
+		}
+		if ok {
+			w.commits[name] = cp
+		}
+	}
+	return w, nil
+}
+
+// cursorNames — курсоры по commit-файлам: commit.meta (mysql) и commit.<name>.meta.
+func (w *WAL) cursorNames() ([]string, error) {
+	paths, err := filepath.Glob(filepath.Join(w.dir, "commit*.meta"))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, p := range paths {
+		base := filepath.Base(p)
+		if base == "commit.meta" {
+			names = append(names, legacyCursor)
+			continue
+		}
+		names = append(names, strings.TrimSuffix(strings.TrimPrefix(base, "commit."), ".meta"))
+	}
+	return names, nil
+}
+
+// segRecords — число записей сегмента: из индекса, без него — чтением.
+func (w *WAL) segRecords(seg int) (int, error) {
+	if idx, ok := w.LoadIndex(seg); ok {
+		return idx.Records, nil
+	}
+	r, err := openSegReader(w.segPath(seg))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return r.skip(int(^uint(0) >> 1))
+}
+
+type walStatShard struct {
+	Shard    int                    `json:"shard"`
+	Dir      string                 `json:"dir"`
+	Segments []SegmentInfo          `json:"segments"`
+	Cursors  map[string]walStatCurs `json:"cursors"`
+}
+
+type walStatCurs struct {
+	Commit CommitPos `json:"commit"`
+	Lag    int       `json:"lag"` // записей после commit
+}
+
+func cmdWALStat(args []string) int {
+	fs := flag.NewFlagSet("wal stat", flag.ExitOnError)
+	var wf walFlags
+	wf.register(fs, -1)
+	asJSON := fs.Bool("json", false, "print JSON")
+	_ = fs.Parse(args)
+
+	var out []walStatShard
+	for _, shard := range wf.shards() {
+		w, err := openWALReadOnly(wf, shard)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		segs, err := w.listSegs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		st := walStatShard{Shard: shard, Dir: w.dir, Cursors: map[string]walStatCurs{}}
+		records := make(map[int]int, len(segs))
+		for _, seg := range segs {
+			si := SegmentInfo{Seg: seg, Spilled: w.isSpilled(seg)}
+			if idx, ok := w.LoadIndex(seg); ok {
+				si.Size, si.Records, si.FirstTS, si.LastTS, si.ZSize, si.KeyID, si.Indexed = idx.Size, idx.Records, idx.FirstTS, idx.LastTS, idx.ZSize, idx.KeyID, true
+			} else {
+				n, err := w.segRecords(seg)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "segment %d: %v\n", seg, err)
+					return 1
+				}
+				si.Records = n
+				if fi, path, err := statSeg(w.segPath(seg)); err == nil {
+					if isPacked(path) {
+						si.Size, si.ZSize = -1, fi.Size()
+					} else {
+						si.Size = fi.Size()
+					}
+				}
+			}
+			records[seg] = si.Records
+			st.Segments = append(st.Segments, si)
+		}
+		for name, cp := range w.commits {
+			lag := 0
+			for _, seg := range segs {
+				switch {
+				case seg > cp.Seg:
+					lag += records[seg]
+				case seg == cp.Seg:
+					lag += max(0, records[seg]-cp.Line)
+				}
+			}
+			st.Cursors[name] = walStatCurs{Commit: cp, Lag: lag}
+		}
+		out = append(out, st)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(out)
+		return 0
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, st := range out {
+		fmt.Fprintf(tw, "shard %d\t%s\n", st.Shard, st.Dir)
+		fmt.Fprintln(tw, "  seg\tsize\tzsize\tkey\trecords\tfirst_ts\tlast_ts\t")
+		for _, si := range st.Segments {
+			note := ""
+			if si.Spilled {
+				note = "spilled"
+			}
+			fmt.Fprintf(tw, "  %06d\t%s\t%s\t%s\t%d\t%s\t%s\t%s\n", si.Seg, sizeOrDash(si.Size), sizeOrDash(si.ZSize), sizeOrDash(int64(si.KeyID)), si.Records,
+				tsOrDash(si.FirstTS), tsOrDash(si.LastTS), note)
+		}
+		for name, c := range st.Cursors {
+			fmt.Fprintf(tw, "  cursor %s\tcommit %d:%d\t(off %d)\tlag %d\t\t\t\t\n", name, c.Commit.Seg, c.Commit.Line, c.Commit.Off, c.Lag)
+		}
+	}
+	_ = tw.Flush()
+	return 0
+}
+
+func sizeOrDash(n int64) string {
+	if n <= 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+func tsOrDash(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func cmdWALDump(args []string) int {
+	fs := flag.NewFlagSet("wal dump", flag.ExitOnError)
+	var wf walFlags
+	wf.register(fs, 0)
+	from := fs.String("from", "", "first record seg:line (line 1-based; default — start of WAL)")
+	limit := fs.Int("limit", 100, "max events")
+	format := fs.String("format", "json", "json | csv")
+	_ = fs.Parse(args)
+	if wf.shard < 0 {
+		fmt.Fprintln(os.Stderr, "wal dump: --shard must be a single shard")
+		return 2
+	}
+
+	w, err := openWALReadOnly(wf, wf.shard)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	segs, err := w.listSegs()
+	if err != nil || len(segs) == 0 {
+		fmt.Fprintln(os.Stderr, "no segments", err)
+		return 1
+	}
+	start := CommitPos{Seg: segs[0]}
+	if *from != "" {
+		seg, line, err := parseSegLine(*from)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		// позиция сразу перед line-й записью
+		if start, err = w.seekLine(seg, max(0, line-1)); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+
+	var emit func(pos string, ev Event) error
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		emit = func(_ string, ev Event) error { return enc.Encode(ev) }
+	case "csv":
+		cw := csv.NewWriter(os.Stdout)
+		defer cw.Flush()
+		_ = cw.Write([]string{"pos", "ts", "event_id", "event", "user_id", "domain_id", "file_id", "geo_id", "geo_group_id", "domain_type_id", "visitor_ip"})
+		emit = func(pos string, ev Event) error {
+			return cw.Write([]string{pos, ev.TS.UTC().Format(time.RFC3339Nano), ev.EventID, ev.EventName,
+				strconv.Itoa(ev.UserID), strconv.Itoa(ev.DomainID), strconv.Itoa(ev.FileID), strconv.Itoa(ev.GeoID),
+				strconv.Itoa(ev.GeoGroupID), strconv.Itoa(ev.DomainTypeID), net.IP(ev.VisitorIP).String()})
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "unknown format %q\n", *format)
+		return 2
+	}
+
+	n := 0
+	next, err := w.scanFrom(start, func(pos CommitPos, ev Event, rerr error) bool {
+		if n >= *limit {
+			return false
+		}
+		n++
+		if rerr != nil {
+			fmt.Fprintf(os.Stderr, "%d:%d: %v\n", pos.Seg, pos.Line, rerr)
+			return true
+		}
+		return emit(fmt.Sprintf("%d:%d", pos.Seg, pos.Line), ev) == nil
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if next != nil {
+		fmt.Fprintf(os.Stderr, "next: --from %d:%d\n", next.Seg, next.Line+1)
+	}
+	return 0
+}
+
+// scanFrom читает записи с позиции start по всем следующим сегментам. fn получает позицию
+// записи (line — её номер) и событие или ошибку записи (битая — читаем дальше); false — стоп.
+// Возвращает позицию, на которой остановились (nil — дочитали до конца WAL).
+func (w *WAL) scanFrom(start CommitPos, fn func(pos CommitPos, ev Event, err error) bool) (*CommitPos, error) {
+	segs, err := w.listSegs()
+	if err != nil {
+		return nil, err
+	}
+	cur := start
+	for _, seg := range segs {
+		if seg < start.Seg {
+			continue
+		}
+		if seg > cur.Seg {
+			cur = CommitPos{Seg: seg}
+		}
+		r, err := openSegReader(w.segPath(seg))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // удалил Compact, пока читали
+			}
+			return nil, err
+		}
+		if err := r.seek(cur.Off); err != nil {
+			_ = r.Close()
+			return nil, err
+		}
+		for {
+			ev, err := r.Next()
+			var ce *corruptRecordError
+			if errors.Is(err, io.EOF) || errors.Is(err, errBadFrame) {
+				break
+			}
+			if err != nil && !errors.Is(err, errEmptyRecord) && !errors.As(err, &ce) {
+				_ = r.Close()
+				return nil, err
+			}
+			pos := CommitPos{Seg: seg, Line: cur.Line + 1, Off: r.off}
+			if errors.Is(err, errEmptyRecord) {
+				cur = pos
+				continue
+			}
+			if !fn(pos, ev, err) {
+				_ = r.Close()
+				return &cur, nil
+			}
+			cur = pos
+		}
+		_ = r.Close()
+	}
+	return nil, nil
+}
+
+func cmdWALVerify(args []string) int {
+	fs := flag.NewFlagSet("wal verify", flag.ExitOnError)
+	var wf walFlags
+	wf.register(fs, -1)
+	_ = fs.Parse(args)
+
+	problems := 0
+	report := func(shard, seg int, format string, a ...any) {
+		problems++
+		fmt.Printf("shard %d segment %06d: %s\n", shard, seg, fmt.Sprintf(format, a...))
+	}
+	for _, shard := range wf.shards() {
+		w, err := openWALReadOnly(wf, shard)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		segs, err := w.listSegs()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		for _, seg := range segs {
+			res, err := verifySegment(w.segPath(seg))
+			if err != nil {
+				report(shard, seg, "%v", err)
+				continue
+			}
+			for _, c := range res.corrupt {
+				report(shard, seg, "record %d: %s", c.line, c.err)
+			}
+			if res.badFrame {
+				report(shard, seg, "bad record frame after record %d (offset %d), rest of segment unreadable", res.records, res.end)
+			}
+			if res.torn > 0 {
+				report(shard, seg, "torn tail: %d bytes after record %d", res.torn, res.records)
+			}
+			if _, err := os.Stat(w.indexPath(seg)); err == nil {
+				idx, ok := w.LoadIndex(seg)
+				switch {
+				case !ok:
+					report(shard, seg, "index does not match segment file")
+				case idx.Records != res.records:
+					report(shard, seg, "index records %d, segment has %d", idx.Records, res.records)
+				default:
+					chk := &SegmentIndex{Size: idx.Size}
+					if err := fileCRC(w.segPath(seg), chk); err != nil || chk.CRC32C != idx.CRC32C {
+						report(shard, seg, "crc32c mismatch with index (%v)", err)
+					}
+				}
+			}
+			if len(res.corrupt) == 0 && !res.badFrame && res.torn == 0 {
+				fmt.Printf("shard %d segment %06d: ok, %d records\n", shard, seg, res.records)
+			}
+		}
+	}
+	if problems > 0 {
+		fmt.Printf("%d problem(s)\n", problems)
+		return 1
+	}
+	return 0
+}
+
+type segVerify struct {
+	records  int
+	end      int64 // конец последней целой записи
+	torn     int64 // байт после неё (только несжатый сегмент)
+	badFrame bool
+	corrupt  []corruptAt
+}
+
+type corruptAt struct {
+	line int
+	err  string
+}
+
+func verifySegment(path string) (segVerify, error) {
+	var res segVerify
+	r, err := openSegReader(path)
+	if err != nil {
+		return res, err
+	}
+	defer r.Close()
+	for {
+		_, err := r.Next()
+		var ce *corruptRecordError
+		switch {
+		case err == nil, errors.Is(err, errEmptyRecord):
+		case errors.As(err, &ce):
+			res.corrupt = append(res.corrupt, corruptAt{line: res.records + 1, err: ce.Error()})
+		case errors.Is(err, io.EOF), errors.Is(err, errBadFrame):
+			res.badFrame = errors.Is(err, errBadFrame)
+			res.end = r.off
+			if r.dec == nil {
+				if st, err := r.f.Stat(); err == nil && st.Size() > r.off && !res.badFrame {
+					res.torn = st.Size() - r.off
+				}
+			}
+			return res, nil
+		default:
+			return res, err
+		}
+		res.records++
+	}
+}
+
+func cmdWALSetCommit(args []string) int {
+	fs := flag.NewFlagSet("wal set-commit", flag.ExitOnError)
+	var wf walFlags
+	wf.register(fs, 0)
+	cursor := fs.String("cursor", legacyCursor, "cursor (sink) name")
+	yes := fs.Bool("yes", false, "do not ask for confirmation")
+	_ = fs.Parse(args)
+	if fs.NArg() != 1 || wf.shard < 0 {
+		fmt.Fprintln(os.Stderr, "usage: wal set-commit [--dir D] [--shard N] [--cursor NAME] [--yes] seg:line")
+		return 2
+	}
+	seg, line, err := parseSegLine(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	// сервис запущен — он перезапишет commit своим: не даём
+	lock, err := lockWALDir(shardDir(wf.dir, wf.shard), 0)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer lock.release()
+
+	w, err := openWALReadOnly(wf, wf.shard)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	cp, err := w.seekLine(seg, line)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if cp.Line != line {
+		fmt.Fprintf(os.Stderr, "segment %d has only %d records\n", seg, cp.Line)
+		return 1
+	}
+
+	old, ok := w.commits[*cursor]
+	fmt.Printf("cursor %q shard %d (%s)\n", *cursor, wf.shard, w.commitPath(*cursor))
+	if ok {
+		fmt.Printf("  current: %d:%d (off %d)\n", old.Seg, old.Line, old.Off)
+	} else {
+		fmt.Println("  current: none")
+	}
+	fmt.Printf("  new:     %d:%d (off %d)\n", cp.Seg, cp.Line, cp.Off)
+	fmt.Println("events after the new position will be (re)sent to the sink, events before it skipped.")
+	fmt.Println("with WAL_COMMIT_MODE=db the wal_cursor row wins on start.")
+	if !*yes {
+		fmt.Print("type yes to continue: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			fmt.Println("aborted")
+			return 1
+		}
+	}
+	w.commits[*cursor] = cp
+	if err := w.saveCommitLocked(*cursor); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Println("done")
+	return 0
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+/* ---------------- commit в MySQL (exactly-once) ---------------- */
+
+// WAL_COMMIT_MODE=db: батч и новая позиция WAL пишутся в одной транзакции:
+//
+//	INSERT INTO player_pay_log ...;
+//	INSERT INTO wal_cursor (name, seg, line, off) ... ON DUPLICATE KEY UPDATE ...;
+//	COMMIT;
+//
+// commit.meta после этого лишь кэш. При старте NewWAL сверяет его с wal_cursor и доверяет БД,
+// поэтому падение между COMMIT и записью commit.meta не даёт дублей.
+// name — имя инстанса (у каждого коллектора свой WAL и своя строка курсора). Шард 0 — строка name,
+// шард i — name/NN: батч из нескольких шардов двигает все их строки в той же транзакции.
+
+type MySQLCommitStore struct {
+	db   *sql.DB
+	name string
+
+	// сколько ждём MySQL при старте, прежде чем сдаться
+	loadTimeout time.Duration
+}
+
+func NewMySQLCommitStore(db *sql.DB, name string, loadTimeout time.Duration) *MySQLCommitStore {
+	return &MySQLCommitStore{db: db, name: name, loadTimeout: loadTimeout}
+}
+
+// rowName — строка курсора шарда: шард 0 под старым именем, остальные "<name>/NN".
+func (s *MySQLCommitStore) rowName(shard int) string {
+	if shard == 0 {
+		return s.name
+	}
+	return fmt.Sprintf("%s/%02d", s.name, shard)
+}
+
+// ShardStore — позиция одного шарда для NewWAL.
+func (s *MySQLCommitStore) ShardStore(shard int) CommitStore {
+	return mysqlShardCursor{s: s, shard: shard}
+}
+
+type mysqlShardCursor struct {
+	s     *MySQLCommitStore
+	shard int
+}
+
+func (c mysqlShardCursor) LoadCommit() (CommitPos, bool, error) {
+	return c.s.LoadCommit(c.shard)
+}
+
+// LoadCommit ретраит, пока MySQL не ответит или не выйдет loadTimeout:
+// без курсора из БД стартовать нельзя — иначе повторная вставка уже записанного.
+func (s *MySQLCommitStore) LoadCommit(shard int) (CommitPos, bool, error) {
+	deadline := time.Now().Add(s.loadTimeout)
+	backoff := 500 * time.Millisecond
+	for {
+		cp, ok, err := s.load(shard)
+		if err == nil {
+			return cp, ok, nil
+		}
+		if time.Now().After(deadline) {
+			return CommitPos{}, false, err
+		}
+		log.Printf("wal cursor load failed, retry in %s: %v", backoff, err)
+		time.Sleep(backoff)
+		if backoff < 10*time.Second {
+			backoff *= 2
+		}
+	}
+}
+
+func (s *MySQLCommitStore) load(shard int) (CommitPos, bool, error) {
+	ctxTO, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var cp CommitPos
+	err := s.db.QueryRowContext(ctxTO, `SELECT seg, line, off FROM wal_cursor WHERE name = ?`, s.rowName(shard)).Scan(&cp.Seg, &cp.Line, &cp.Off)
+	if errors.Is(err, sql.ErrNoRows) {
+		return CommitPos{}, false, nil
+	}
+	if err != nil {
+		return CommitPos{}, false, err
+	}
+	return cp, true, nil
+}
+
+// InsertBatchWithCommit вставляет батч и двигает wal_cursor шардов на next в одной транзакции.
+// Пустой батч — только сдвиг курсора (события ушли в dead-letter).
+func (s *MySQLCommitStore) InsertBatchWithCommit(ctx context.Context, batch []Event, next []ShardPos) error {
+	ctxTO, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	tx, err := s.db.BeginTx(ctxTO, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	var dups dupStats
+	if len(batch) > 0 {
+		if dups, err = insertBatch(ctxTO, tx, batch); err != nil {
+			return err
+		}
+	}
+	for _, sp := range next {
+		cp := sp.Pos
+		if _, err := tx.ExecContext(ctxTO, `INSERT INTO wal_cursor (name, seg, line, off) VALUES (?, ?, ?, ?)
+ON DUPLICATE KEY UPDATE seg = VALUES(seg), line = VALUES(line), off = VALUES(off)`, s.rowName(sp.Shard), cp.Seg, cp.Line, cp.Off); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	dups.observe()
+	return nil
+}
@@ -1,6 +1,10 @@
 package main
 
-import "time"
+import (
+	"log"
+	"strings"
+	"time"
+)
 
 /* ---------------- config ---------------- */
 
@@ -12,21 +16,88 @@ type Config struct {
 
 	FlushEvery time.Duration
 	BatchMax   int
-	QueueSize  int
+
+	Sinks []SinkConfig
+
+	AdminToken string
+
+	// SIGTERM: readyz -> 503, пауза ShutdownReadyDelay, затем http.Shutdown и дренаж WAL в sinks;
+	// всё вместе не дольше ShutdownDrainTimeout
+	ShutdownDrainTimeout time.Duration
+	ShutdownReadyDelay   time.Duration
+
+	DeadLetterSegmentMaxMB int
+	DeadLetterMaxMB        int
+	DeadLetterRejectQueue  int // отказы на входе: очередь к dead-letter и лимит записей в секунду
+	DeadLetterRejectRate   int
+
+	ClickHouse ClickHouseConfig
+	Kafka      KafkaConfig
+	Peer       PeerConfig
+
+	// приём реплик соседей (wal_replica.go): пустой REPL_TOKEN — /repl/append выключен
+	ReplToken     string
+	ReplMaxBodyMB int
 
 	DomainReloadEvery time.Duration
 	GeoReloadEvery    time.Duration
 
 	ReqMaxInFlight int
 
+	BatchBodyMaxKB int
+	BatchItemsMax  int
+
 	WALDir          string
 	WALSegmentMaxMB int
 	WALFsyncEvery   time.Duration
 	WALCompactEvery time.Duration
+	WALIndexEvery   int
+	WALShards       int
+	WALLockWait     time.Duration // WAL_DIR/LOCK занят: ждать столько (0 — сразу не стартовать)
+
+	// сегмент закрывается не позже WALRotateEvery и после WALIdleSealAfter без записей
+	WALRotateEvery   time.Duration
+	WALIdleSealAfter time.Duration
+	WALCompress      string // zstd | none: сжатие закрытых сегментов
+
+	WALKeys walKeyRing // WAL_ENCRYPT_KEYS(_FILE), WAL_ENCRYPT_KEY_ID: шифрование сегментов
+
+	WALImportMaxMB int // предел архива для /admin/wal/import
+
+	// group commit: ответ на эти события — только после fsync (см. wal_sync.go)
+	WALSyncEvents    []string
+	WALSyncGroupWait time.Duration
+	WALSyncTimeout   time.Duration
+
+	// квота WAL_DIR (см. wal_quota.go)
+	WALQuotaMB         int
+	WALQuotaSegments   int
+	WALQuotaPolicy     string
+	WALQuotaKeepEvents []string
+	WALQuotaReadyPct   int
+	WALSpillDir        string
+
+	// file — commit.meta (at-least-once), db — позиция WAL в MySQL в одной транзакции с батчем
+	WALCommitMode        string
+	WALCursorName        string
+	WALCursorLoadTimeout time.Duration
+}
+
+// SinkConfig — настройки одного sink'а. FLUSH_EVERY/BATCH_MAX по умолчанию общие,
+// переопределяются через SINK_<NAME>_FLUSH_EVERY / SINK_<NAME>_BATCH_MAX.
+type SinkConfig struct {
+	Name       string
+	FlushEvery time.Duration
+	BatchMax   int
+
+	// ретраи одного flush: RetryMax попыток, пауза RetryBackoff, удваивается до RetryBackoffMax
+	RetryMax        int
+	RetryBackoff    time.Duration
+	RetryBackoffMax time.Duration
 }
 
 func loadConfig() Config {
-	return Config{
+	cfg := Config{
 		ListenAddr: env("LISTEN", ":8080"),
 		MySQLDSN:   mustEnv("MYSQL_DSN"),
 
@@ -34,16 +105,170 @@ func loadConfig() Config {
 
 		FlushEvery: envDur("FLUSH_EVERY", 5*time.Minute),
 		BatchMax:   envInt("BATCH_MAX", 2000),
-		QueueSize:  envInt("QUEUE_SIZE", 200_000),
 
 		DomainReloadEvery: envDur("DOMAIN_RELOAD_EVERY", 1*time.Hour),
 		GeoReloadEvery:    envDur("GEO_RELOAD_EVERY", 1*time.Hour),
 
 		ReqMaxInFlight: envInt("REQ_MAX_INFLIGHT", 2000),
 
+		AdminToken: env("ADMIN_TOKEN", ""),
+
+		ReplToken:     env("REPL_TOKEN", ""),
+		ReplMaxBodyMB: envInt("REPL_MAX_BODY_MB", 64),
+
+		ShutdownDrainTimeout: envDur("SHUTDOWN_DRAIN_TIMEOUT", 25*time.Second),
+		ShutdownReadyDelay:   envDur("SHUTDOWN_READY_DELAY", 0),
+
+		DeadLetterSegmentMaxMB: envInt("DEADLETTER_SEGMENT_MAX_MB", 64),
+		DeadLetterMaxMB:        envInt("DEADLETTER_MAX_MB", 1024),
+		DeadLetterRejectQueue:  envInt("DEADLETTER_REJECT_QUEUE", 1024),
+		DeadLetterRejectRate:   envInt("DEADLETTER_REJECT_RATE", 100),
+
+		BatchBodyMaxKB: envInt("BATCH_BODY_MAX_KB", 512),
+		BatchItemsMax:  envInt("BATCH_ITEMS_MAX", 500),
+
 		WALDir:          env("WAL_DIR", "/var/lib/ingest-wal"),
 		WALSegmentMaxMB: envInt("WAL_SEGMENT_MAX_MB", 256),
 		WALFsyncEvery:   envDur("WAL_FSYNC_EVERY", 1*time.Second),
 		WALCompactEvery: envDur("WAL_COMPACT_EVERY", 1*time.Minute),
+		WALIndexEvery:   envInt("WAL_INDEX_EVERY", 4096),
+		WALShards:       envInt("WAL_SHARDS", 1),
+		WALLockWait:     envDur("WAL_LOCK_WAIT", 0),
+
+		WALRotateEvery:   envDur("WAL_ROTATE_EVERY", 0),
+		WALIdleSealAfter: envDur("WAL_IDLE_SEAL_AFTER", 0),
+		WALCompress:      env("WAL_COMPRESS", "none"),
+		WALImportMaxMB:   envInt("WAL_IMPORT_MAX_MB", 4096),
+
+		WALSyncEvents:    splitList(env("WAL_SYNC_EVENTS", "")),
+		WALSyncGroupWait: envDur("WAL_SYNC_GROUP_WAIT", 2*time.Millisecond),
+		WALSyncTimeout:   envDur("WAL_SYNC_TIMEOUT", 500*time.Millisecond),
+
+		WALQuotaMB:         envInt("WAL_QUOTA_MB", 0),
+		WALQuotaSegments:   envInt("WAL_QUOTA_SEGMENTS", 0),
+		WALQuotaPolicy:     env("WAL_QUOTA_POLICY", quotaReject),
+		WALQuotaKeepEvents: splitList(env("WAL_QUOTA_KEEP_EVENTS", "pay")),
+		WALQuotaReadyPct:   envInt("WAL_QUOTA_READY_PCT", 90),
+		WALSpillDir:        env("WAL_SPILL_DIR", ""),
+
+		WALCommitMode:        env("WAL_COMMIT_MODE", "file"),
+		WALCursorName:        env("WAL_CURSOR_NAME", hostname()),
+		WALCursorLoadTimeout: envDur("WAL_CURSOR_LOAD_TIMEOUT", 1*time.Minute),
+	}
+	cfg.Sinks = loadSinks(env("SINKS", "mysql"), cfg.FlushEvery, cfg.BatchMax)
+	for _, ev := range cfg.WALSyncEvents {
+		if _, ok := allowedEvents[ev]; !ok && ev != "*" {
+			log.Fatalf("WAL_SYNC_EVENTS: unknown event %q", ev)
+		}
+	}
+	keys, err := walKeysFromEnv()
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	cfg.WALKeys = keys
+	if cfg.WALCompress != "zstd" && cfg.WALCompress != "none" {
+		log.Fatalf("WAL_COMPRESS: want zstd or none, got %q", cfg.WALCompress)
+	}
+	switch cfg.WALQuotaPolicy {
+	case quotaReject, quotaDropOldest:
+	case quotaSpill:
+		if cfg.WALSpillDir == "" {
+			log.Fatalf("WAL_QUOTA_POLICY=spill needs WAL_SPILL_DIR")
+		}
+	default:
+		log.Fatalf("WAL_QUOTA_POLICY: unknown policy %q", cfg.WALQuotaPolicy)
+	}
+	for _, ev := range cfg.WALQuotaKeepEvents {
+		if _, ok := allowedEvents[ev]; !ok {
+			log.Fatalf("WAL_QUOTA_KEEP_EVENTS: unknown event %q", ev)
+		}
+	}
+	if cfg.hasSink("clickhouse") {
+		cfg.ClickHouse = ClickHouseConfig{
+			URL:      mustEnv("CLICKHOUSE_URL"),
+			Database: env("CLICKHOUSE_DATABASE", "default"),
+			Table:    env("CLICKHOUSE_TABLE", "player_pay_log"),
+			User:     env("CLICKHOUSE_USER", ""),
+			Password: env("CLICKHOUSE_PASSWORD", ""),
+			Timeout:  envDur("CLICKHOUSE_TIMEOUT", 30*time.Second),
+		}
+	}
+	if cfg.hasSink("kafka") {
+		cfg.Kafka = KafkaConfig{
+			Brokers:     splitList(mustEnv("KAFKA_BROKERS")),
+			Topic:       env("KAFKA_TOPIC", "player-events"),
+			KeyBy:       env("KAFKA_KEY", "domain_id"),
+			Acks:        env("KAFKA_ACKS", "all"),
+			Compression: env("KAFKA_COMPRESSION", "zstd"),
+			ClientID:    env("KAFKA_CLIENT_ID", "player-stat-collector"),
+			Timeout:     envDur("KAFKA_TIMEOUT", 30*time.Second),
+
+			MaxBatchBytes: int32(envInt("KAFKA_MAX_BATCH_BYTES", kafkaDefaultMaxBatchBytes)),
+		}
+	}
+	if cfg.hasSink(peerSinkName) {
+		cfg.Peer = PeerConfig{
+			URL:         mustEnv("REPL_PEER_URL"),
+			Token:       mustEnv("REPL_TOKEN"),
+			Source:      cfg.WALCursorName,
+			Mode:        env("REPL_MODE", "async"),
+			SyncTimeout: envDur("REPL_SYNC_TIMEOUT", 200*time.Millisecond),
+			Timeout:     envDur("REPL_TIMEOUT", 10*time.Second),
+			Heartbeat:   envDur("REPL_HEARTBEAT", 5*time.Second),
+		}
+	}
+	return cfg
+}
+
+func (c Config) hasSink(name string) bool {
+	for _, sc := range c.Sinks {
+		if sc.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func loadSinks(list string, flushEvery time.Duration, batchMax int) []SinkConfig {
+	var out []SinkConfig
+	seen := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" || seen[name] {
+			continue
+		}
+		if !validSinkName(name) {
+			log.Fatalf("bad sink name %q", name)
+		}
+		seen[name] = true
+		prefix := "SINK_" + strings.ToUpper(name) + "_"
+		every := flushEvery
+		if name == peerSinkName {
+			every = peerFlushEvery
+		}
+		out = append(out, SinkConfig{
+			Name:       name,
+			FlushEvery: envDur(prefix+"FLUSH_EVERY", every),
+			BatchMax:   envInt(prefix+"BATCH_MAX", batchMax),
+
+			RetryMax:        envInt(prefix+"RETRY_MAX", 10),
+			RetryBackoff:    envDur(prefix+"RETRY_BACKOFF", 300*time.Millisecond),
+			RetryBackoffMax: envDur(prefix+"RETRY_BACKOFF_MAX", 1*time.Minute),
+		})
+	}
+	if len(out) == 0 {
+		log.Fatalf("SINKS is empty")
+	}
+	return out
+}
+
+// имя sink'а идёт в имя commit-файла
+func validSinkName(s string) bool {
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '_') {
+			return false
+		}
 	}
+	return s != ""
 }
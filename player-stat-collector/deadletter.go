@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+/* ---------------- dead-letter ---------------- */
+
+// DeadLetter — append-only сегментированное хранилище WAL_DIR/deadletter/000001.jsonl, ...
+// Одна JSON-строка на запись. Сюда попадает всё, что мы НЕ донесли до sink'ов:
+//   - corrupt_wal_line — строка JSON-сегмента WAL, которую не удалось разобрать
+//   - corrupt_wal_record — запись бинарного сегмента WAL с неверным crc или неразбираемым событием
+//   - bad_event, unknown_domain, bad_request — запрос не прошёл валидацию (/log, /e/, /batch)
+//   - sink_rejected — sink отверг событие окончательно (PermanentError)
+//   - wal_quota_dropped — сегмент WAL унесён в архив квотой (drop_oldest), сами события в Archive
+//
+// Позиция записи pos = "seg:line" (line 1-based) — по ней листаем /admin/deadletter.
+// С ключами WAL IP посетителя и сырые записи WAL хранятся зашифрованными (см. seal).
+// Старые сегменты удаляются, когда суммарный размер больше maxTotal.
+
+const (
+	reasonCorruptWALLine   = "corrupt_wal_line"
+	reasonCorruptWALRecord = "corrupt_wal_record"
+	reasonSinkRejected     = "sink_rejected"
+	reasonWALQuotaDropped  = "wal_quota_dropped"
+)
+
+type DeadLetterEntry struct {
+	ID     string    `json:"id"`            // uuid записи, из него же event_id при re-inject
+	Pos    string    `json:"pos,omitempty"` // seg:line, заполняется при чтении
+	TS     time.Time `json:"ts"`
+	Reason string    `json:"reason"`
+	Sink   string    `json:"sink,omitempty"`
+	Error  string    `json:"error"`
+
+	// sink_rejected: событие целиком
+	Event *Event `json:"event,omitempty"`
+
+	// отказ на входе: параметры запроса и заголовки, чтобы пересобрать событие при re-inject
+	Params    *eventParams `json:"params,omitempty"`
+	VisitorIP []byte       `json:"visitor_ip,omitempty"`
+	Country   string       `json:"country,omitempty"`
+	// элемент /batch, который не разобрался в params: как пришёл, re-inject его не берёт
+	RawRequest string `json:"raw_request,omitempty"`
+
+	// corrupt_wal_line / corrupt_wal_record: сама строка (запись) и где она была
+	Raw       string `json:"raw,omitempty"`
+	RawRecord []byte `json:"raw_record,omitempty"` // schema+payload бинарной записи
+	WALPos    string `json:"wal_pos,omitempty"`
+
+	// wal_quota_dropped: куда уехал сегмент
+	Archive string `json:"archive,omitempty"`
+
+	// с активным ключом WAL IP и сырые записи WAL открыто не пишутся: они в Sealed
+	// (nonce | AES-GCM(JSON deadLetterSecret)) под ключом KeyID, List расшифровывает обратно
+	KeyID  uint16 `json:"key_id,omitempty"`
+	Sealed []byte `json:"sealed,omitempty"`
+}
+
+// deadLetterSecret — поля записи с IP посетителя (сырая запись WAL тоже его содержит).
+type deadLetterSecret struct {
+	VisitorIP      []byte `json:"visitor_ip,omitempty"`
+	EventVisitorIP []byte `json:"event_visitor_ip,omitempty"`
+	Raw            string `json:"raw,omitempty"`
+	RawRecord      []byte `json:"raw_record,omitempty"`
+}
+
+const deadLetterKeyLabel = "pwal deadletter"
+
+// seal убирает IP и сырые записи в Sealed под активным ключом WAL. Ключ записи выводится из её ID.
+func (e *DeadLetterEntry) seal(keys walKeyRing) error {
+	if keys.active == 0 {
+		return nil
+	}
+	sec := deadLetterSecret{VisitorIP: e.VisitorIP, Raw: e.Raw, RawRecord: e.RawRecord}
+	if e.Event != nil {
+		sec.EventVisitorIP = e.Event.VisitorIP
+	}
+	if len(sec.VisitorIP)+len(sec.EventVisitorIP)+len(sec.Raw)+len(sec.RawRecord) == 0 {
+		return nil
+	}
+	plain, err := json.Marshal(sec)
+	if err != nil {
+		return err
+	}
+	aead, err := keys.deriveAEAD(keys.active, deadLetterKeyLabel, []byte(e.ID))
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	_, _ = rand.Read(nonce)
+
+	e.KeyID = keys.active
+	e.Sealed = aead.Seal(nonce, nonce, plain, []byte(e.ID))
+	e.VisitorIP, e.Raw, e.RawRecord = nil, "", nil
+	if e.Event != nil {
+		ev := *e.Event
+		ev.VisitorIP = nil
+		e.Event = &ev
+	}
+	return nil
+}
+
+// unseal возвращает поля из Sealed. Без ключа KeyID запись остаётся зашифрованной.
+func (e *DeadLetterEntry) unseal(keys walKeyRing) error {
+	if len(e.Sealed) == 0 {
+		return nil
+	}
+	aead, err := keys.deriveAEAD(e.KeyID, deadLetterKeyLabel, []byte(e.ID))
+	if err != nil {
+		return err
+	}
+	ns := aead.NonceSize()
+	if len(e.Sealed) < ns+aead.Overhead() {
+		return errDecrypt
+	}
+	plain, err := aead.Open(nil, e.Sealed[:ns], e.Sealed[ns:], []byte(e.ID))
+	if err != nil {
+		return errDecrypt
+	}
+	var sec deadLetterSecret
+	if err := json.Unmarshal(plain, &sec); err != nil {
+		return err
+	}
+	e.VisitorIP, e.Raw, e.RawRecord = sec.VisitorIP, sec.Raw, sec.RawRecord
+	if e.Event != nil {
+		e.Event.VisitorIP = sec.EventVisitorIP
+	}
+	e.KeyID, e.Sealed = 0, nil
+	return nil
+}
+
+type DeadLetter struct {
+	mu       sync.Mutex
+	dir      string
+	segMax   int64
+	maxTotal int64
+
+	curSeg  int
+	curFile *os.File
+	curSize int64
+	curLine int
+}
+
+func NewDeadLetter(walDir string, segMaxMB, maxTotalMB int) (*DeadLetter, error) {
+	d := &DeadLetter{
+		dir:      filepath.Join(walDir, "deadletter"),
+		segMax:   int64(segMaxMB) * 1024 * 1024,
+		maxTotal: int64(maxTotalMB) * 1024 * 1024,
+	}
+	if err := os.MkdirAll(d.dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	segs, err := d.listSegs()
+	if err != nil {
+		return nil, err
+	}
+
+	// старый единый файл WAL_DIR/deadletter.jsonl (там только sink_rejected) — становится первым сегментом
+	legacy := filepath.Join(walDir, "deadletter.jsonl")
+	if _, err := os.Stat(legacy); err == nil && len(segs) == 0 {
+		if err := os.Rename(legacy, d.segPath(1)); err != nil {
+			return nil, err
+		}
+		segs = []int{1}
+	}
+
+	d.curSeg = 1
+	if len(segs) > 0 {
+		d.curSeg = segs[len(segs)-1]
+	}
+	if err := d.openSeg(d.curSeg); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+func (d *DeadLetter) segPath(seg int) string {
+	return filepath.Join(d.dir, fmt.Sprintf("%06d.jsonl", seg))
+}
+
+func (d *DeadLetter) listSegs() ([]int, error) {
+	entries, err := os.ReadDir(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	for _, e := range entries {
+		base, ok := strings.CutSuffix(e.Name(), ".jsonl")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(base); err == nil {
+			segs = append(segs, n)
+		}
+	}
+	sort.Ints(segs)
+	return segs, nil
+}
+
+func (d *DeadLetter) openSeg(seg int) error {
+	path := d.segPath(seg)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	lines, err := countLines(path)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	if d.curFile != nil {
+		_ = d.curFile.Close()
+	}
+	d.curFile = f
+	d.curSeg = seg
+	d.curSize = st.Size()
+	d.curLine = lines
+	return nil
+}
+
+// Write дописывает запись. durable=true — с fsync: после этого событие можно коммитить в WAL.
+func (d *DeadLetter) Write(e DeadLetterEntry, durable bool) error {
+	if e.ID == "" {
+		e.ID = newEventID()
+	}
+	if e.TS.IsZero() {
+		e.TS = time.Now().UTC()
+	}
+	e.Pos = ""
+	if err := e.seal(walKeys); err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.segMax > 0 && d.curSize >= d.segMax {
+		if err := d.openSeg(d.curSeg + 1); err != nil {
+			return err
+		}
+		d.enforceRetentionLocked()
+	}
+
+	n, err := d.curFile.Write(b)
+	if err != nil {
+		return err
+	}
+	d.curSize += int64(n)
+	d.curLine++
+	mDeadLetterEntries.WithLabelValues(e.Reason).Inc()
+
+	if durable {
+		return d.curFile.Sync()
+	}
+	return nil
+}
+
+// enforceRetentionLocked удаляет самые старые сегменты сверх maxTotal (текущий не трогаем).
+func (d *DeadLetter) enforceRetentionLocked() {
+	if d.maxTotal <= 0 {
+		return
+	}
+	segs, err := d.listSegs()
+	if err != nil {
+		return
+	}
+	sizes := make(map[int]int64, len(segs))
+	var total int64
+	for _, seg := range segs {
+		if st, err := os.Stat(d.segPath(seg)); err == nil {
+			sizes[seg] = st.Size()
+			total += st.Size()
+		}
+	}
+	for _, seg := range segs {
+		if total <= d.maxTotal || seg >= d.curSeg {
+			break
+		}
+		if err := os.Remove(d.segPath(seg)); err == nil {
+			log.Printf("deadletter: retention removed segment %d", seg)
+			total -= sizes[seg]
+		}
+	}
+}
+
+// List читает записи после позиции from ("seg:line", пусто — с начала), не больше limit.
+// reason != "" — фильтр. next — позиция для следующей страницы ("" — дальше ничего нет).
+func (d *DeadLetter) List(from string, limit int, reason string) (items []DeadLetterEntry, next string, err error) {
+	fromSeg, fromLine := 0, 0
+	if from != "" {
+		if fromSeg, fromLine, err = parseSegLine(from); err != nil {
+			return nil, "", err
+		}
+	}
+
+	segs, err := d.listSegs()
+	if err != nil {
+		return nil, "", err
+	}
+
+	for _, seg := range segs {
+		if seg < fromSeg {
+			continue
+		}
+		f, err := os.Open(d.segPath(seg))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // удалён retention'ом
+			}
+			return nil, "", err
+		}
+		rd := bufio.NewReaderSize(f, 64*1024)
+		line := 0
+		for {
+			raw, rerr := rd.ReadBytes('\n')
+			if len(raw) == 0 || raw[len(raw)-1] != '\n' {
+				break // EOF (недописанную строку не отдаём)
+			}
+			line++
+			if seg == fromSeg && line <= fromLine {
+				continue
+			}
+			pos := fmt.Sprintf("%d:%d", seg, line)
+			if len(items) >= limit {
+				_ = f.Close()
+				return items, next, nil
+			}
+			next = pos
+
+			var e DeadLetterEntry
+			if err := json.Unmarshal(bytes.TrimSpace(raw), &e); err != nil {
+				e = DeadLetterEntry{Reason: "unreadable", Error: err.Error(), Raw: string(raw)}
+			}
+			if err := e.unseal(walKeys); err != nil {
+				log.Printf("deadletter: %d:%d: %v", seg, line, err)
+			}
+			if e.Reason == "" && e.Event != nil {
+				e.Reason = reasonSinkRejected // записи из старого deadletter.jsonl
+			}
+			if reason != "" && e.Reason != reason {
+				continue
+			}
+			e.Pos = pos
+			items = append(items, e)
+			if rerr != nil {
+				break
+			}
+		}
+		_ = f.Close()
+	}
+	return items, "", nil
+}
+
+// parseSegLine разбирает "seg:line".
+func parseSegLine(s string) (int, int, error) {
+	a, b, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, 0, fmt.Errorf("bad position %q, want seg:line", s)
+	}
+	seg, err1 := strconv.Atoi(a)
+	line, err2 := strconv.Atoi(b)
+	if err1 != nil || err2 != nil || seg < 0 || line < 0 {
+		return 0, 0, fmt.Errorf("bad position %q, want seg:line", s)
+	}
+	return seg, line, nil
+}
+
+// rejectQueue — отказы на входе (/log, /e/, /batch) от публичных клиентов. Handler только кладёт запись
+// в ограниченную очередь и не ждёт d.mu и диска; пишет одна горутина, не больше perSec записей в секунду.
+// Что не влезло в очередь или в лимит — отбрасывается (ingest_deadletter_rejects_dropped_total).
+type rejectQueue struct {
+	dl     *DeadLetter
+	ch     chan DeadLetterEntry
+	perSec int
+	done   chan struct{}
+}
+
+func newRejectQueue(dl *DeadLetter, size, perSec int) *rejectQueue {
+	q := &rejectQueue{dl: dl, ch: make(chan DeadLetterEntry, size), perSec: perSec, done: make(chan struct{})}
+	go q.run()
+	return q
+}
+
+func (q *rejectQueue) add(e DeadLetterEntry) {
+	select {
+	case q.ch <- e:
+	default:
+		mDeadLetterRejectsDropped.Inc()
+	}
+}
+
+func (q *rejectQueue) run() {
+	defer close(q.done)
+	var window time.Time
+	n := 0
+	for e := range q.ch {
+		if now := time.Now(); now.Sub(window) >= time.Second {
+			window, n = now, 0
+		}
+		if q.perSec > 0 && n >= q.perSec {
+			mDeadLetterRejectsDropped.Inc()
+			continue
+		}
+		n++
+		if err := q.dl.Write(e, false); err != nil {
+			log.Printf("deadletter write failed: %v", err)
+		}
+	}
+}
+
+// Close дописывает очередь. Вызывать, когда handler'ы уже остановлены.
+func (q *rejectQueue) Close() {
+	close(q.ch)
+	<-q.done
+}
+
+// deadLetterRequest — отказ на входе (/log, /e/, /batch) в dead-letter.
+func deadLetterRequest(q *rejectQueue, p *eventParams, ip16 []byte, iso2 string, cause error) {
+	q.add(DeadLetterEntry{
+		Reason:    rejectReason(cause),
+		Error:     cause.Error(),
+		Params:    p,
+		VisitorIP: ip16,
+		Country:   iso2,
+	})
+}
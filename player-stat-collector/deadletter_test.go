@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// withWALKeys ставит ключи процесса на время теста.
+func withWALKeys(t *testing.T, list string) {
+	t.Helper()
+	keys, err := loadWALKeys(list, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := walKeys
+	walKeys = keys
+	t.Cleanup(func() { walKeys = old })
+}
+
+func testWALKey(b byte) string {
+	return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, walKeyLen))
+}
+
+func TestDeadLetterSealsVisitorIP(t *testing.T) {
+	withWALKeys(t, "1:"+testWALKey(1))
+	dir := t.TempDir()
+	dl, err := NewDeadLetter(dir, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip := net.ParseIP("203.0.113.77").To16()
+	ev := Event{EventID: "ev-1", EventName: "play", VisitorIP: ip}
+	entries := []DeadLetterEntry{
+		{Reason: reasonUnknownDomain, Error: "unknown domain", Params: &eventParams{Domain: "x.test"}, VisitorIP: ip},
+		{Reason: reasonSinkRejected, Sink: "mysql", Error: "1265", Event: &ev},
+		{Reason: reasonCorruptWALLine, Error: "bad json", Raw: `{"visitor_ip":"203.0.113.77"}`},
+	}
+	for _, e := range entries {
+		if err := dl.Write(e, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(ev.VisitorIP, ip) {
+		t.Fatal("Write modified caller's event")
+	}
+
+	raw, err := os.ReadFile(filepath.Join(dir, "deadletter", "000001.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range [][]byte{[]byte("203.0.113.77"), []byte(base64.StdEncoding.EncodeToString(ip))} {
+		if bytes.Contains(raw, leak) {
+			t.Fatalf("dead-letter segment contains visitor IP %q:\n%s", leak, raw)
+		}
+	}
+
+	items, _, err := dl.List("", 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 3 {
+		t.Fatalf("%d items, want 3", len(items))
+	}
+	if !bytes.Equal(items[0].VisitorIP, ip) || !bytes.Equal(items[1].Event.VisitorIP, ip) || items[2].Raw != entries[2].Raw {
+		t.Errorf("unsealed entries do not match: %+v", items)
+	}
+	for _, it := range items {
+		if it.Sealed != nil || it.KeyID != 0 {
+			t.Errorf("entry %s still sealed", it.Pos)
+		}
+	}
+
+	// ключ убрали — запись отдаётся зашифрованной, без IP
+	withWALKeys(t, "2:"+testWALKey(2))
+	items, _, err = dl.List("", 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Sealed == nil || items[0].KeyID != 1 || items[0].VisitorIP != nil {
+		t.Errorf("entry without key: %+v", items)
+	}
+}
+
+// Отказы на входе пишутся не чаще лимита, лишнее отбрасывается и считается.
+func TestRejectQueueRateLimit(t *testing.T) {
+	withWALKeys(t, "")
+	dl, err := NewDeadLetter(t.TempDir(), 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dropped := testutil.ToFloat64(mDeadLetterRejectsDropped)
+
+	q := newRejectQueue(dl, 100, 5)
+	for i := 0; i < 50; i++ {
+		deadLetterRequest(q, &eventParams{Domain: "x.test"}, nil, "", reject(reasonUnknownDomain, "unknown domain"))
+	}
+	q.Close()
+
+	items, _, err := dl.List("", 100, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 5 {
+		t.Errorf("%d entries written, want 5", len(items))
+	}
+	if got := testutil.ToFloat64(mDeadLetterRejectsDropped) - dropped; got != 45 {
+		t.Errorf("dropped counter +%v, want +45", got)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
 	"strings"
@@ -12,6 +17,7 @@ import (
 
 type Event struct {
 	TS           time.Time `json:"ts"`
+	EventID      string    `json:"event_id,omitempty"` // клиентский или сгенерированный в WAL.Append
 	UserID       int       `json:"user_id"`
 	DomainID     int       `json:"domain_id"`
 	GeoID        int       `json:"geo_id"`
@@ -20,6 +26,10 @@ type Event struct {
 	VisitorIP    []byte    `json:"visitor_ip"` // 16 bytes
 	FileID       int       `json:"file_id"`
 	EventName    string    `json:"event"`
+
+	// шард и позиция WAL сразу за событием: их заполняет читатель WAL, по ним flusher двигает commit
+	shard int
+	next  CommitPos
 }
 
 var allowedEvents = map[string]struct{}{
@@ -28,15 +38,64 @@ var allowedEvents = map[string]struct{}{
 	"getads": {}, "impression": {}, "p1": {}, "fallback": {}, "loaderror": {},
 }
 
-func buildEvent(r *http.Request, dc *DomainCache, geo *GeoMapper) (Event, error) {
+// eventParams — входные поля события. Одинаковы для GET (/log, /e/<event>) и POST (/batch).
+type eventParams struct {
+	Event        string      `json:"event"`
+	Domain       string      `json:"domain"`
+	FileID       json.Number `json:"file_id"` // принимаем и 123, и "123"
+	ForceCountry string      `json:"force_country"`
+	EventID      string      `json:"event_id"` // опционально, для идемпотентности ретраев клиента
+}
+
+// Причины отказа (reason в dead-letter).
+const (
+	reasonBadEvent      = "bad_event"
+	reasonUnknownDomain = "unknown_domain"
+	reasonBadRequest    = "bad_request"
+)
+
+// rejectError — событие не прошло валидацию; reason идёт в dead-letter.
+type rejectError struct {
+	reason string
+	msg    string
+}
+
+func (e *rejectError) Error() string { return e.msg }
+
+func reject(reason, msg string) error { return &rejectError{reason: reason, msg: msg} }
+
+func rejectReason(err error) string {
+	var re *rejectError
+	if errors.As(err, &re) {
+		return re.reason
+	}
+	return reasonBadRequest
+}
+
+func queryParams(r *http.Request) eventParams {
 	q := r.URL.Query()
+	return eventParams{
+		Event:        q.Get("event"),
+		Domain:       q.Get("domain"),
+		FileID:       json.Number(q.Get("file_id")),
+		ForceCountry: q.Get("force_country"),
+		EventID:      q.Get("event_id"),
+	}
+}
+
+func buildEvent(r *http.Request, dc *DomainCache, geo *GeoMapper) (Event, error) {
+	return buildEventFrom(r.Context(), queryParams(r), clientIP16(r), r.Header.Get("CF-IPCountry"), dc, geo)
+}
 
-	ev := q.Get("event")
+// buildEventFrom валидирует параметры и обогащает событие (домен, гео).
+// ip16 и iso2 (CF-IPCountry) — из заголовков запроса; force_country из p главнее iso2.
+func buildEventFrom(ctx context.Context, p eventParams, ip16 []byte, iso2 string, dc *DomainCache, geo *GeoMapper) (Event, error) {
+	ev := p.Event
 	if _, ok := allowedEvents[ev]; !ok {
-		return Event{}, errors.New("no event param")
+		return Event{}, reject(reasonBadEvent, "no event param")
 	}
 
-	domainName := strings.ToLower(strings.TrimSpace(q.Get("domain")))
+	domainName := strings.ToLower(strings.TrimSpace(p.Domain))
 
 	// если в рефе есть домен - используется он
 	// refDomain := refererDomain(r)
@@ -51,28 +110,32 @@ func buildEvent(r *http.Request, dc *DomainCache, geo *GeoMapper) (Event, error)
 	// }
 
 	if domainName == "" {
-		return Event{}, errors.New("no domain param")
+		return Event{}, reject(reasonBadRequest, "no domain param")
 	}
 
-	fileID, err := strconv.Atoi(q.Get("file_id"))
+	fileID, err := strconv.Atoi(string(p.FileID))
 	if err != nil || fileID <= 0 {
-		return Event{}, errors.New("no file_id param")
+		return Event{}, reject(reasonBadRequest, "no file_id param")
 	}
 
-	drow, err := dc.Get(r.Context(), domainName)
+	eventID := strings.TrimSpace(p.EventID)
+	if eventID != "" && !validEventID(eventID) {
+		return Event{}, reject(reasonBadRequest, "bad event_id param")
+	}
+
+	drow, err := dc.Get(ctx, domainName)
 	if err != nil {
-		return Event{}, errors.New("domain not found (" + domainName + "):" + err.Error())
+		return Event{}, reject(reasonUnknownDomain, "domain not found ("+domainName+"):"+err.Error())
 	}
 
-	ip16 := clientIP16(r)
-	iso2 := r.Header.Get("CF-IPCountry")
-	forceCountry := q.Get("force_country")
+	forceCountry := p.ForceCountry
 	if forceCountry != "" {
 		iso2 = forceCountry
 	}
 
 	event := Event{
 		TS:           time.Now().UTC(),
+		EventID:      eventID,
 		UserID:       drow.ParentID,
 		DomainID:     drow.ID,
 		DomainTypeID: drow.DomainTypeID,
@@ -91,3 +154,31 @@ func buildEvent(r *http.Request, dc *DomainCache, geo *GeoMapper) (Event, error)
 
 	return event, nil
 }
+
+// validEventID: UUID или любой другой id из [A-Za-z0-9_-], 8..64 символа (колонка VARCHAR(64)).
+func validEventID(s string) bool {
+	if len(s) < 8 || len(s) > 64 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// newEventID генерирует UUID v4.
+func newEventID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		// crypto/rand на linux не падает; на всякий случай — время
+		binary.BigEndian.PutUint64(b[:8], uint64(time.Now().UnixNano()))
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
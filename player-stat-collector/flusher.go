@@ -2,105 +2,172 @@ package main
 
 import (
 	"context"
-	"database/sql"
 	"log"
-	"strings"
 	"time"
 )
 
 /* ---------------- flusher ---------------- */
 
-func insertBatch(ctx context.Context, db *sql.DB, batch []Event) error {
-	sb := strings.Builder{}
-	sb.WriteString(`INSERT INTO player_pay_log
-(created_at,user_id,domain_id,geo_id,geo_group_id,domain_type_id,visitor_ip,file_id,event) VALUES `)
-
-	args := make([]any, 0, len(batch)*8)
-	for i, e := range batch {
-		if i > 0 {
-			sb.WriteString(",")
-		}
-		sb.WriteString("(?,?,?,?,?,?,?,?,?)")
-		args = append(args, e.TS, e.UserID, e.DomainID, e.GeoID, e.GeoGroupID, e.DomainTypeID, e.VisitorIP, e.FileID, e.EventName)
-	}
-
-	ctxTO, cancel := context.WithTimeout(ctx, 10*time.Second)
-	defer cancel()
+// commitSetter — куда flusher двигает позицию после записи батча: commit-курсоры WAL
+// (*ShardedWAL) или собственный курсор replay.
+type commitSetter interface {
+	SetCommit(name string, next []ShardPos) error
+}
 
-	_, err := db.ExecContext(ctxTO, sb.String(), args...)
-	return err
+// eventSource — откуда flusher берёт события: курсор sink'а в WAL (walSource) или replay (chanSource).
+type eventSource interface {
+	// Fill дописывает в buf то, что можно прочитать сейчас, но не больше max событий; не блокируется.
+	// done — событий больше не будет.
+	Fill(buf []Event, max int) (out []Event, done bool)
+	// Ready срабатывает, когда появились новые события.
+	Ready() <-chan struct{}
 }
 
-func flusher(ctx context.Context, db *sql.DB, wal *WAL, ch <-chan Event, flushEvery time.Duration, batchMax int) {
+// flusher читает события sink'а из src в buf и пишет их батчами. buf — единственная копия событий
+// в памяти: пока батч не записан, src дальше не читается. У каждого sink свой commit-курсор в каждом шарде WAL.
+// Отмена ctx — остановка: дочитываем src до конца и выходим; hard — жёсткий дедлайн, недописанное остаётся в WAL.
+func flusher(ctx, hard context.Context, wal commitSetter, sink Sink, dl *DeadLetter, src eventSource, sc SinkConfig) {
+	flushEvery, batchMax := sc.FlushEvery, sc.BatchMax
 	t := time.NewTicker(flushEvery)
 	defer t.Stop()
 
+	name := sink.Name()
+	bufLen := mBufLen.WithLabelValues(name)
+
 	buf := make([]Event, 0, batchMax)
-	blocked := false // если true — не читаем из ch, пока не запишем buf
+	blocked := false // если true — не читаем src, пока не запишем buf
+
+	// write пишет батч и двигает commit курсора sink'а
+	write := func(batch []Event) error {
+		next := batchCommits(batch)
+		if err := sink.Write(hard, batch, next); err != nil {
+			return err
+		}
+		// успех: двигаем commit каждого шарда за его последнее событие батча
+		if err := wal.SetCommit(name, next); err != nil {
+			log.Printf("wal commit advance failed sink=%s: %v", name, err)
+		}
+		mFlushed.WithLabelValues(name).Add(float64(len(batch)))
+		return nil
+	}
+
+	// deadLetter убирает одно отвергнутое событие: dead-letter, затем commit за ним
+	deadLetter := func(ev Event, cause error) error {
+		dle := DeadLetterEntry{Reason: reasonSinkRejected, Sink: name, Error: cause.Error(), Event: &ev}
+		if err := dl.Write(dle, true); err != nil {
+			return err
+		}
+		next := []ShardPos{{Shard: ev.shard, Pos: ev.next}}
+		if cs, ok := sink.(commitSaver); ok {
+			if err := cs.SaveCommit(hard, next); err != nil {
+				return err
+			}
+		}
+		if err := wal.SetCommit(name, next); err != nil {
+			log.Printf("wal commit advance failed sink=%s: %v", name, err)
+		}
+		mDeadLet.WithLabelValues(name).Inc()
+		log.Printf("dead-letter sink=%s event_id=%s event=%s: %v", name, ev.EventID, ev.EventName, cause)
+		return nil
+	}
+
+	// writeIsolating пишет батч; если sink отверг его окончательно — делит пополам,
+	// пока не найдёт плохие события. Возвращает, сколько событий с начала батча
+	// обработано (записано или в dead-letter) — они уже закоммичены.
+	var writeIsolating func(batch []Event) (int, error)
+	writeIsolating = func(batch []Event) (int, error) {
+		err := write(batch)
+		if err == nil {
+			return len(batch), nil
+		}
+		if !isPermanent(err) {
+			return 0, err
+		}
+		if len(batch) == 1 {
+			if err := deadLetter(batch[0], err); err != nil {
+				return 0, err
+			}
+			return 1, nil
+		}
+		mid := len(batch) / 2
+		n, err := writeIsolating(batch[:mid])
+		if err != nil {
+			return n, err
+		}
+		m, err := writeIsolating(batch[mid:])
+		return n + m, err
+	}
 
 	flush := func() bool {
 		if len(buf) == 0 {
 			return true
 		}
-		mBufLen.Set(float64(len(buf)))
-
-		backoff := 300 * time.Millisecond
-		for attempt := 1; attempt <= 10; attempt++ {
-			if err := insertBatch(ctx, db, buf); err != nil {
-				mFlushErr.Inc()
-				log.Printf("flush failed attempt=%d err=%v", attempt, err)
+		bufLen.Set(float64(len(buf)))
+
+		backoff := sc.RetryBackoff
+		for attempt := 1; attempt <= sc.RetryMax; attempt++ {
+			done, err := writeIsolating(buf)
+			// обработанный префикс уже закоммичен — убираем его из buf
+			buf = buf[:copy(buf, buf[done:])]
+			bufLen.Set(float64(len(buf)))
+			if err != nil {
+				mFlushErr.WithLabelValues(name).Inc()
+				log.Printf("flush failed sink=%s attempt=%d err=%v", name, attempt, err)
 				select {
 				case <-time.After(backoff):
-					backoff *= 2
+					backoff = min(backoff*2, sc.RetryBackoffMax)
 					continue
-				case <-ctx.Done():
+				case <-hard.Done():
 					return false
 				}
 			}
-
-			// успех: двигаем commit на len(buf)
-			if err := wal.AdvanceCommit(len(buf)); err != nil {
-				log.Printf("wal commit advance failed: %v", err)
-			}
-
-			mFlushed.Add(float64(len(buf)))
-			buf = buf[:0]
-			mBufLen.Set(0)
 			return true
 		}
 
 		// ВАЖНО: НЕ ДРОПАЕМ buf!
 		// Просто остаёмся blocked и будем пытаться позже.
-		log.Printf("flush still failing; keep %d events in memory; WAL already has them", len(buf))
+		log.Printf("flush still failing sink=%s; keep %d events in memory; WAL already has them", name, len(buf))
 		return false
 	}
 
+	stop := ctx.Done()
+	stopping := false
 	for {
-		// если blocked=true, отключаем приём новых событий
-		var inCh <-chan Event
+		done := false
 		if !blocked {
-			inCh = ch
-		} else {
-			inCh = nil
+			n := len(buf)
+			buf, done = src.Fill(buf, batchMax)
+			bufLen.Set(float64(len(buf)))
+			// остановка: читать больше нечего — WAL дочитан
+			done = done || stopping && len(buf) == n && len(buf) < batchMax
+		}
+		if done {
+			if flush() {
+				log.Printf("flusher sink=%s: drained", name)
+			}
+			return
+		}
+		if len(buf) >= batchMax && !blocked {
+			blocked = !flush()
+			continue
+		}
+		if stopping && !blocked && hard.Err() == nil {
+			continue // дочитываем хвост без ожидания таймера
 		}
 
 		select {
-		case <-ctx.Done():
-			_ = flush()
+		case <-hard.Done():
+			// дедлайн остановки: что не успели — останется в WAL до следующего старта
+			log.Printf("flusher sink=%s: stop deadline, %d events left in WAL", name, len(buf))
 			return
 
+		case <-stop:
+			stopping, stop = true, nil
+
 		case <-t.C:
-			ok := flush()
-			blocked = !ok
-
-		case e := <-inCh:
-			buf = append(buf, e)
-			mQueueLen.Set(float64(len(ch)))
-			mBufLen.Set(float64(len(buf)))
-			if len(buf) >= batchMax {
-				ok := flush()
-				blocked = !ok
-			}
+			blocked = !flush()
+
+		case <-src.Ready():
 		}
 	}
 }
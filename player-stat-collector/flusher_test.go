@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeSink отвергает окончательно батч, в котором есть событие из poison,
+// и (если задано) ретраибельно — первые failFirst вызовов Write.
+type fakeSink struct {
+	poison    map[string]bool
+	failFirst int
+
+	mu      sync.Mutex
+	calls   int
+	written map[string]int
+}
+
+func (s *fakeSink) Name() string { return "fake" }
+
+func (s *fakeSink) Write(ctx context.Context, batch []Event, next []ShardPos) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if s.calls <= s.failFirst {
+		return errors.New("sink unavailable")
+	}
+	for _, e := range batch {
+		if s.poison[e.EventID] {
+			return &PermanentError{Err: errors.New("bad row " + e.EventID)}
+		}
+	}
+	if s.written == nil {
+		s.written = map[string]int{}
+	}
+	for _, e := range batch {
+		s.written[e.EventID]++
+	}
+	return nil
+}
+
+// shardedTestEvents — n событий, разложенных по shards шардам по кругу, с растущими позициями в каждом.
+func shardedTestEvents(n, shards int) []Event {
+	out := make([]Event, n)
+	for i := range out {
+		sh := i % shards
+		line := i/shards + 1
+		out[i] = Event{
+			TS:        time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			EventID:   "ev-" + strconv.Itoa(i),
+			FileID:    i + 1,
+			EventName: "play",
+			shard:     sh,
+			next:      CommitPos{Seg: 1, Line: line, Off: int64(line) * 64},
+		}
+	}
+	return out
+}
+
+// lastCommits — последняя закоммиченная позиция каждого шарда.
+func lastCommits(commits [][]ShardPos) map[int]CommitPos {
+	out := map[int]CommitPos{}
+	for _, c := range commits {
+		for _, sp := range c {
+			out[sp.Shard] = sp.Pos
+		}
+	}
+	return out
+}
+
+func TestFlusherIsolatesPermanentErrors(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		n, shards int
+		poison    []string
+		failFirst int
+	}{
+		{name: "one shard", n: 8, shards: 1, poison: []string{"ev-5"}},
+		{name: "first and last", n: 7, shards: 1, poison: []string{"ev-0", "ev-6"}},
+		// ev-7 — последнее событие шарда 1: его commit приходит только из dead-letter
+		{name: "across shards", n: 9, shards: 3, poison: []string{"ev-2", "ev-7"}},
+		{name: "all rejected", n: 4, shards: 2, poison: []string{"ev-0", "ev-1", "ev-2", "ev-3"}},
+		// ретраибельная ошибка не превращает батч в dead-letter и не дублирует записанное
+		{name: "retry then isolate", n: 6, shards: 2, poison: []string{"ev-3"}, failFirst: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			poison := map[string]bool{}
+			for _, id := range tc.poison {
+				poison[id] = true
+			}
+			sink := &fakeSink{poison: poison, failFirst: tc.failFirst}
+			batch := shardedTestEvents(tc.n, tc.shards)
+			commits, dl := runTestFlusher(t, sink, batch)
+
+			items, _, err := dl.List("", 100, reasonSinkRejected)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dead := map[string]bool{}
+			for _, it := range items {
+				if it.Event == nil || it.Sink != "fake" {
+					t.Fatalf("dead-letter entry %+v", it)
+				}
+				dead[it.Event.EventID] = true
+			}
+			if len(items) != len(poison) {
+				t.Errorf("dead-letter has %d entries, want %d", len(items), len(poison))
+			}
+
+			sink.mu.Lock()
+			defer sink.mu.Unlock()
+			for _, e := range batch {
+				want := 1
+				if poison[e.EventID] {
+					want = 0
+					if !dead[e.EventID] {
+						t.Errorf("%s not in dead-letter", e.EventID)
+					}
+				}
+				if got := sink.written[e.EventID]; got != want {
+					t.Errorf("%s written %d times, want %d", e.EventID, got, want)
+				}
+			}
+
+			got, _ := commits.snapshot()
+			last := lastCommits(got)
+			want := lastCommits([][]ShardPos{batchCommits(batch)})
+			if len(last) != len(want) {
+				t.Fatalf("commits reached shards %v, want %v", last, want)
+			}
+			for sh, pos := range want {
+				if last[sh] != pos {
+					t.Errorf("shard %d committed to %v, want end of batch %v", sh, last[sh], pos)
+				}
+			}
+		})
+	}
+}
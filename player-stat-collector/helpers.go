@@ -190,6 +190,14 @@ func envDur(k string, def time.Duration) time.Duration {
 	return d
 }
 
+func hostname() string {
+	h, err := os.Hostname()
+	if err != nil || h == "" {
+		return "default"
+	}
+	return h
+}
+
 func nullIntTo0(v sql.NullInt64) int {
 	if v.Valid {
 		return int(v.Int64)
@@ -22,6 +22,8 @@ func normalizePathForMetrics(r *http.Request) string {
 	switch {
 	case p == "/log":
 		return "/log"
+	case p == "/batch":
+		return "/batch"
 	case strings.HasPrefix(p, "/e/"):
 		return "/e/*" // ВАЖНО: не /e/<event>
 	case p == "/healthz":
@@ -34,6 +36,8 @@ func normalizePathForMetrics(r *http.Request) string {
 		return "/debug/domain-cache"
 	case p == "/debug/country-cache":
 		return "/debug/country-cache"
+	case strings.HasPrefix(p, "/admin/"):
+		return "/admin/*"
 	case strings.HasPrefix(p, "/metrics/"):
 		return "/metrics" // скрытый путь
 	default:
@@ -3,10 +3,18 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -18,40 +26,149 @@ func init() {
 	prometheus.MustRegister(
 		mPlayerEvent,
 		mReqTotal, mReqDur,
-		mEnqueued, mDropped, mFlushed, mFlushErr,
-		mQueueLen, mBufLen,
-		mWALBytes, mWALSegs, mWALReplay, mWALAppendErr,
+		mEnqueued, mDropped, mFlushed, mFlushErr, mDeadLet, mMySQLDuplicates, mDeadLetterEntries, mDeadLetterRejectsDropped,
+		mSinkLag, mBufLen,
+		mWALBytes, mWALSegs, mWALReplay, mWALAppendErr, mWALTornTail, mWALCorruptTail,
+		mWALGroupSyncs, mWALSyncWait, mWALSyncTimeouts,
+		mWALQuotaUsed, mWALQuotaDropped, mWALQuotaRejected, mWALSpilled,
+		mWALRotations, mWALCompressed, mWALCompressSaved,
+		mReplSyncWait, mReplSyncTimeouts, mReplPeerUp, mReplReceived, mReplPromoted,
 	)
 }
 
-var walNotify = make(chan struct{}, 1) // глобально/в main
-
 func main() {
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(os.Args[1:]))
+	}
+
 	cfg := loadConfig()
+	walKeys = cfg.WALKeys
+	if walKeys.active != 0 {
+		log.Printf("WAL: encrypting new segments with key %d (%d keys loaded)", walKeys.active, len(walKeys.keys))
+	}
 
 	db := mustDB(cfg.MySQLDSN)
 	defer db.Close()
 
-	wal, err := NewWAL(cfg.WALDir, cfg.WALSegmentMaxMB, cfg.WALFsyncEvery)
+	// всё, что не донесли до sink'ов: битые строки WAL, отказы на входе, отказы sink'ов
+	dl, err := NewDeadLetter(cfg.WALDir, cfg.DeadLetterSegmentMaxMB, cfg.DeadLetterMaxMB)
+	if err != nil {
+		log.Fatalf("deadletter init: %v", err)
+	}
+	// отказы на входе — мимо handler'а, через очередь с лимитом
+	rejects := newRejectQueue(dl, cfg.DeadLetterRejectQueue, cfg.DeadLetterRejectRate)
+
+	walOpts := WALOptions{
+		Dir:          cfg.WALDir,
+		SegmentMaxMB: cfg.WALSegmentMaxMB,
+		FsyncEvery:   cfg.WALFsyncEvery,
+		IndexEvery:   cfg.WALIndexEvery,
+		RotateEvery:  cfg.WALRotateEvery,
+		IdleSeal:     cfg.WALIdleSealAfter,
+		Compress:     cfg.WALCompress == "zstd",
+		LockWait:     cfg.WALLockWait,
+
+		SyncEvents:    cfg.WALSyncEvents,
+		SyncGroupWait: cfg.WALSyncGroupWait,
+		SyncTimeout:   cfg.WALSyncTimeout,
+
+		Quota: WALQuota{
+			MaxBytes:    int64(cfg.WALQuotaMB) << 20,
+			MaxSegments: cfg.WALQuotaSegments,
+			Policy:      cfg.WALQuotaPolicy,
+			KeepEvents:  cfg.WALQuotaKeepEvents,
+			SpillDir:    cfg.WALSpillDir,
+			ArchiveDir:  filepath.Join(cfg.WALDir, "deadletter", "wal-archive"),
+			OnDrop: func(shard, seg int, archive string, records int) {
+				dle := DeadLetterEntry{
+					Reason:  reasonWALQuotaDropped,
+					Error:   fmt.Sprintf("wal quota exceeded: %d records dropped", records),
+					WALPos:  fmt.Sprintf("%d:%d", shard, seg),
+					Archive: archive,
+				}
+				if err := dl.Write(dle, false); err != nil {
+					log.Printf("deadletter write failed: %v", err)
+				}
+			},
+		},
+	}
+	sinks := make([]Sink, 0, len(cfg.Sinks))
+	for _, sc := range cfg.Sinks {
+		sink, store, err := newSink(sc, cfg, db)
+		if err != nil {
+			log.Fatalf("sink %s: %v", sc.Name, err)
+		}
+		sinks = append(sinks, sink)
+		walOpts.Cursors = append(walOpts.Cursors, WALCursor{Name: sc.Name, Store: store})
+	}
+
+	wal, err := NewShardedWAL(walOpts, cfg.WALShards)
 	if err != nil {
 		log.Fatalf("wal init: %v", err)
 	}
 
-	events := make(chan Event, cfg.QueueSize)
+	// реплики соседей на этом инстансе: /repl/append и promote
+	replicas := newReplicaSet(cfg.WALDir, walOpts, wal)
+
 	dc := NewDomainCache(db, cfg.DomainReloadEvery)
 	geo := NewGeoMapper(db, cfg.GeoReloadEvery)
 
+	// ctx — обычная работа, отменяется по SIGTERM (начало остановки);
+	// hardCtx — жёсткий дедлайн остановки: после него flusher'ы бросают недописанное (оно в WAL)
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
+	hardCtx, hardCancel := context.WithCancel(context.Background())
+	defer hardCancel()
+
+	// репликация WAL на peer'а: heartbeat, подрезка реплики по commit'ам остальных sink'ов
+	for _, sink := range sinks {
+		peer, ok := sink.(*PeerSink)
+		if !ok {
+			continue
+		}
+		var others []string
+		for _, sc := range cfg.Sinks {
+			if sc.Name != peerSinkName {
+				others = append(others, sc.Name)
+			}
+		}
+		peer.flushed = func() []ShardPos { return flushedPos(wal, others) }
+		if cfg.Peer.Mode == "sync" {
+			wal.replWait = peer.waitAck
+		}
+		log.Printf("repl: replicating WAL to %s as %q (%s)", cfg.Peer.URL, cfg.Peer.Source, cfg.Peer.Mode)
+		go peer.Run(ctx)
+	}
 
 	// background geo refresh
 	go geo.Run(ctx)
 	// background domain refresh
 	go dc.Run(ctx)
 
-	// wal tail reader
-	tailer := NewWALTailer(wal)
-	go tailer.Run(ctx, events, walNotify)
+	// на каждый sink: flusher читает свой курсор во всех шардах WAL и пишет батчами
+	var pipes sync.WaitGroup
+	for i, sink := range sinks {
+		sc := cfg.Sinks[i]
+		// битые записи в dead-letter пишет только первый sink
+		var srcDL *DeadLetter
+		if i == 0 {
+			srcDL = dl
+		}
+		src := newWALSource(wal, sc.Name, srcDL)
+		pipes.Add(1)
+		go func() {
+			defer pipes.Done()
+			defer src.Close()
+			flusher(ctx, hardCtx, wal, sink, dl, src, sc)
+		}()
+	}
+
+	// индексы закрытых сегментов, которых нет (после обновления или падения)
+	go func() {
+		if err := wal.IndexSegments(); err != nil {
+			log.Printf("WAL: index segments: %v", err)
+		}
+	}()
 
 	// background WAL compact + stats gauges
 	go func() {
@@ -63,19 +180,18 @@ func main() {
 				return
 			case <-t.C:
 				_ = wal.Compact()
-				cp, segs, bytes, err := wal.Stats()
+				segs, bytes, err := wal.Stats()
 				if err == nil {
 					mWALSegs.Set(float64(segs))
 					mWALBytes.Set(float64(bytes))
-					_ = cp // used in /stats
+				}
+				for _, sc := range cfg.Sinks {
+					mSinkLag.WithLabelValues(sc.Name).Set(float64(wal.LagBytes(sc.Name)))
 				}
 			}
 		}
 	}()
 
-	// start flusher
-	go flusher(ctx, db, wal, events, cfg.FlushEvery, cfg.BatchMax)
-
 	mux := http.NewServeMux()
 	mux.Handle("/metrics/w8Z", promhttp.Handler())
 
@@ -84,7 +200,18 @@ func main() {
 		_, _ = w.Write([]byte("ok\n"))
 	})
 
+	var draining atomic.Bool
 	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		// при остановке первым делом уходим из балансировки
+		if draining.Load() {
+			http.Error(w, "draining", http.StatusServiceUnavailable)
+			return
+		}
+		// WAL почти упёрся в квоту — уводим трафик, пока не начали отказывать
+		if cfg.WALQuotaReadyPct > 0 && wal.QuotaRatio() >= float64(cfg.WALQuotaReadyPct)/100 {
+			http.Error(w, "wal quota", http.StatusServiceUnavailable)
+			return
+		}
 		ctxTO, cancel := context.WithTimeout(r.Context(), 2*time.Second)
 		defer cancel()
 		if err := db.PingContext(ctxTO); err != nil {
@@ -96,33 +223,11 @@ func main() {
 	})
 
 	// /log?event=...&domain=...&file_id=...
-	handleLog := func(w http.ResponseWriter, r *http.Request) {
-		ev, err := buildEvent(r, dc, geo)
-		if err != nil {
-			mDropped.Inc()
-			http.Error(w, fmt.Errorf("bad request: %v", err).Error(), 400)
-			return
-		}
-
-		if _, err := wal.Append(ev); err != nil {
-			mWALAppendErr.Inc()
-			mDropped.Inc()
-			http.Error(w, "wal write failed", 500)
-			return
-		}
-
-		// разбудить tailer (non-blocking)
-		select {
-		case walNotify <- struct{}{}:
-		default:
-		}
-
-		w.WriteHeader(http.StatusAccepted)
-		_, _ = w.Write([]byte("ok\n"))
-
-	}
+	logHandler := handleLog(wal, dc, geo, rejects)
+	mux.HandleFunc("/log", logHandler)
 
-	mux.HandleFunc("/log", handleLog)
+	// POST /batch: JSON-массив или NDJSON (в т.ч. navigator.sendBeacon)
+	mux.HandleFunc("/batch", handleBatch(wal, dc, geo, rejects, int64(cfg.BatchBodyMaxKB)*1024, cfg.BatchItemsMax))
 
 	mux.HandleFunc("/e/", func(w http.ResponseWriter, r *http.Request) {
 		evName := strings.TrimPrefix(r.URL.Path, "/e/")
@@ -138,7 +243,7 @@ func main() {
 		r.URL.RawQuery = q.Encode()
 
 		// метрики можно пометить как /e/* отдельно, если хочешь:
-		handleLog(w, r)
+		logHandler(w, r)
 	})
 
 	mux.HandleFunc("/debug/domain-cache", func(w http.ResponseWriter, r *http.Request) {
@@ -164,23 +269,55 @@ func main() {
 
 	// human-friendly stats
 	mux.HandleFunc("/debug/wal", func(w http.ResponseWriter, r *http.Request) {
-		cp, segs, bytes, _ := wal.Stats()
+		segs, bytes, _ := wal.Stats()
 
-		wal.readMu.Lock()
-		rp := wal.readPos
-		wal.readMu.Unlock()
+		sinksInfo := make(map[string]any, len(cfg.Sinks))
+		for _, sc := range cfg.Sinks {
+			sinksInfo[sc.Name] = map[string]any{"lag_bytes": wal.LagBytes(sc.Name)}
+		}
+
+		// по шардам: сегменты и позиции каждого sink
+		shards := make([]map[string]any, 0, len(wal.Shards()))
+		for i, sw := range wal.Shards() {
+			cps, _, _, _ := sw.Stats()
+			segInfo, _ := sw.Segments()
+			reads := make(map[string]CommitPos, len(cfg.Sinks))
+			for _, sc := range cfg.Sinks {
+				reads[sc.Name] = sw.ReadPos(sc.Name)
+			}
+			info := map[string]any{
+				"shard":    i,
+				"segments": segInfo,
+				"commit":   cps,
+				"read_pos": reads,
+			}
+			if sw.quota.enabled() {
+				info["quota_used"] = sw.quotaRatio()
+			}
+			shards = append(shards, info)
+		}
 
 		resp := map[string]any{
-			"queue_len":      len(events),
 			"wal_segments":   segs,
 			"wal_size_bytes": bytes,
-			"commit":         cp,
-			"read_pos":       rp,
+			"shards":         shards,
+			"sinks":          sinksInfo,
 		}
 		w.Header().Set("Content-Type", "application/json")
 		_ = json.NewEncoder(w).Encode(resp)
 	})
 
+	// admin: Authorization: Bearer $ADMIN_TOKEN
+	mux.HandleFunc("/admin/deadletter", requireAdmin(cfg.AdminToken, handleDeadLetterList(dl)))
+	mux.HandleFunc("/admin/deadletter/reinject", requireAdmin(cfg.AdminToken, handleDeadLetterReinject(wal, dc, geo, 64<<20)))
+	importer := &handoffImporter{wal: wal, dir: filepath.Join(cfg.WALDir, "imports")}
+	mux.HandleFunc("/admin/wal/import", requireAdmin(cfg.AdminToken, handleWALImport(importer, int64(cfg.WALImportMaxMB)<<20)))
+	mux.HandleFunc("/admin/repl", requireAdmin(cfg.AdminToken, handleReplAdmin(replicas)))
+	mux.HandleFunc("/admin/repl/", requireAdmin(cfg.AdminToken, handleReplAdmin(replicas)))
+
+	// приём репликации от соседа: Authorization: Bearer $REPL_TOKEN
+	mux.HandleFunc("/repl/append", requireAdmin(cfg.ReplToken, handleReplAppend(replicas, int64(cfg.ReplMaxBodyMB)<<20)))
+
 	lim := newLimiter(cfg.ReqMaxInFlight)
 	handler := lim.Wrap(mux)
 
@@ -203,7 +340,102 @@ func main() {
 		WriteTimeout:      10 * time.Second,
 		IdleTimeout:       60 * time.Second,
 	}
+	// HTTP/2 без TLS (prior knowledge) — для репликации с соседа; обычные клиенты идут по HTTP/1.1
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetUnencryptedHTTP2(true)
+
+	go func() {
+		log.Printf("listening on %s, wal=%s", cfg.ListenAddr, cfg.WALDir)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	log.Printf("shutdown: got %v, drain timeout %s", <-sig, cfg.ShutdownDrainTimeout)
+	deadline := time.Now().Add(cfg.ShutdownDrainTimeout)
 
-	log.Printf("listening on %s, wal=%s", cfg.ListenAddr, cfg.WALDir)
-	log.Fatal(srv.ListenAndServe())
+	// 1. readyz -> 503 и даём балансировщику заметить
+	draining.Store(true)
+	time.Sleep(cfg.ShutdownReadyDelay)
+
+	// 2. перестаём принимать запросы, дожидаемся текущих
+	shCtx, shCancel := context.WithDeadline(context.Background(), deadline)
+	if err := srv.Shutdown(shCtx); err != nil {
+		log.Printf("shutdown: http: %v", err)
+	}
+	shCancel()
+	rejects.Close()
+
+	// 3. flusher'ы дочитывают хвост WAL и пишут его в sinks
+	cancel()
+	pipesDone := make(chan struct{})
+	go func() {
+		pipes.Wait()
+		close(pipesDone)
+	}()
+	select {
+	case <-pipesDone:
+	case <-time.After(time.Until(deadline)):
+		log.Printf("shutdown: drain timeout, the rest stays in WAL")
+		hardCancel()
+		<-pipesDone
+	}
+
+	// 4. закрываем sinks, fsync сегмента и commit-файлов
+	for _, sink := range sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("shutdown: sink %s close: %v", sink.Name(), err)
+			}
+		}
+	}
+	replicas.Close()
+	if err := wal.Close(); err != nil {
+		log.Printf("shutdown: wal close: %v", err)
+	}
+	log.Printf("shutdown: done")
+}
+
+// handleLog — GET /log?event=...&domain=...&file_id=... (и /e/<event>): одно событие в WAL.
+func handleLog(wal *ShardedWAL, dc *DomainCache, geo *GeoMapper, rejects *rejectQueue) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ev, err := buildEvent(r, dc, geo)
+		if err != nil {
+			mDropped.Inc()
+			p := queryParams(r)
+			deadLetterRequest(rejects, &p, clientIP16(r), r.Header.Get("CF-IPCountry"), err)
+			http.Error(w, fmt.Errorf("bad request: %v", err).Error(), 400)
+			return
+		}
+
+		if wal.Shed(ev) {
+			mDropped.Inc()
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "wal quota exceeded", http.StatusServiceUnavailable)
+			return
+		}
+
+		if _, err := wal.AppendDurable(r.Context(), []Event{ev}); err != nil {
+			if errors.Is(err, errWALSyncTimeout) {
+				// событие в WAL, но fsync не уложился в бюджет: пусть клиент повторит
+				wal.Notify()
+				w.Header().Set("Retry-After", "1")
+				http.Error(w, "wal sync timeout", http.StatusServiceUnavailable)
+				return
+			}
+			mWALAppendErr.Inc()
+			mDropped.Inc()
+			http.Error(w, "wal write failed", 500)
+			return
+		}
+
+		// разбудить flusher'ы (non-blocking)
+		wal.Notify()
+
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = w.Write([]byte("ok\n"))
+	}
 }
@@ -20,15 +20,40 @@ var (
 	)
 
 	mEnqueued = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_events_enqueued_total", Help: "Events enqueued"})
-	mDropped  = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_events_dropped_total", Help: "Events dropped (queue full/bad/wal error)"})
-	mFlushed  = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_events_flushed_total", Help: "Events flushed to MySQL"})
-	mFlushErr = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_flush_errors_total", Help: "Flush errors"})
+	mDropped  = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_events_dropped_total", Help: "Events dropped (bad/wal error/quota)"})
+	mFlushed  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_events_flushed_total", Help: "Events flushed to sink"}, []string{"sink"})
+	mFlushErr = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_flush_errors_total", Help: "Flush errors"}, []string{"sink"})
+	mDeadLet  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_events_dead_lettered_total", Help: "Events rejected by sink permanently and written to dead-letter"}, []string{"sink"})
 
-	mQueueLen = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_queue_length", Help: "In-memory queue length"})
-	mBufLen   = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_batch_buffer_length", Help: "Current batch buffer length"})
+	mMySQLDuplicates = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_mysql_duplicate_events_total", Help: "Events absorbed by UNIQUE event_id: replay of the same event or collision with a different one"}, []string{"kind"})
 
-	mWALBytes     = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_wal_size_bytes", Help: "Approx WAL size on disk"})
-	mWALSegs      = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_wal_segments", Help: "Number of WAL segments"})
-	mWALReplay    = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_replay_total", Help: "Events replayed from WAL at startup"})
-	mWALAppendErr = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_append_errors_total", Help: "WAL append errors"})
+	mDeadLetterEntries        = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_deadletter_entries_total", Help: "Dead-letter entries written"}, []string{"reason"})
+	mDeadLetterRejectsDropped = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_deadletter_rejects_dropped_total", Help: "Rejected requests not written to dead-letter: queue full or rate limit"})
+
+	mSinkLag = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ingest_sink_lag_bytes", Help: "WAL bytes between the sink commit and the WAL end"}, []string{"sink"})
+	mBufLen  = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ingest_batch_buffer_length", Help: "Current batch buffer length"}, []string{"sink"})
+
+	mWALBytes        = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_wal_size_bytes", Help: "Approx WAL size on disk"})
+	mWALSegs         = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_wal_segments", Help: "Number of WAL segments"})
+	mWALReplay       = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_replay_total", Help: "Events replayed from WAL at startup"})
+	mWALAppendErr    = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_append_errors_total", Help: "WAL append errors"})
+	mWALGroupSyncs   = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_group_fsyncs_total", Help: "Group-commit fsyncs of the WAL segment"})
+	mWALSyncWait     = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "ingest_wal_sync_wait_seconds", Help: "Time a request waited for its group fsync", Buckets: []float64{.0005, .001, .002, .005, .01, .02, .05, .1, .25, .5, 1}})
+	mWALSyncTimeouts = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_sync_timeouts_total", Help: "Requests answered 503: group fsync exceeded WAL_SYNC_TIMEOUT"})
+	mWALTornTail     = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_torn_tail_total", Help: "Torn WAL segment tails truncated at startup"})
+	mWALCorruptTail  = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_corrupt_tail_total", Help: "WAL segment tails after a bad record frame moved to the archive at startup"})
+
+	mWALQuotaUsed     = prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "ingest_wal_quota_used_ratio", Help: "WAL_DIR usage relative to the shard quota"}, []string{"shard"})
+	mWALQuotaDropped  = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_quota_dropped_segments_total", Help: "WAL segments moved to the archive by drop_oldest quota policy"})
+	mWALQuotaRejected = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_quota_rejected_total", Help: "Events rejected with 503 by reject quota policy"})
+	mWALRotations     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_wal_rotations_total", Help: "WAL segment rotations by reason (size, age, idle)"}, []string{"reason"})
+	mWALCompressed    = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_compressed_segments_total", Help: "Sealed WAL segments compressed with zstd"})
+	mWALCompressSaved = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_compress_saved_bytes_total", Help: "Disk bytes saved by WAL segment compression"})
+	mWALSpilled       = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_wal_spilled_segments_total", Help: "WAL segments created in WAL_SPILL_DIR"})
+
+	mReplSyncWait     = prometheus.NewHistogram(prometheus.HistogramOpts{Name: "ingest_repl_sync_wait_seconds", Help: "Time a request waited for the peer ack (REPL_MODE=sync)", Buckets: []float64{.001, .002, .005, .01, .02, .05, .1, .25, .5, 1}})
+	mReplSyncTimeouts = prometheus.NewCounter(prometheus.CounterOpts{Name: "ingest_repl_sync_timeouts_total", Help: "Requests answered without the peer ack: REPL_SYNC_TIMEOUT exceeded"})
+	mReplPeerUp       = prometheus.NewGauge(prometheus.GaugeOpts{Name: "ingest_repl_peer_up", Help: "Last heartbeat to the replication peer succeeded"})
+	mReplReceived     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_repl_received_events_total", Help: "Events replicated to this instance by source"}, []string{"source"})
+	mReplPromoted     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: "ingest_repl_promoted_events_total", Help: "Replica events promoted into the local WAL by source"}, []string{"source"})
 )
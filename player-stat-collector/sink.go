@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+/* ---------------- sinks ---------------- */
+
+// Sink — получатель событий из WAL. На каждый sink свой flusher, который читает WAL
+// со своего commit-курсора (commit.<name>.meta).
+type Sink interface {
+	Name() string
+
+	// Write пишет батч целиком или возвращает ошибку (тогда батч будет повторён).
+	// next — позиции WAL сразу после последнего события батча в каждом шарде: sink может
+	// сохранить их атомарно с данными (см. MySQLSink + wal_cursor).
+	Write(ctx context.Context, batch []Event, next []ShardPos) error
+}
+
+// commitSaver — sink, который сам хранит позицию WAL (MySQLSink в режиме db).
+// Ему сообщаем и о позиции за событиями, ушедшими в dead-letter, иначе после рестарта
+// курсор из sink'а вернёт их обратно.
+type commitSaver interface {
+	SaveCommit(ctx context.Context, next []ShardPos) error
+}
+
+// PermanentError — sink окончательно отверг данные батча (ретраи не помогут):
+// flusher делит батч пополам, находит плохие события и отправляет их в dead-letter.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string { return "permanent: " + e.Err.Error() }
+func (e *PermanentError) Unwrap() error { return e.Err }
+
+func isPermanent(err error) bool {
+	var pe *PermanentError
+	return errors.As(err, &pe)
+}
+
+// newSink создаёт sink по имени из SINKS. Второе значение — внешний store
+// commit-позиций, если sink хранит их сам (иначе nil).
+func newSink(sc SinkConfig, cfg Config, db *sql.DB) (Sink, ShardCommitStore, error) {
+	switch sc.Name {
+	case "mysql":
+		switch cfg.WALCommitMode {
+		case "file":
+			return NewMySQLSink(db, nil), nil, nil
+		case "db":
+			store := NewMySQLCommitStore(db, cfg.WALCursorName, cfg.WALCursorLoadTimeout)
+			return NewMySQLSink(db, store), store, nil
+		default:
+			return nil, nil, fmt.Errorf("bad WAL_COMMIT_MODE %q (file|db)", cfg.WALCommitMode)
+		}
+	case "clickhouse":
+		sink, err := NewClickHouseSink(cfg.ClickHouse, nil)
+		return sink, nil, err
+	case "kafka":
+		sink, err := NewKafkaSink(cfg.Kafka)
+		return sink, nil, err
+	case peerSinkName:
+		sink, err := NewPeerSink(cfg.Peer, cfg.WALDir)
+		return sink, nil, err
+	default:
+		return nil, nil, fmt.Errorf("unknown sink %q", sc.Name)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+/* ---------------- sink: clickhouse ---------------- */
+
+// ClickHouseSink пишет батч одним запросом в HTTP-интерфейс ClickHouse:
+//
+//	POST {CLICKHOUSE_URL}/?query=INSERT INTO db.table FORMAT JSONEachRow
+//
+// Успех — только ответ 200, любой другой код или обрыв — ошибка, батч повторит flusher,
+// commit-курсор clickhouse не двигается. Ошибки разбора данных (4xx, см. classifyCHError) —
+// PermanentError: flusher найдёт плохую строку и отправит её в dead-letter.
+// Повтор того же батча гасится через insert_deduplication_token
+// (нужен ReplicatedMergeTree или non_replicated_deduplication_window у MergeTree).
+// client подменяется в тестах (httptest.Server, имитирующий HTTP-интерфейс ClickHouse).
+type ClickHouseSink struct {
+	client   *http.Client
+	endpoint string // полный URL с query, собирается один раз
+	user     string
+	password string
+}
+
+type ClickHouseConfig struct {
+	URL      string // http://clickhouse:8123
+	Database string
+	Table    string
+	User     string
+	Password string
+	Timeout  time.Duration
+}
+
+func NewClickHouseSink(cfg ClickHouseConfig, client *http.Client) (*ClickHouseSink, error) {
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("bad CLICKHOUSE_URL %q", cfg.URL)
+	}
+	q := u.Query()
+	q.Set("query", fmt.Sprintf("INSERT INTO %s.%s FORMAT JSONEachRow", quoteCHIdent(cfg.Database), quoteCHIdent(cfg.Table)))
+	q.Set("date_time_input_format", "best_effort")
+	u.RawQuery = q.Encode()
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: cfg.Timeout}
+	}
+	return &ClickHouseSink{
+		client:   client,
+		endpoint: u.String(),
+		user:     cfg.User,
+		password: cfg.Password,
+	}, nil
+}
+
+func (s *ClickHouseSink) Name() string { return "clickhouse" }
+
+// chRow — строка player_pay_log в ClickHouse (см. clickhouse/init.sql).
+type chRow struct {
+	CreatedAt    string `json:"created_at"`
+	EventID      string `json:"event_id"`
+	UserID       int    `json:"user_id"`
+	DomainID     int    `json:"domain_id"`
+	GeoID        int    `json:"geo_id"`
+	GeoGroupID   int    `json:"geo_group_id"`
+	DomainTypeID int    `json:"domain_type_id"`
+	VisitorIP    string `json:"visitor_ip"` // IPv6, v4 как ::ffff:a.b.c.d
+	FileID       int    `json:"file_id"`
+	Event        string `json:"event"`
+}
+
+func (s *ClickHouseSink) Write(ctx context.Context, batch []Event, next []ShardPos) error {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body) // Encode пишет '\n' после каждой строки — это и есть JSONEachRow
+	for _, e := range batch {
+		ip := "::"
+		if len(e.VisitorIP) == net.IPv6len {
+			if v4 := net.IP(e.VisitorIP).To4(); v4 != nil {
+				ip = "::ffff:" + v4.String()
+			} else {
+				ip = net.IP(e.VisitorIP).String()
+			}
+		}
+		if err := enc.Encode(chRow{
+			CreatedAt:    e.TS.UTC().Format("2006-01-02 15:04:05.000"),
+			EventID:      e.EventID,
+			UserID:       e.UserID,
+			DomainID:     e.DomainID,
+			GeoID:        e.GeoID,
+			GeoGroupID:   e.GeoGroupID,
+			DomainTypeID: e.DomainTypeID,
+			VisitorIP:    ip,
+			FileID:       e.FileID,
+			Event:        e.EventName,
+		}); err != nil {
+			return err
+		}
+	}
+
+	endpoint := s.endpoint
+	if token := chDedupToken(batch); token != "" {
+		endpoint += "&insert_deduplication_token=" + token
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	if s.user != "" {
+		req.Header.Set("X-ClickHouse-User", s.user)
+		req.Header.Set("X-ClickHouse-Key", s.password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode != http.StatusOK {
+		return classifyCHError(resp, fmt.Errorf("clickhouse: http %d: %s", resp.StatusCode, bytes.TrimSpace(msg)))
+	}
+	return nil
+}
+
+// Коды ClickHouse (X-ClickHouse-Exception-Code), при которых строка не вставится никогда.
+var chPermanentErrors = map[int]bool{
+	6:   true, // CANNOT_PARSE_TEXT
+	25:  true, // CANNOT_PARSE_ESCAPE_SEQUENCE
+	26:  true, // CANNOT_PARSE_QUOTED_STRING
+	27:  true, // CANNOT_PARSE_INPUT_ASSERTION_FAILED
+	36:  true, // BAD_ARGUMENTS (в т.ч. значение не из Enum event)
+	38:  true, // CANNOT_PARSE_DATE
+	41:  true, // CANNOT_PARSE_DATETIME
+	53:  true, // TYPE_MISMATCH
+	69:  true, // ARGUMENT_OUT_OF_BOUND
+	70:  true, // CANNOT_CONVERT_TYPE
+	72:  true, // CANNOT_PARSE_NUMBER
+	117: true, // INCORRECT_DATA
+	131: true, // TOO_LARGE_STRING_SIZE
+	676: true, // CANNOT_PARSE_IPV4
+	677: true, // CANNOT_PARSE_IPV6
+	691: true, // UNKNOWN_ELEMENT_OF_ENUM
+}
+
+// classifyCHError оборачивает ошибки данных в PermanentError: 4xx с кодом из chPermanentErrors,
+// 400 без кода и 413 (батч больше max_query_size/лимита прокси). Остальное (5xx, 401/403,
+// 404 UNKNOWN_TABLE, ...) — сбой или конфиг, ретраибельно.
+func classifyCHError(resp *http.Response, err error) error {
+	if resp.StatusCode < 400 || resp.StatusCode >= 500 {
+		return err
+	}
+	if resp.StatusCode == http.StatusRequestEntityTooLarge {
+		return &PermanentError{Err: err}
+	}
+	code, cerr := strconv.Atoi(resp.Header.Get("X-ClickHouse-Exception-Code"))
+	if cerr != nil {
+		if resp.StatusCode == http.StatusBadRequest {
+			return &PermanentError{Err: err}
+		}
+		return err
+	}
+	if chPermanentErrors[code] {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// chDedupToken — хэш event_id батча: ретрай того же батча даёт тот же токен,
+// а батчи разных коллекторов не пересекаются. Старые события без event_id — без токена.
+func chDedupToken(batch []Event) string {
+	h := sha256.New()
+	for _, e := range batch {
+		if e.EventID == "" {
+			return ""
+		}
+		h.Write([]byte(e.EventID))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+func quoteCHIdent(s string) string {
+	return "`" + string(bytes.ReplaceAll([]byte(s), []byte("`"), []byte("\\`"))) + "`"
+}
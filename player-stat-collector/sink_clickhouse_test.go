@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chRequest — запрос, который получил поддельный ClickHouse.
+type chRequest struct {
+	query string
+	token string
+	user  string
+	rows  []chRow
+}
+
+// fakeClickHouse — httptest.Server вместо HTTP-интерфейса ClickHouse; reply решает, что ответить на запрос.
+type fakeClickHouse struct {
+	*httptest.Server
+	mu    sync.Mutex
+	reqs  []chRequest
+	reply func(n int, req chRequest, w http.ResponseWriter)
+}
+
+func newFakeClickHouse(t *testing.T, reply func(n int, req chRequest, w http.ResponseWriter)) *fakeClickHouse {
+	t.Helper()
+	f := &fakeClickHouse{reply: reply}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		req := chRequest{
+			query: r.URL.Query().Get("query"),
+			token: r.URL.Query().Get("insert_deduplication_token"),
+			user:  r.Header.Get("X-ClickHouse-User"),
+		}
+		sc := bufio.NewScanner(bytes.NewReader(body))
+		for sc.Scan() {
+			var row chRow
+			if err := json.Unmarshal(sc.Bytes(), &row); err != nil {
+				t.Errorf("body line %q is not JSONEachRow: %v", sc.Text(), err)
+			}
+			req.rows = append(req.rows, row)
+		}
+
+		f.mu.Lock()
+		f.reqs = append(f.reqs, req)
+		n := len(f.reqs)
+		f.mu.Unlock()
+		f.reply(n, req, w)
+	}))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeClickHouse) requests() []chRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]chRequest(nil), f.reqs...)
+}
+
+func newCHTestSink(t *testing.T, url string) *ClickHouseSink {
+	t.Helper()
+	s, err := NewClickHouseSink(ClickHouseConfig{
+		URL:      url,
+		Database: "default",
+		Table:    "player_pay_log",
+		User:     "collector",
+		Password: "secret",
+		Timeout:  5 * time.Second,
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func chTestEvents(n int) []Event {
+	out := make([]Event, n)
+	for i := range out {
+		out[i] = Event{
+			TS:        time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			EventID:   "ev-" + strconv.Itoa(i),
+			UserID:    7,
+			DomainID:  100,
+			FileID:    500 + i,
+			EventName: "play",
+			VisitorIP: []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 10, 0, 0, byte(i)},
+			next:      CommitPos{Seg: 1, Line: i + 1, Off: int64(i+1) * 64},
+		}
+	}
+	return out
+}
+
+// runTestFlusher прогоняет events через flusher в sink и ждёт, пока тот дочитает источник.
+func runTestFlusher(t *testing.T, sink Sink, events []Event) (*recordingCommits, *DeadLetter) {
+	t.Helper()
+	dl, err := NewDeadLetter(t.TempDir(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := newChanSource(len(events))
+	for _, e := range events {
+		src.send(context.Background(), e)
+	}
+	src.close()
+
+	commits := &recordingCommits{}
+	sc := SinkConfig{
+		Name:            sink.Name(),
+		FlushEvery:      10 * time.Millisecond,
+		BatchMax:        len(events),
+		RetryMax:        10,
+		RetryBackoff:    10 * time.Millisecond,
+		RetryBackoffMax: 20 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flusher(context.Background(), context.Background(), commits, sink, dl, src, sc)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flusher did not finish")
+	}
+	return commits, dl
+}
+
+func TestClickHouseSinkWrite(t *testing.T) {
+	f := newFakeClickHouse(t, func(n int, req chRequest, w http.ResponseWriter) {})
+	s := newCHTestSink(t, f.URL)
+
+	batch := chTestEvents(3)
+	if err := s.Write(context.Background(), batch, batchCommits(batch)); err != nil {
+		t.Fatal(err)
+	}
+
+	reqs := f.requests()
+	if len(reqs) != 1 {
+		t.Fatalf("%d requests, want 1", len(reqs))
+	}
+	req := reqs[0]
+	if want := "INSERT INTO `default`.`player_pay_log` FORMAT JSONEachRow"; req.query != want {
+		t.Errorf("query %q, want %q", req.query, want)
+	}
+	if req.token == "" || req.token != chDedupToken(batch) {
+		t.Errorf("insert_deduplication_token %q, want %q", req.token, chDedupToken(batch))
+	}
+	if req.user != "collector" {
+		t.Errorf("X-ClickHouse-User %q", req.user)
+	}
+	if len(req.rows) != len(batch) {
+		t.Fatalf("%d rows, want %d", len(req.rows), len(batch))
+	}
+	for i, row := range req.rows {
+		want := chRow{
+			CreatedAt: "2026-01-02 03:04:05.000",
+			EventID:   batch[i].EventID,
+			UserID:    7,
+			DomainID:  100,
+			VisitorIP: "::ffff:10.0.0." + strconv.Itoa(i),
+			FileID:    batch[i].FileID,
+			Event:     "play",
+		}
+		if row != want {
+			t.Errorf("row %d: %+v, want %+v", i, row, want)
+		}
+	}
+}
+
+func TestClickHouseSinkRetry5xx(t *testing.T) {
+	f := newFakeClickHouse(t, func(n int, req chRequest, w http.ResponseWriter) {
+		if n <= 2 {
+			w.Header().Set("X-ClickHouse-Exception-Code", "242") // TABLE_IS_READ_ONLY
+			http.Error(w, "Code: 242. DB::Exception: Table is in readonly mode", http.StatusServiceUnavailable)
+		}
+	})
+	s := newCHTestSink(t, f.URL)
+
+	batch := chTestEvents(4)
+	commits, _ := runTestFlusher(t, s, batch)
+
+	reqs := f.requests()
+	if len(reqs) != 3 {
+		t.Fatalf("%d requests, want 3 (two 503 + success)", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.token != reqs[0].token || len(req.rows) != len(batch) {
+			t.Errorf("attempt %d: token %q rows %d, want same batch as first attempt", i, req.token, len(req.rows))
+		}
+	}
+	got, _ := commits.snapshot()
+	if len(got) != 1 || got[0][0].Pos != batch[len(batch)-1].next {
+		t.Errorf("commits %v, want one at %v", got, batch[len(batch)-1].next)
+	}
+}
+
+func TestClickHouseSinkPoisonRow(t *testing.T) {
+	const poison = "ev-2"
+	var mu sync.Mutex
+	inserted := map[string]int{} // строки из принятых (200) запросов
+	f := newFakeClickHouse(t, func(n int, req chRequest, w http.ResponseWriter) {
+		for _, row := range req.rows {
+			if row.EventID == poison {
+				w.Header().Set("X-ClickHouse-Exception-Code", "27")
+				http.Error(w, "Code: 27. DB::Exception: Cannot parse input", http.StatusBadRequest)
+				return
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, row := range req.rows {
+			inserted[row.EventID]++
+		}
+	})
+	s := newCHTestSink(t, f.URL)
+
+	batch := chTestEvents(5)
+	commits, dl := runTestFlusher(t, s, batch)
+
+	items, _, err := dl.List("", 10, reasonSinkRejected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Event == nil || items[0].Event.EventID != poison || items[0].Sink != "clickhouse" {
+		t.Fatalf("dead-letter %+v, want only %s", items, poison)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	for _, e := range batch {
+		want := 1
+		if e.EventID == poison {
+			want = 0
+		}
+		if inserted[e.EventID] != want {
+			t.Errorf("%s inserted %d times, want %d", e.EventID, inserted[e.EventID], want)
+		}
+	}
+
+	got, _ := commits.snapshot()
+	if len(got) == 0 || got[len(got)-1][0].Pos != batch[len(batch)-1].next {
+		t.Errorf("last commit %v, want %v", got, batch[len(batch)-1].next)
+	}
+}
+
+func TestClassifyCHError(t *testing.T) {
+	for _, tc := range []struct {
+		status    int
+		code      string
+		permanent bool
+	}{
+		{http.StatusBadRequest, "27", true},
+		{http.StatusBadRequest, "", true},
+		{http.StatusRequestEntityTooLarge, "", true},
+		{http.StatusNotFound, "60", false}, // UNKNOWN_TABLE — конфиг
+		{http.StatusUnauthorized, "516", false},
+		{http.StatusBadRequest, "62", false}, // SYNTAX_ERROR — не данные
+		{http.StatusInternalServerError, "27", false},
+		{http.StatusServiceUnavailable, "", false},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Header: http.Header{}}
+		if tc.code != "" {
+			resp.Header.Set("X-ClickHouse-Exception-Code", tc.code)
+		}
+		err := classifyCHError(resp, io.ErrUnexpectedEOF)
+		if isPermanent(err) != tc.permanent {
+			t.Errorf("http %d code %q: permanent=%v, want %v", tc.status, tc.code, isPermanent(err), tc.permanent)
+		}
+	}
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+/* ---------------- sink: kafka ---------------- */
+
+// KafkaSink публикует обогащённые события (после DomainCache/GeoMapper) в топик.
+// Write ждёт подтверждения брокера на каждую запись батча (ProduceSync) — commit-курсор
+// kafka двигается только после ack. При ретрае батча возможны повторы: потребители
+// дедуплицируют по event_id.
+//
+// В тестах брокер in-process: kfake.NewCluster() из franz-go и его ListenAddrs() в Brokers (sink_kafka_test.go).
+type KafkaSink struct {
+	client   *kgo.Client
+	topic    string
+	keyBy    string
+	timeout  time.Duration
+	maxBatch int32
+}
+
+type KafkaConfig struct {
+	Brokers     []string
+	Topic       string
+	KeyBy       string // domain_id | file_id
+	Acks        string // all | leader | none
+	Compression string // none | gzip | snappy | lz4 | zstd
+	ClientID    string
+	Timeout     time.Duration
+
+	// MaxBatchBytes — предел record batch на запрос; не выше message.max.bytes брокера
+	// (и max.message.bytes топика), иначе брокер отвечает MESSAGE_TOO_LARGE на весь батч.
+	MaxBatchBytes int32
+}
+
+// kafkaDefaultMaxBatchBytes — дефолт franz-go, ниже дефолтного message.max.bytes брокера (1048588).
+const kafkaDefaultMaxBatchBytes = 1_000_012
+
+// kafkaMessage — value сообщения. visitor_ip строкой, а не base64 как в WAL.
+type kafkaMessage struct {
+	TS           time.Time `json:"ts"`
+	EventID      string    `json:"event_id"`
+	Event        string    `json:"event"`
+	UserID       int       `json:"user_id"`
+	DomainID     int       `json:"domain_id"`
+	DomainTypeID int       `json:"domain_type_id"`
+	GeoID        int       `json:"geo_id"`
+	GeoGroupID   int       `json:"geo_group_id"`
+	FileID       int       `json:"file_id"`
+	VisitorIP    string    `json:"visitor_ip,omitempty"`
+}
+
+func NewKafkaSink(cfg KafkaConfig, extra ...kgo.Opt) (*KafkaSink, error) {
+	if len(cfg.Brokers) == 0 || cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka: brokers and topic are required")
+	}
+	switch cfg.KeyBy {
+	case "domain_id", "file_id":
+	default:
+		return nil, fmt.Errorf("kafka: bad key %q (domain_id|file_id)", cfg.KeyBy)
+	}
+	if cfg.MaxBatchBytes <= 0 {
+		cfg.MaxBatchBytes = kafkaDefaultMaxBatchBytes
+	}
+
+	opts := []kgo.Opt{
+		kgo.SeedBrokers(cfg.Brokers...),
+		kgo.DefaultProduceTopic(cfg.Topic),
+		kgo.ClientID(cfg.ClientID),
+		kgo.ProducerBatchMaxBytes(cfg.MaxBatchBytes),
+		// не даём клиенту ретраить бесконечно: ретраи батча — забота flusher
+		kgo.RecordDeliveryTimeout(cfg.Timeout),
+	}
+
+	switch cfg.Acks {
+	case "all":
+		opts = append(opts, kgo.RequiredAcks(kgo.AllISRAcks()))
+	case "leader":
+		opts = append(opts, kgo.RequiredAcks(kgo.LeaderAck()), kgo.DisableIdempotentWrite())
+	case "none":
+		// ack «получен» сразу после отправки — commit без гарантии записи
+		opts = append(opts, kgo.RequiredAcks(kgo.NoAck()), kgo.DisableIdempotentWrite())
+	default:
+		return nil, fmt.Errorf("kafka: bad acks %q (all|leader|none)", cfg.Acks)
+	}
+
+	switch cfg.Compression {
+	case "none":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.NoCompression()))
+	case "gzip":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.GzipCompression()))
+	case "snappy":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.SnappyCompression()))
+	case "lz4":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.Lz4Compression()))
+	case "zstd":
+		opts = append(opts, kgo.ProducerBatchCompression(kgo.ZstdCompression()))
+	default:
+		return nil, fmt.Errorf("kafka: bad compression %q (none|gzip|snappy|lz4|zstd)", cfg.Compression)
+	}
+
+	client, err := kgo.NewClient(append(opts, extra...)...)
+	if err != nil {
+		return nil, err
+	}
+	return &KafkaSink{client: client, topic: cfg.Topic, keyBy: cfg.KeyBy, timeout: cfg.Timeout, maxBatch: cfg.MaxBatchBytes}, nil
+}
+
+func (s *KafkaSink) Name() string { return "kafka" }
+
+func (s *KafkaSink) Write(ctx context.Context, batch []Event, next []ShardPos) error {
+	recs := make([]*kgo.Record, 0, len(batch))
+	for _, e := range batch {
+		msg := kafkaMessage{
+			TS:           e.TS,
+			EventID:      e.EventID,
+			Event:        e.EventName,
+			UserID:       e.UserID,
+			DomainID:     e.DomainID,
+			DomainTypeID: e.DomainTypeID,
+			GeoID:        e.GeoID,
+			GeoGroupID:   e.GeoGroupID,
+			FileID:       e.FileID,
+		}
+		if len(e.VisitorIP) == net.IPv6len {
+			msg.VisitorIP = net.IP(e.VisitorIP).String()
+		}
+		val, err := json.Marshal(msg)
+		if err != nil {
+			return err
+		}
+
+		key := e.DomainID
+		if s.keyBy == "file_id" {
+			key = e.FileID
+		}
+		recs = append(recs, &kgo.Record{
+			Key:     []byte(strconv.Itoa(key)),
+			Value:   val,
+			Headers: []kgo.RecordHeader{{Key: "event", Value: []byte(e.EventName)}},
+		})
+	}
+
+	ctxTO, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+
+	// ProduceSync возвращается, когда на каждую запись пришёл ack (или ошибка)
+	err := s.client.ProduceSync(ctxTO, recs...).FirstErr()
+	switch {
+	case errors.Is(err, kerr.MessageTooLarge):
+		// событие — сотни байт, до предела не дорастает: значит, KAFKA_MAX_BATCH_BYTES
+		// выше лимита брокера/топика. Это конфиг, а не poison event — делить батч бессмысленно.
+		return fmt.Errorf("kafka: %w (KAFKA_MAX_BATCH_BYTES=%d above broker message.max.bytes?)", err, s.maxBatch)
+	case errors.Is(err, kerr.InvalidRecord):
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+func (s *KafkaSink) Close() error {
+	s.client.Close()
+	return nil
+}
+
+func splitList(s string) []string {
+	var out []string
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kerr"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const kafkaTestTopic = "player-events"
+
+func newKafkaTestSink(t *testing.T, c *kfake.Cluster, keyBy string, timeout time.Duration) *KafkaSink {
+	t.Helper()
+	cfg := KafkaConfig{
+		Brokers:     c.ListenAddrs(),
+		Topic:       kafkaTestTopic,
+		KeyBy:       keyBy,
+		Acks:        "all",
+		Compression: "none",
+		ClientID:    "test",
+		Timeout:     timeout,
+	}
+	// ретраи внутри kgo ждут обновления метаданных (по умолчанию не чаще раза в 5s)
+	s, err := NewKafkaSink(cfg,
+		kgo.MetadataMinAge(10*time.Millisecond),
+		kgo.RetryBackoffFn(func(int) time.Duration { return 10 * time.Millisecond }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func kafkaTestEvents(n int) []Event {
+	out := make([]Event, n)
+	for i := range out {
+		out[i] = Event{
+			TS:        time.Unix(1700000000+int64(i), 0).UTC(),
+			EventID:   "ev-" + strconv.Itoa(i),
+			DomainID:  100 + i%2,
+			FileID:    500 + i,
+			EventName: "play",
+			VisitorIP: make([]byte, 16),
+			next:      CommitPos{Seg: 1, Line: i + 1, Off: int64(i+1) * 64},
+		}
+	}
+	return out
+}
+
+// consumeAll читает из топика n записей (или падает по таймауту).
+func consumeAll(t *testing.T, c *kfake.Cluster, n int) []*kgo.Record {
+	t.Helper()
+	cl, err := kgo.NewClient(
+		kgo.SeedBrokers(c.ListenAddrs()...),
+		kgo.ConsumeTopics(kafkaTestTopic),
+		kgo.ConsumeResetOffset(kgo.NewOffset().AtStart()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cl.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var out []*kgo.Record
+	for len(out) < n {
+		fs := cl.PollFetches(ctx)
+		if ctx.Err() != nil {
+			t.Fatalf("consumed %d of %d records", len(out), n)
+		}
+		fs.EachRecord(func(r *kgo.Record) { out = append(out, r) })
+	}
+	return out
+}
+
+func TestKafkaSinkWriteKeys(t *testing.T) {
+	for _, keyBy := range []string{"domain_id", "file_id"} {
+		t.Run(keyBy, func(t *testing.T) {
+			c := kfake.MustCluster(kfake.NumBrokers(1), kfake.SeedTopics(3, kafkaTestTopic))
+			defer c.Close()
+			s := newKafkaTestSink(t, c, keyBy, 5*time.Second)
+
+			batch := kafkaTestEvents(6)
+			if err := s.Write(context.Background(), batch, batchCommits(batch)); err != nil {
+				t.Fatal(err)
+			}
+
+			byID := map[string]Event{}
+			for _, e := range batch {
+				byID[e.EventID] = e
+			}
+			recs := consumeAll(t, c, len(batch))
+			for _, r := range recs {
+				var m kafkaMessage
+				if err := json.Unmarshal(r.Value, &m); err != nil {
+					t.Fatal(err)
+				}
+				e, ok := byID[m.EventID]
+				if !ok {
+					t.Fatalf("unexpected event_id %q", m.EventID)
+				}
+				delete(byID, m.EventID)
+
+				want := e.DomainID
+				if keyBy == "file_id" {
+					want = e.FileID
+				}
+				if string(r.Key) != strconv.Itoa(want) {
+					t.Errorf("event %s: key %q, want %d", m.EventID, r.Key, want)
+				}
+				if m.VisitorIP != "::" {
+					t.Errorf("event %s: visitor_ip %q", m.EventID, m.VisitorIP)
+				}
+			}
+			if len(byID) != 0 {
+				t.Errorf("events not produced: %v", byID)
+			}
+		})
+	}
+}
+
+// recordingCommits — commitSetter flusher'а: запоминает позиции и момент каждого SetCommit.
+type recordingCommits struct {
+	mu      sync.Mutex
+	commits [][]ShardPos
+	at      []time.Time
+}
+
+func (r *recordingCommits) SetCommit(name string, next []ShardPos) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.commits = append(r.commits, next)
+	r.at = append(r.at, time.Now())
+	return nil
+}
+
+func (r *recordingCommits) snapshot() ([][]ShardPos, []time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([][]ShardPos(nil), r.commits...), append([]time.Time(nil), r.at...)
+}
+
+func TestKafkaSinkCommitAfterAck(t *testing.T) {
+	c := kfake.MustCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, kafkaTestTopic))
+	defer c.Close()
+
+	// пока failing — брокер отвечает NOT_ENOUGH_REPLICAS на каждый produce
+	var failing atomic.Bool
+	var ackedAt atomic.Int64
+	var rejected atomic.Int32
+	failing.Store(true)
+	c.ControlKey(int16(kmsg.Produce), func(req kmsg.Request) (kmsg.Response, error, bool) {
+		c.KeepControl()
+		if !failing.Load() {
+			ackedAt.CompareAndSwap(0, time.Now().UnixNano())
+			return nil, nil, false
+		}
+		preq := req.(*kmsg.ProduceRequest)
+		resp := preq.ResponseKind().(*kmsg.ProduceResponse)
+		for _, rt := range preq.Topics {
+			st := kmsg.NewProduceResponseTopic()
+			st.Topic, st.TopicID = rt.Topic, rt.TopicID
+			for _, rp := range rt.Partitions {
+				sp := kmsg.NewProduceResponseTopicPartition()
+				sp.Partition = rp.Partition
+				sp.ErrorCode = kerr.NotEnoughReplicas.Code
+				st.Partitions = append(st.Partitions, sp)
+			}
+			resp.Topics = append(resp.Topics, st)
+		}
+		rejected.Add(1)
+		return resp, nil, true
+	})
+
+	// 1s — минимум RecordDeliveryTimeout в kgo; ждём не таймаут, а отказы брокера
+	s := newKafkaTestSink(t, c, "domain_id", time.Second)
+	dl, err := NewDeadLetter(t.TempDir(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	src := newChanSource(16)
+	batch := kafkaTestEvents(4)
+	for _, e := range batch {
+		src.send(context.Background(), e)
+	}
+	src.close()
+
+	commits := &recordingCommits{}
+	sc := SinkConfig{
+		Name:            "kafka",
+		FlushEvery:      20 * time.Millisecond,
+		BatchMax:        len(batch),
+		RetryMax:        100,
+		RetryBackoff:    20 * time.Millisecond,
+		RetryBackoffMax: 50 * time.Millisecond,
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		flusher(context.Background(), context.Background(), commits, s, dl, src, sc)
+	}()
+
+	// брокер отверг несколько попыток: commit стоит на месте
+	for deadline := time.Now().Add(10 * time.Second); rejected.Load() < 3; time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("only %d produce attempts", rejected.Load())
+		}
+	}
+	if got, _ := commits.snapshot(); len(got) != 0 {
+		t.Fatalf("commit advanced before ack: %v", got)
+	}
+
+	failing.Store(false)
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("flusher did not finish after broker recovered")
+	}
+
+	got, at := commits.snapshot()
+	if len(got) != 1 {
+		t.Fatalf("commits: %v, want exactly one", got)
+	}
+	want := batch[len(batch)-1].next
+	if len(got[0]) != 1 || got[0][0].Pos != want {
+		t.Errorf("commit %v, want %v", got[0], want)
+	}
+	if acked := ackedAt.Load(); acked == 0 || at[0].UnixNano() < acked {
+		t.Errorf("commit at %v before broker accepted produce", at[0])
+	}
+	if recs := consumeAll(t, c, len(batch)); len(recs) != len(batch) {
+		t.Errorf("produced %d records, want %d", len(recs), len(batch))
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+/* ---------------- sink: mysql ---------------- */
+
+// MySQLSink пишет в player_pay_log.
+// store != nil — режим WAL_COMMIT_MODE=db: позиция WAL коммитится в wal_cursor вместе с батчем.
+type MySQLSink struct {
+	db    *sql.DB
+	store *MySQLCommitStore
+}
+
+func NewMySQLSink(db *sql.DB, store *MySQLCommitStore) *MySQLSink {
+	return &MySQLSink{db: db, store: store}
+}
+
+func (s *MySQLSink) Name() string { return "mysql" }
+
+func (s *MySQLSink) Write(ctx context.Context, batch []Event, next []ShardPos) error {
+	var err error
+	if s.store != nil {
+		err = s.store.InsertBatchWithCommit(ctx, batch, next)
+	} else {
+		var d dupStats
+		if d, err = insertBatch(ctx, s.db, batch); err == nil {
+			d.observe()
+		}
+	}
+	return classifyMySQLError(err)
+}
+
+func (s *MySQLSink) SaveCommit(ctx context.Context, next []ShardPos) error {
+	if s.store == nil {
+		return nil
+	}
+	return s.store.InsertBatchWithCommit(ctx, nil, next)
+}
+
+// Ошибки данных: строка не влезет никогда, сколько ни ретрай (strict mode).
+var mysqlPermanentErrors = map[uint16]bool{
+	1048: true, // ER_BAD_NULL_ERROR
+	1264: true, // ER_WARN_DATA_OUT_OF_RANGE (geo_group_id в TINYINT)
+	1265: true, // WARN_DATA_TRUNCATED (в т.ч. значение не из ENUM event)
+	1292: true, // ER_TRUNCATED_WRONG_VALUE (кривая дата)
+	1364: true, // ER_NO_DEFAULT_FOR_FIELD
+	1366: true, // ER_TRUNCATED_WRONG_VALUE_FOR_FIELD
+	1406: true, // ER_DATA_TOO_LONG
+	// ER_NO_REFERENCED_ROW_2: в init.sql внешних ключей нет, 1452 бывает только с FK, добавленным
+	// вручную (domain_id → domains). Домен проверен по кэшу domains при приёме, значит строку с тех
+	// пор удалили и сама она не вернётся, а ретрай держал бы весь sink. Событие уходит в dead-letter:
+	// после восстановления родителя — re-inject.
+	1452: true,
+	1690: true, // ER_DATA_OUT_OF_RANGE
+}
+
+// classifyMySQLError оборачивает ошибки данных в PermanentError. Всё остальное
+// (сеть, deadlock, lock wait timeout, read-only, ...) — ретраибельно.
+func classifyMySQLError(err error) error {
+	var me *mysql.MySQLError
+	if errors.As(err, &me) && mysqlPermanentErrors[me.Number] {
+		return &PermanentError{Err: err}
+	}
+	return err
+}
+
+// sqlExecer — *sql.DB или *sql.Tx.
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// dupStats — сколько событий батча поглотил UNIQUE event_id.
+// replays — то же событие повторно (replay WAL после рестарта), collisions — другое событие
+// с уже занятым event_id (клиент переиспользовал id): оно не записано.
+type dupStats struct {
+	replays, collisions int
+}
+
+func (d dupStats) observe() {
+	if d.replays > 0 {
+		mMySQLDuplicates.WithLabelValues("replay").Add(float64(d.replays))
+	}
+	if d.collisions > 0 {
+		mMySQLDuplicates.WithLabelValues("collision").Add(float64(d.collisions))
+	}
+}
+
+// insertBatch идемпотентен по event_id (UNIQUE): повторная вставка того же события
+// после рестарта (replay WAL) поглощается. Поглощённые строки сверяются с тем, что уже
+// в таблице, — чужое событие под тем же event_id считается коллизией (см. dupStats).
+func insertBatch(ctx context.Context, db sqlExecer, batch []Event) (dupStats, error) {
+	sb := strings.Builder{}
+	sb.WriteString(`INSERT INTO player_pay_log
+(created_at,user_id,domain_id,geo_id,geo_group_id,domain_type_id,visitor_ip,file_id,event,event_id) VALUES `)
+
+	args := make([]any, 0, len(batch)*10)
+	for i, e := range batch {
+		if i > 0 {
+			sb.WriteString(",")
+		}
+		sb.WriteString("(?,?,?,?,?,?,?,?,?,?)")
+		// старые записи WAL без event_id пишем как NULL (UNIQUE допускает много NULL)
+		var eventID any
+		if e.EventID != "" {
+			eventID = e.EventID
+		}
+		args = append(args, e.TS, e.UserID, e.DomainID, e.GeoID, e.GeoGroupID, e.DomainTypeID, e.VisitorIP, e.FileID, e.EventName, eventID)
+	}
+	// не INSERT IGNORE: он превращает в warning и остальные ошибки (ENUM, диапазоны)
+	sb.WriteString(" ON DUPLICATE KEY UPDATE event_id = event_id")
+
+	ctxTO, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	res, err := db.ExecContext(ctxTO, sb.String(), args...)
+	if err != nil {
+		return dupStats{}, err
+	}
+	// без CLIENT_FOUND_ROWS вставка даёт 1, поглощённый дубль — 0
+	n, err := res.RowsAffected()
+	if err != nil || int(n) >= len(batch) {
+		return dupStats{}, nil
+	}
+	return checkDuplicates(ctxTO, db, batch, len(batch)-int(n))
+}
+
+// checkDuplicates делит dups поглощённых строк на повторы и коллизии: событие с event_id,
+// под которым в таблице лежит строка с другим domain_id/file_id/event, потеряно.
+func checkDuplicates(ctx context.Context, db sqlExecer, batch []Event, dups int) (dupStats, error) {
+	ids := make([]any, 0, len(batch))
+	for _, e := range batch {
+		if e.EventID != "" {
+			ids = append(ids, e.EventID)
+		}
+	}
+	if len(ids) == 0 {
+		return dupStats{}, nil
+	}
+
+	type stored struct {
+		domainID, fileID int
+		event            string
+	}
+	rows, err := db.QueryContext(ctx, `SELECT event_id, domain_id, file_id, event FROM player_pay_log WHERE event_id IN (?`+
+		strings.Repeat(",?", len(ids)-1)+`)`, ids...)
+	if err != nil {
+		return dupStats{}, err
+	}
+	defer rows.Close()
+	have := make(map[string]stored, len(ids))
+	for rows.Next() {
+		var id string
+		var st stored
+		if err := rows.Scan(&id, &st.domainID, &st.fileID, &st.event); err != nil {
+			return dupStats{}, err
+		}
+		have[id] = st
+	}
+	if err := rows.Err(); err != nil {
+		return dupStats{}, err
+	}
+
+	var d dupStats
+	for _, e := range batch {
+		st, ok := have[e.EventID]
+		if e.EventID == "" || !ok {
+			continue
+		}
+		if st.domainID != e.DomainID || st.fileID != e.FileID || st.event != e.EventName {
+			d.collisions++
+			log.Printf("mysql: event_id %q collision: domain %d file %d %s not written, row has domain %d file %d %s",
+				e.EventID, e.DomainID, e.FileID, e.EventName, st.domainID, st.fileID, st.event)
+		}
+	}
+	d.replays = max(0, dups-d.collisions)
+	return d, nil
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+/* ---------------- sink: peer (репликация WAL) ---------------- */
+
+// PeerSink — реплика WAL на соседнем инстансе (SINKS=mysql,peer). Его commit-курсор "peer" и есть
+// ack-курсор peer'а: Compact не удалит сегмент, пока peer не подтвердил всё в нём.
+//
+//	POST REPL_PEER_URL/repl/append
+//	Authorization: Bearer REPL_TOKEN
+//	X-Repl-Source:  имя узла (WAL_CURSOR_NAME)
+//	X-Repl-Epoch:   id WAL_DIR этого узла (WAL_DIR/repl.epoch): позиции сравнимы только внутри одного
+//	X-Repl-Flushed: [{Shard, Pos}] — до куда узел уже разнёс события по остальным sink'ам
+//	тело: кадры shard uvarint | seg uvarint | line uvarint | off uvarint | запись WAL (appendRecord)
+//
+// Позиция кадра — позиция WAL сразу после события (ev.next). Peer отвечает 200 после fsync реплики.
+// По X-Repl-Flushed peer подрезает реплику: на promote уходит только то, что узел не успел разнести.
+// Без событий тот же запрос раз в REPL_HEARTBEAT — подрезка и проверка связи, пока трафика нет.
+//
+// REPL_MODE=sync: /log и /batch отвечают после ack peer'а, но не дольше REPL_SYNC_TIMEOUT
+// (не дождались — событие всё равно принято, ingest_repl_sync_timeouts_total).
+
+const (
+	peerSinkName    = "peer"
+	replContentType = "application/x-pwal-frames"
+	hdrReplSource   = "X-Repl-Source"
+	hdrReplEpoch    = "X-Repl-Epoch"
+	hdrReplFlushed  = "X-Repl-Flushed"
+	replEpochFile   = "repl.epoch"
+
+	// реплике нужна свежесть, а не большие батчи: SINK_PEER_FLUSH_EVERY по умолчанию
+	peerFlushEvery = 20 * time.Millisecond
+)
+
+type PeerConfig struct {
+	URL         string
+	Token       string
+	Source      string // имя этого узла у peer'а
+	Mode        string // async | sync
+	SyncTimeout time.Duration
+	Timeout     time.Duration
+	Heartbeat   time.Duration
+}
+
+type PeerSink struct {
+	cfg    PeerConfig
+	epoch  string
+	client *http.Client
+
+	// flushed — позиции, до которых события разнесены остальными sink'ами; ставит main после NewShardedWAL
+	flushed func() []ShardPos
+}
+
+func NewPeerSink(cfg PeerConfig, walDir string) (*PeerSink, error) {
+	if cfg.URL == "" || cfg.Token == "" {
+		return nil, errors.New("peer: REPL_PEER_URL and REPL_TOKEN are required")
+	}
+	if !validReplSource(cfg.Source) {
+		return nil, fmt.Errorf("peer: bad source name %q (WAL_CURSOR_NAME)", cfg.Source)
+	}
+	if cfg.Mode != "async" && cfg.Mode != "sync" {
+		return nil, fmt.Errorf("peer: bad REPL_MODE %q (async|sync)", cfg.Mode)
+	}
+	epoch, err := loadReplEpoch(walDir)
+	if err != nil {
+		return nil, err
+	}
+	// http:// — HTTP/2 без TLS (prior knowledge), https:// — HTTP/2 через ALPN: один поток на peer'а
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.Protocols = new(http.Protocols)
+	tr.Protocols.SetHTTP2(true)
+	tr.Protocols.SetUnencryptedHTTP2(true)
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	return &PeerSink{cfg: cfg, epoch: epoch, client: &http.Client{Transport: tr, Timeout: cfg.Timeout}}, nil
+}
+
+func (s *PeerSink) Name() string { return peerSinkName }
+
+func (s *PeerSink) Write(ctx context.Context, batch []Event, _ []ShardPos) error {
+	body := make([]byte, 0, len(batch)*128)
+	for _, ev := range batch {
+		body = appendReplFrame(body, ev)
+	}
+	return s.post(ctx, body)
+}
+
+func (s *PeerSink) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL+"/repl/append", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+s.cfg.Token)
+	req.Header.Set("Content-Type", replContentType)
+	req.Header.Set(hdrReplSource, s.cfg.Source)
+	req.Header.Set(hdrReplEpoch, s.epoch)
+	if s.flushed != nil {
+		fb, _ := json.Marshal(s.flushed())
+		req.Header.Set(hdrReplFlushed, string(fb))
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("peer: %w", err)
+	}
+	defer resp.Body.Close()
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("peer: http %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusBadRequest, http.StatusRequestEntityTooLarge:
+		// peer не разобрал кадр или батч велик: flusher поделит батч и найдёт виноватое событие
+		return &PermanentError{Err: err}
+	default:
+		return err
+	}
+}
+
+// Run — heartbeat: пустой append раз в REPL_HEARTBEAT.
+func (s *PeerSink) Run(ctx context.Context) {
+	t := time.NewTicker(s.cfg.Heartbeat)
+	defer t.Stop()
+	up := true
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			err := s.post(ctx, nil)
+			switch {
+			case err != nil && up:
+				log.Printf("repl: peer %s is unreachable: %v", s.cfg.URL, err)
+			case err == nil && !up:
+				log.Printf("repl: peer %s is back", s.cfg.URL)
+			}
+			up = err == nil
+			if up {
+				mReplPeerUp.Set(1)
+			} else {
+				mReplPeerUp.Set(0)
+			}
+		}
+	}
+}
+
+// waitAck — REPL_MODE=sync: ждём, пока курсор peer шарда w дойдёт до pos.
+func (s *PeerSink) waitAck(ctx context.Context, w *WAL, pos CommitPos) {
+	// flusher peer'а должен прочитать запись сейчас, а не по своему таймеру
+	w.Notify()
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.SyncTimeout)
+	defer cancel()
+	start := time.Now()
+	if err := w.WaitCommit(ctx, peerSinkName, pos); err != nil {
+		mReplSyncTimeouts.Inc()
+	}
+	mReplSyncWait.Observe(time.Since(start).Seconds())
+}
+
+// flushedPos — по каждому шарду самый отстающий commit из names.
+func flushedPos(wal *ShardedWAL, names []string) []ShardPos {
+	if len(names) == 0 {
+		return nil
+	}
+	out := make([]ShardPos, 0, len(wal.Shards()))
+	for i, w := range wal.Shards() {
+		sp := ShardPos{Shard: i, Pos: w.Commit(names[0])}
+		for _, name := range names[1:] {
+			if cp := w.Commit(name); cp.Less(sp.Pos) {
+				sp.Pos = cp
+			}
+		}
+		out = append(out, sp)
+	}
+	return out
+}
+
+// loadReplEpoch читает WAL_DIR/repl.epoch, при первом запуске создаёт.
+func loadReplEpoch(walDir string) (string, error) {
+	path := filepath.Join(walDir, replEpochFile)
+	b, err := os.ReadFile(path)
+	if err == nil {
+		if epoch := strings.TrimSpace(string(b)); epoch != "" {
+			return epoch, nil
+		}
+	} else if !os.IsNotExist(err) {
+		return "", err
+	}
+	if err := os.MkdirAll(walDir, 0o755); err != nil {
+		return "", err
+	}
+	epoch := newHandoffID()
+	if err := writeFileSync(path+".tmp", []byte(epoch+"\n"), ""); err != nil {
+		return "", err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return "", err
+	}
+	return epoch, syncDir(walDir)
+}
+
+/* ---------------- кадры репликации ---------------- */
+
+type replFrame struct {
+	shard int
+	pos   CommitPos
+	ev    Event
+}
+
+func appendReplFrame(b []byte, ev Event) []byte {
+	b = binary.AppendUvarint(b, uint64(ev.shard))
+	b = binary.AppendUvarint(b, uint64(ev.next.Seg))
+	b = binary.AppendUvarint(b, uint64(ev.next.Line))
+	b = binary.AppendUvarint(b, uint64(ev.next.Off))
+	return appendRecord(b, ev)
+}
+
+var errReplFrame = errors.New("bad replication frame")
+
+func parseReplFrames(b []byte) ([]replFrame, error) {
+	var out []replFrame
+	for len(b) > 0 {
+		var hdr [4]uint64
+		for i := range hdr {
+			v, n := binary.Uvarint(b)
+			if n <= 0 || v > 1<<40 {
+				return nil, fmt.Errorf("%w %d: bad position", errReplFrame, len(out))
+			}
+			hdr[i], b = v, b[n:]
+		}
+		if hdr[0] > 255 {
+			return nil, fmt.Errorf("%w %d: bad shard %d", errReplFrame, len(out), hdr[0])
+		}
+		if len(b) < recHeaderLen {
+			return nil, fmt.Errorf("%w %d: truncated", errReplFrame, len(out))
+		}
+		n := binary.LittleEndian.Uint32(b[:4])
+		if n == 0 || n > maxRecordLength || len(b) < recHeaderLen+int(n) {
+			return nil, fmt.Errorf("%w %d: bad record length %d", errReplFrame, len(out), n)
+		}
+		body := b[recHeaderLen : recHeaderLen+int(n)]
+		if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(b[4:8]) {
+			return nil, fmt.Errorf("%w %d: crc mismatch", errReplFrame, len(out))
+		}
+		ev, err := decodeRecord(body)
+		if err != nil {
+			return nil, fmt.Errorf("%w %d: %v", errReplFrame, len(out), err)
+		}
+		out = append(out, replFrame{
+			shard: int(hdr[0]),
+			pos:   CommitPos{Seg: int(hdr[1]), Line: int(hdr[2]), Off: int64(hdr[3])},
+			ev:    ev,
+		})
+		b = b[recHeaderLen+int(n):]
+	}
+	return out, nil
+}
+
+// имя источника идёт в путь WAL_DIR/replica/<source>
+func validReplSource(s string) bool {
+	if s == "" || len(s) > 64 || s[0] == '.' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
@@ -1,36 +1,45 @@
 package main
 
 import (
+	"context"
+	"crypto/cipher"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 /* ---------------- WAL ---------------- */
 
-// commit.meta содержит: {"seg":1,"line":1234}
-// seg - номер сегмента, line - сколько строк в этом сегменте уже подтверждено (committed)
+// commit.meta содержит: {"seg":1,"line":1234,"off":56789}
+// seg - номер сегмента, line - сколько записей (в старых JSON-сегментах строк) в этом сегменте уже подтверждено (committed),
+// off - смещение в файле сразу после последней подтверждённой записи (0 — начало сегмента).
+// Позиция считается по off; line — для людей (dead-letter, /debug/wal) и для старых commit.meta без off.
 type CommitPos struct {
-	Seg  int `json:"seg"`
-	Line int `json:"line"`
+	Seg  int   `json:"seg"`
+	Line int   `json:"line"`
+	Off  int64 `json:"off"`
 }
 
 type AppendPos struct {
 	Seg  int
 	Line int
+	Off  int64
 }
 
 type WAL struct {
+	shard       int // номер шарда (wal_shards.go), 0 — WAL_DIR
 	dir         string
 	segMaxBytes int64
 	fsyncEvery  time.Duration
+	indexEvery  int
 
 	mu sync.Mutex
 
@@ -42,47 +51,262 @@ type WAL struct {
 	curSize   int64
 	lastFsync time.Time
 
-	commit CommitPos
+	// ротация по времени (wal_rotate.go)
+	rotateEvery time.Duration
+	idleSeal    time.Duration
+	compress    bool       // сжимать закрытые сегменты (wal_compress.go)
+	packMu      sync.Mutex // одно сжатие за раз
+	curOpened   time.Time  // когда текущий сегмент открыт на запись
+	lastAppend  time.Time
+
+	// ts первого/последнего события, дописанного в текущий сегмент (для /debug/wal)
+	curFirstTS, curLastTS time.Time
+
+	// шифр текущего сегмента (nil — не шифруется), см. wal_crypt.go
+	curKeyID uint16
+	curAEAD  cipher.AEAD
+	curAAD   []byte
+
+	// commit по каждому курсору (sink): у каждого sink свой commit-файл
+	commits  map[string]CommitPos
+	commitCh chan struct{} // закрывается, когда какой-то commit сдвинулся (WaitCommit)
+
+	readMu sync.Mutex
+	reads  map[string]CommitPos // позиции чтения курсоров (wal_reader.go), НЕ сохраняем на диск
+
+	notifyMu sync.Mutex
+	notify   []chan struct{} // будильники читателей (Subscribe)
+
+	// group commit (wal_sync.go)
+	syncEvents    map[string]bool
+	syncGroupWait time.Duration
+	syncTimeout   time.Duration
+	syncMu        sync.Mutex // держит fsync вне mu; ротация/Close берут его перед закрытием файла
+	syncKick      chan struct{}
+	stop          chan struct{} // закрывается в Close: syncer, sealer
+
+	lock *walLock // flock WAL_DIR/LOCK, снимается в Close
+
+	// квота WAL_DIR (wal_quota.go)
+	quota      WALQuota
+	keepEvents map[string]bool
+	usedBytes  atomic.Int64
+	usedSegs   atomic.Int64
+	spillMu    sync.Mutex
+	spilled    map[int]bool // сегменты, лежащие в quota.SpillDir
+
+	durMu   sync.Mutex
+	durSeg  int // всё до (durSeg, durOff) точно на диске
+	durOff  int64
+	waiters []syncWaiter
+}
+
+// CommitStore — внешнее хранилище commit-позиции (см. MySQLCommitStore).
+// Если позиция там есть, при старте она главнее commit-файла.
+type CommitStore interface {
+	LoadCommit() (pos CommitPos, ok bool, err error)
+}
+
+// WALCursor — именованный commit-курсор (по одному на sink).
+type WALCursor struct {
+	Name string
+
+	// Store != nil: commit-файл сверяется с позицией шарда из store при старте (доверяем store)
+	Store ShardCommitStore
+}
+
+type WALOptions struct {
+	Shard        int
+	Dir          string
+	SegmentMaxMB int
+	FsyncEvery   time.Duration
+	IndexEvery   int // метка в индексе сегмента каждые N записей
 
-	readMu  sync.Mutex
-	readPos CommitPos // НЕ сохраняем на диск, только для текущего процесса
+	// сегмент закрывается не позже RotateEvery и после IdleSeal без записей (0 — выключено)
+	RotateEvery time.Duration
+	IdleSeal    time.Duration
+	Compress    bool // zstd для закрытых сегментов
+
+	// события, ответ на которые ждёт fsync ("*" — все); пусто — только таймер FsyncEvery
+	SyncEvents    []string
+	SyncGroupWait time.Duration
+	SyncTimeout   time.Duration
+
+	Quota WALQuota
+
+	// LOCK занят другим процессом: 0 — сразу ошибка, иначе ждём не дольше LockWait
+	LockWait time.Duration
+
+	Cursors []WALCursor
 }
 
-func NewWAL(dir string, segMaxMB int, fsyncEvery time.Duration) (*WAL, error) {
-	if err := os.MkdirAll(dir, 0o755); err != nil {
+var errWALClosed = errors.New("wal closed")
+
+// legacyCursor — курсор, который хранится в старом commit.meta (совместимость с существующими WAL_DIR).
+const legacyCursor = "mysql"
+
+func NewWAL(opts WALOptions) (*WAL, error) {
+	if err := os.MkdirAll(opts.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	lock, err := lockWALDir(opts.Dir, opts.LockWait)
+	if err != nil {
 		return nil, err
 	}
+	w, err := openWAL(opts)
+	if err != nil {
+		lock.release()
+		return nil, err
+	}
+	w.lock = lock
+	return w, nil
+}
+
+// openWAL — NewWAL под уже взятой блокировкой каталога.
+func openWAL(opts WALOptions) (*WAL, error) {
+	if len(opts.Cursors) == 0 {
+		return nil, errors.New("wal: no cursors")
+	}
 	w := &WAL{
-		dir:         dir,
-		segMaxBytes: int64(segMaxMB) * 1024 * 1024,
-		fsyncEvery:  fsyncEvery,
+		shard:         opts.Shard,
+		dir:           opts.Dir,
+		segMaxBytes:   int64(opts.SegmentMaxMB) * 1024 * 1024,
+		fsyncEvery:    opts.FsyncEvery,
+		indexEvery:    opts.IndexEvery,
+		rotateEvery:   opts.RotateEvery,
+		idleSeal:      opts.IdleSeal,
+		compress:      opts.Compress,
+		syncEvents:    make(map[string]bool, len(opts.SyncEvents)),
+		syncGroupWait: opts.SyncGroupWait,
+		syncTimeout:   opts.SyncTimeout,
+		syncKick:      make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		quota:         opts.Quota,
+		keepEvents:    make(map[string]bool, len(opts.Quota.KeepEvents)),
+		spilled:       make(map[int]bool),
+		commits:       make(map[string]CommitPos, len(opts.Cursors)),
+		reads:         make(map[string]CommitPos, len(opts.Cursors)),
+	}
+
+	for _, ev := range opts.Quota.KeepEvents {
+		w.keepEvents[ev] = true
+	}
+	if err := w.loadSpilled(); err != nil {
+		return nil, err
+	}
+
+	// сначала существующие курсоры, потом новые: новый sink стартует с самого отстающего
+	var fresh []WALCursor
+	for _, c := range opts.Cursors {
+		if _, dup := w.commits[c.Name]; dup {
+			return nil, fmt.Errorf("wal: duplicate cursor %q", c.Name)
+		}
+		cp, ok, err := w.loadCommit(c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("wal: load commit %q: %w", c.Name, err)
+		}
+		if !ok {
+			fresh = append(fresh, c)
+			continue
+		}
+		w.commits[c.Name] = cp
+		if _, err := os.Stat(w.commitPath(c.Name) + ".tmp"); err == nil {
+			// взят из .tmp (или .tmp битый) — сохраняем заново, пока .tmp не удалён
+			if err := w.saveCommitLocked(c.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for _, c := range fresh {
+		cp, err := w.initialCommit()
+		if err != nil {
+			return nil, err
+		}
+		log.Printf("WAL: new cursor %q starts at %+v", c.Name, cp)
+		w.commits[c.Name] = cp
+		// сразу на диск: иначе после рестарта курсор снова "новый" и стартует с другой позиции
+		if err := w.saveCommitLocked(c.Name); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, c := range opts.Cursors {
+		if c.Store != nil {
+			if err := w.reconcileCommit(c.Name, c.Store.ShardStore(w.shard)); err != nil {
+				return nil, err
+			}
+		}
+		// старый commit без off: находим смещение один раз (по индексу сегмента, если есть)
+		cp := w.commits[c.Name]
+		if cp.Off > 0 || cp.Line == 0 {
+			continue
+		}
+		cp, err := w.seekLine(cp.Seg, cp.Line)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("wal: resolve commit %q: %w", c.Name, err)
+		}
+		if err == nil {
+			log.Printf("WAL: commit %q %+v -> %+v", c.Name, w.commits[c.Name], cp)
+			w.commits[c.Name] = cp
+			if err := w.saveCommitLocked(c.Name); err != nil {
+				return nil, err
+			}
+		}
 	}
-	if err := w.loadCommit(); err != nil {
+
+	if err := w.removeTmp(); err != nil {
 		return nil, err
 	}
-	w.readPos = w.commit
 	if err := w.openOrCreateTail(); err != nil {
 		return nil, err
 	}
+	if err := w.recoverCommitsLocked(); err != nil {
+		return nil, err
+	}
+	for _, c := range opts.Cursors {
+		w.reads[c.Name] = w.commits[c.Name]
+	}
+
+	// всё, что было в файлах до старта, считаем на диске
+	w.durSeg, w.durOff = w.curSeg, w.curSize
+	for _, ev := range opts.SyncEvents {
+		w.syncEvents[ev] = true
+	}
+	if len(w.syncEvents) > 0 {
+		go w.runSyncer()
+	}
+	if w.rotateEvery > 0 || w.idleSeal > 0 {
+		go w.runSealer()
+	}
 	return w, nil
 }
 
-func (w *WAL) commitPath() string {
-	return filepath.Join(w.dir, "commit.meta")
+func (w *WAL) commitPath(name string) string {
+	if name == legacyCursor {
+		return filepath.Join(w.dir, "commit.meta")
+	}
+	return filepath.Join(w.dir, "commit."+name+".meta")
 }
 
-func (w *WAL) loadCommit() error {
-	b, err := os.ReadFile(w.commitPath())
-	if err != nil {
-		if os.IsNotExist(err) {
-			w.commit = CommitPos{Seg: 1, Line: 0}
-			return nil
-		}
-		return err
+// loadCommit: целый .tmp остаётся, только если упали между его fsync и rename — он новее
+// commit-файла. Недописанный .tmp не разбирается, тогда берём commit-файл. Битый commit-файл —
+// как отсутствующий: курсор начнёт с самого отстающего (повтор лучше потери).
+func (w *WAL) loadCommit(name string) (CommitPos, bool, error) {
+	path := w.commitPath(name)
+	cp, err := readCommitFile(path + ".tmp")
+	if err == nil {
+		log.Printf("WAL: commit %q recovered from %s.tmp: %+v", name, path, cp)
+	} else {
+		cp, err = readCommitFile(path)
 	}
-	var cp CommitPos
-	if err := json.Unmarshal(b, &cp); err != nil {
-		return err
+	switch {
+	case os.IsNotExist(err):
+		return CommitPos{}, false, nil
+	case errors.Is(err, errBadCommit):
+		log.Printf("WAL: %v, treating cursor %q as new", err, name)
+		return CommitPos{}, false, nil
+	case err != nil:
+		return CommitPos{}, false, err
 	}
 	if cp.Seg <= 0 {
 		cp.Seg = 1
@@ -90,39 +314,99 @@ func (w *WAL) loadCommit() error {
 	if cp.Line < 0 {
 		cp.Line = 0
 	}
-	w.commit = cp
-	return nil
+	if cp.Off < 0 {
+		cp.Off = 0
+	}
+	return cp, true, nil
+}
+
+// initialCommit — позиция для курсора без commit-файла: самый отстающий из уже
+// загруженных курсоров, иначе начало самого старого сегмента.
+func (w *WAL) initialCommit() (CommitPos, error) {
+	if cp, ok := minPos(w.commits); ok {
+		return cp, nil
+	}
+	segs, err := w.listSegs()
+	if err != nil {
+		return CommitPos{}, err
+	}
+	if len(segs) > 0 {
+		return CommitPos{Seg: segs[0], Line: 0}, nil
+	}
+	return CommitPos{Seg: 1, Line: 0}, nil
+}
+
+// reconcileCommit: commit-файл пишется после транзакции в store, поэтому может отстать
+// (или вообще потеряться). Позиция из store — истина.
+func (w *WAL) reconcileCommit(name string, store CommitStore) error {
+	cp, ok, err := store.LoadCommit()
+	if err != nil {
+		return fmt.Errorf("load commit %q from store: %w", name, err)
+	}
+	if !ok {
+		log.Printf("WAL: no commit %q in store, using %+v", name, w.commits[name])
+		return nil
+	}
+	if cp == w.commits[name] {
+		return nil
+	}
+	log.Printf("WAL: commit %q %+v differs from store %+v, trusting store", name, w.commits[name], cp)
+	w.commits[name] = cp
+	return w.saveCommitLocked(name)
 }
 
-func (w *WAL) saveCommitLocked() error {
-	b, _ := json.Marshal(w.commit)
-	tmp := w.commitPath() + ".tmp"
-	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+func (w *WAL) saveCommitLocked(name string) error {
+	b, _ := json.Marshal(w.commits[name])
+	path := w.commitPath(name)
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, b, "commit.write"); err != nil {
+		return err
+	}
+	crashPoint("commit.sync", nil)
+	if err := os.Rename(tmp, path); err != nil {
 		return err
 	}
-	return os.Rename(tmp, w.commitPath())
+	// без fsync каталога rename может не пережить падение машины: commit откатится назад
+	crashPoint("commit.rename", nil)
+	return syncDir(w.dir)
+}
+
+func minPos(m map[string]CommitPos) (CommitPos, bool) {
+	var out CommitPos
+	first := true
+	for _, cp := range m {
+		if first || cp.Less(out) {
+			out = cp
+			first = false
+		}
+	}
+	return out, !first
+}
+
+func (p CommitPos) Less(o CommitPos) bool {
+	return p.Seg < o.Seg || (p.Seg == o.Seg && p.Off < o.Off)
 }
 
 func (w *WAL) segPath(seg int) string {
-	return filepath.Join(w.dir, fmt.Sprintf("%06d.log", seg))
+	name := fmt.Sprintf("%06d.log", seg)
+	if w.isSpilled(seg) {
+		return filepath.Join(w.quota.SpillDir, name)
+	}
+	return filepath.Join(w.dir, name)
 }
 
+// listSegs — сегменты из WAL_DIR и (если есть) из spill-каталога, по порядку.
 func (w *WAL) listSegs() ([]int, error) {
-	entries, err := os.ReadDir(w.dir)
+	segs, err := listSegFiles(w.dir)
 	if err != nil {
 		return nil, err
 	}
-	var segs []int
-	for _, e := range entries {
-		name := e.Name()
-		if !strings.HasSuffix(name, ".log") {
-			continue
-		}
-		base := strings.TrimSuffix(name, ".log")
-		n, err := strconv.Atoi(base)
-		if err == nil {
-			segs = append(segs, n)
+	if w.quota.SpillDir != "" {
+		w.spillMu.Lock()
+		for seg := range w.spilled {
+			segs = append(segs, seg)
 		}
+		w.spillMu.Unlock()
 	}
 	sort.Ints(segs)
 	return segs, nil
@@ -134,195 +418,475 @@ func (w *WAL) openOrCreateTail() error {
 		return err
 	}
 	if len(segs) == 0 {
-		w.curSeg = 1
-		return w.openSeg(w.curSeg, true)
+		return w.openSeg(1)
 	}
-	w.curSeg = segs[len(segs)-1]
-	return w.openSeg(w.curSeg, false)
+	last := segs[len(segs)-1]
+	if _, path, err := statSeg(w.segPath(last)); err == nil && isPacked(path) {
+		return w.openSeg(last + 1) // сжатый — закрыт, не дописываем
+	}
+	return w.openSeg(last)
 }
 
-func (w *WAL) openSeg(seg int, create bool) error {
+// openSeg открывает сегмент на запись (нет — создаёт). Хвост, оборванный падением, обрезается.
+// Старый JSON-сегмент не дописываем: пишем в следующий.
+func (w *WAL) openSeg(seg int) error {
+	if w.quota.Policy == quotaSpill && w.overQuota() {
+		if _, _, err := statSeg(w.segPath(seg)); os.IsNotExist(err) {
+			// WAL_DIR по квоте полон: новый сегмент — в spill
+			w.spillMu.Lock()
+			w.spilled[seg] = true
+			w.spillMu.Unlock()
+			mWALSpilled.Inc()
+		}
+	}
+
 	path := w.segPath(seg)
-	var f *os.File
-	var err error
-	log.Printf("WAL: openSeg %s %t", path, create)
-	if create {
-		f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
-	} else {
-		f, err = os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
-		if os.IsNotExist(err) {
-			f, err = os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0o644)
+	st, err := os.Stat(path)
+	switch {
+	case os.IsNotExist(err), err == nil && st.Size() == 0:
+		// пустой файл — сегмент, созданный до обновления (или заголовок не доехал до диска)
+		log.Printf("WAL: create segment %s", path)
+		if err := createSegment(path); err != nil {
+			return err
+		}
+	case err != nil:
+		return err
+	}
+
+	// проверяем хвост от самого дальнего commit в этом сегменте: всё до него уже прочитано целым
+	var from CommitPos
+	for _, cp := range w.commits {
+		if cp.Seg == seg && from.Less(cp) {
+			from = cp
 		}
 	}
+	format, records, size, err := recoverSegment(path, from)
+	var cte *corruptTailError
+	if errors.As(err, &cte) {
+		if err := w.archiveCorruptTail(cte); err != nil {
+			return err
+		}
+		format, records, size, err = recoverSegment(path, from)
+	}
 	if err != nil {
 		return err
 	}
-	st, err := f.Stat()
+	if format == segJSON {
+		log.Printf("WAL: %s is a JSON segment (%d records), continuing in a new one", path, records)
+		return w.openSeg(seg + 1)
+	}
+	// ключ сменился (ротация, включили или выключили шифрование) — старым ключом больше не пишем
+	hr, err := openSegReader(path)
 	if err != nil {
-		_ = f.Close()
 		return err
 	}
+	keyID, aead, aad := hr.keyID, hr.aead, hr.aad
+	_ = hr.Close()
+	if keyID != walKeys.active {
+		log.Printf("WAL: %s is encrypted with key %d, active key is %d, continuing in a new one", path, keyID, walKeys.active)
+		return w.openSeg(seg + 1)
+	}
 
-	// считаем сколько строк уже в файле (для корректной позиции Append)
-	lines, err := countLines(path)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND, 0o644)
 	if err != nil {
-		_ = f.Close()
 		return err
 	}
-
 	if w.curFile != nil {
+		// закрываемый сегмент — на диск целиком (заодно отпускаем тех, кто ждёт его fsync)
+		w.syncMu.Lock()
+		serr := w.curFile.Sync()
 		_ = w.curFile.Close()
+		w.syncMu.Unlock()
+		w.markDurable(w.curSeg, w.curSize, serr)
+		if w.curSeg != seg {
+			w.sealSegment(w.curSeg)
+		}
+	}
+	if w.curSeg != seg || w.curOpened.IsZero() {
+		// после рестарта возраст сегмента считаем заново: время открытия до падения не знаем
+		w.curFirstTS, w.curLastTS = time.Time{}, time.Time{}
+		w.curOpened = time.Now()
+		w.lastAppend = w.curOpened
 	}
 	w.curFile = f
-	w.curSize = st.Size()
+	w.curKeyID, w.curAEAD, w.curAAD = keyID, aead, aad
+	w.curSize = size
 	w.curSeg = seg
-	w.curLine = lines
+	w.curLine = records
 	w.lastFsync = time.Now()
+	w.refreshUsage()
+	return nil
+}
+
+// archiveCorruptTail уносит байты сегмента за битой рамкой в архив (тот же, куда квота
+// drop_oldest уносит сегменты), чтобы recoverSegment мог обрезать сегмент и писать дальше.
+// Архива нет — не стартуем: терять то, что за рамкой, молча нельзя.
+func (w *WAL) archiveCorruptTail(cte *corruptTailError) error {
+	if w.quota.ArchiveDir == "" {
+		return fmt.Errorf("wal: %w; move the segment away or fix it by hand", cte)
+	}
+	if err := os.MkdirAll(w.quota.ArchiveDir, 0o755); err != nil {
+		return err
+	}
+	src, err := os.Open(cte.path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	archive := filepath.Join(w.quota.ArchiveDir, fmt.Sprintf("shard-%02d-%s.tail-%d", w.shard, filepath.Base(cte.path), cte.off))
+	dst, err := os.OpenFile(archive, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dst, io.NewSectionReader(src, cte.off, cte.size-cte.off))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = syncDir(w.quota.ArchiveDir)
+	}
+	if err != nil {
+		return fmt.Errorf("wal: archive corrupt tail of %s: %w", cte.path, err)
+	}
+	if err := os.Truncate(cte.path, cte.off); err != nil {
+		return err
+	}
+	mWALCorruptTail.Inc()
+	log.Printf("WAL: %v; moved them to %s and truncated the segment", cte, archive)
 	return nil
 }
 
 func (w *WAL) Append(ev Event) (AppendPos, error) {
+	pos, err := w.AppendBatch([]Event{ev})
+	if err != nil {
+		return AppendPos{}, err
+	}
+	return pos[0], nil
+}
+
+// AppendBatch пишет события одним write под одной блокировкой.
+// Либо записаны все события, либо (при ошибке) вызывающий считает, что ни одно.
+// Событиям без EventID присваивается новый UUID (evs меняется на месте).
+func (w *WAL) AppendBatch(evs []Event) ([]AppendPos, error) {
+	if len(evs) == 0 {
+		return nil, nil
+	}
+
+	var b []byte
+	ends := make([]int64, len(evs))
+	for i := range evs {
+		if evs[i].EventID == "" {
+			evs[i].EventID = newEventID()
+		}
+		b = appendRecord(b, evs[i])
+		ends[i] = int64(len(b))
+	}
+
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	// если commit ушёл вперёд — пишем уже в новом сегменте
-	if w.curSeg < w.commit.Seg {
-		if err := w.openSeg(w.commit.Seg, true); err != nil {
-			return AppendPos{}, err
+	if w.curFile == nil {
+		return nil, errWALClosed
+	}
+
+	// если какой-то commit ушёл вперёд (на начало следующего сегмента) — пишем уже в новом сегменте,
+	// иначе этот курсор пропустит дописанные в текущий сегмент строки
+	for _, cp := range w.commits {
+		if w.curSeg < cp.Seg {
+			if err := w.openSeg(cp.Seg); err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	// rotate by size
+	if err := w.enforceQuotaLocked(); err != nil {
+		return nil, err
+	}
+
+	// rotate by size (батч целиком попадает в один сегмент) или по времени
+	now := time.Now()
+	reason := w.rotateDueLocked(now)
 	if w.segMaxBytes > 0 && w.curSize >= w.segMaxBytes {
-		if err := w.openSeg(w.curSeg+1, true); err != nil {
-			return AppendPos{}, err
+		reason = "size"
+	}
+	if reason != "" {
+		if err := w.rotateLocked(reason); err != nil {
+			return nil, err
 		}
 	}
+	w.lastAppend = now
 
-	b, err := json.Marshal(ev)
-	if err != nil {
-		return AppendPos{}, err
+	// шифруем под ключ сегмента, в который пишем (после возможной ротации)
+	if w.curAEAD != nil {
+		b, ends = sealFrames(w.curAEAD, w.curAAD, b, ends)
 	}
-	b = append(b, '\n')
 
+	base := w.curSize
 	n, err := w.curFile.Write(b)
 	if err != nil {
-		return AppendPos{}, err
+		return nil, err
 	}
+	crashPoint("append.write", func() { _ = w.curFile.Truncate(base + int64(n/2)) })
 	w.curSize += int64(n)
-	w.curLine++ // ВАЖНО: увеличиваем счётчик строк
+	if !w.isSpilled(w.curSeg) {
+		w.usedBytes.Add(int64(n))
+	}
+
+	pos := make([]AppendPos, len(evs))
+	for i := range evs {
+		w.curLine++ // ВАЖНО: увеличиваем счётчик записей
+		pos[i] = AppendPos{Seg: w.curSeg, Line: w.curLine, Off: base + ends[i]}
+	}
+	if w.curFirstTS.IsZero() {
+		w.curFirstTS = evs[0].TS
+	}
+	w.curLastTS = evs[len(evs)-1].TS
 
 	if time.Since(w.lastFsync) >= w.fsyncEvery {
-		if err := w.curFile.Sync(); err != nil {
-			return AppendPos{}, err
+		w.syncMu.Lock()
+		err := w.curFile.Sync()
+		w.syncMu.Unlock()
+		w.markDurable(w.curSeg, w.curSize, err)
+		if err != nil {
+			return nil, err
 		}
 		w.lastFsync = time.Now()
 	}
 
-	return AppendPos{Seg: w.curSeg, Line: w.curLine}, nil
+	return pos, nil
+}
+
+// Subscribe подписывает будильник читателя (буфер 1) на записи в этот WAL.
+// Один канал можно подписать на все шарды (walSource).
+func (w *WAL) Subscribe(ch chan struct{}) {
+	w.notifyMu.Lock()
+	w.notify = append(w.notify, ch)
+	w.notifyMu.Unlock()
+}
+
+// Notify будит всех читателей (non-blocking).
+func (w *WAL) Notify() {
+	w.notifyMu.Lock()
+	defer w.notifyMu.Unlock()
+	for _, ch := range w.notify {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
 }
 
-func (w *WAL) MarkRead(pos AppendPos) {
+func (w *WAL) ReadPos(name string) CommitPos {
 	w.readMu.Lock()
 	defer w.readMu.Unlock()
+	return w.reads[name]
+}
 
-	if pos.Seg > w.readPos.Seg || (pos.Seg == w.readPos.Seg && pos.Line > w.readPos.Line) {
-		w.readPos = CommitPos{Seg: pos.Seg, Line: pos.Line}
-	}
+func (w *WAL) setReadPos(name string, pos CommitPos) {
+	w.readMu.Lock()
+	w.reads[name] = pos
+	w.readMu.Unlock()
 }
 
-// AdvanceCommit advances commit position by n events, relative to current commit pointer (seg,line).
-// Поскольку commit хранится “по строкам в сегменте”, нам нужно уметь “перескакивать” на следующий сегмент.
-func (w *WAL) AdvanceCommit(n int) error {
-	if n <= 0 {
-		return nil
-	}
+func (w *WAL) Commit(name string) CommitPos {
 	w.mu.Lock()
 	defer w.mu.Unlock()
+	return w.commits[name]
+}
 
-	log.Printf("WAL: AdvanceCommit, n=%d, commit=%+v", n, w.commit)
+// SetCommit выставляет commit курсора в уже записанную sink'ом позицию
+// (позиция последнего события батча, её приносит читатель WAL вместе с событием). O(1), без чтения сегмента.
+// Назад не двигает: курсор мог перепрыгнуть сегмент, унесённый квотой (drop_oldest).
+func (w *WAL) SetCommit(name string, cp CommitPos) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if cp.Less(w.commits[name]) {
+		return nil
+	}
+	w.commits[name] = cp
+	if w.commitCh != nil {
+		close(w.commitCh)
+		w.commitCh = nil
+	}
+	return w.saveCommitLocked(name)
+}
 
-	// Идём по сегментам, считая строки (лениво: читаем файл и считаем строки по необходимости).
-	for n > 0 {
-		path := w.segPath(w.commit.Seg)
-		lines, err := countLines(path)
-		if err != nil {
-			if os.IsNotExist(err) {
-				// сегмента ещё нет — commit указывает на “начало будущего сегмента”, это ок
-				return w.saveCommitLocked()
-			}
-			return err
+// WaitCommit ждёт, пока commit курсора name дойдёт до pos (REPL_MODE=sync ждёт так ack peer'а).
+func (w *WAL) WaitCommit(ctx context.Context, name string, pos CommitPos) error {
+	for {
+		w.mu.Lock()
+		if !w.commits[name].Less(pos) {
+			w.mu.Unlock()
+			return nil
 		}
-		remainingInSeg := lines - w.commit.Line
-		if remainingInSeg <= 0 {
-			// сегмент целиком уже подтверждён — двигаемся дальше
-			w.commit.Seg++
-			w.commit.Line = 0
-			continue
+		if w.commitCh == nil {
+			w.commitCh = make(chan struct{})
 		}
-		if n < remainingInSeg {
-			w.commit.Line += n
-			n = 0
-		} else {
-			// подтверждаем до конца сегмента
-			w.commit.Line += remainingInSeg
-			n -= remainingInSeg
-			// переходим на следующий сегмент
-			w.commit.Seg++
-			w.commit.Line = 0
+		ch := w.commitCh
+		w.mu.Unlock()
+		select {
+		case <-ch:
+		case <-ctx.Done():
+			return ctx.Err()
 		}
 	}
-
-	return w.saveCommitLocked()
 }
 
 func (w *WAL) Compact() error {
-	// держим w.mu на весь цикл, чтобы не пересечься с AdvanceCommit/Append
+	// держим w.mu на весь цикл, чтобы не пересечься с SetCommit/Append
 	w.mu.Lock()
 	defer w.mu.Unlock()
 
-	commit := w.commit
-	cur := w.curSeg
+	// сегмент удаляем, только когда его прошли ВСЕ курсоры (и commit, и чтение).
+	// commit на конце закрытого сегмента — сегмент пройден целиком (после него могло ничего не прийти)
+	limit := w.curSeg
+	for _, cp := range w.commits {
+		seg := cp.Seg
+		if seg < w.curSeg && cp.Off > 0 && cp.Off >= w.sealedSize(seg) {
+			seg++
+		}
+		if seg < limit {
+			limit = seg
+		}
+	}
 
 	w.readMu.Lock()
-	read := w.readPos
-	w.readMu.Unlock()
-
-	limit := commit.Seg
-	if cur < limit {
-		limit = cur
-	}
-	if read.Seg < limit {
-		limit = read.Seg
+	for _, rp := range w.reads {
+		if rp.Seg < limit {
+			limit = rp.Seg
+		}
 	}
+	w.readMu.Unlock()
 
 	segs, err := w.listSegs()
 	if err != nil {
 		return err
 	}
 
+	removed := false
 	for _, seg := range segs {
 		if seg < limit {
+			if removed {
+				crashPoint("compact.remove", nil)
+			}
+			removed = true
 			_ = os.Remove(w.segPath(seg))
+			_ = os.Remove(w.segPath(seg) + packedExt)
+			_ = os.Remove(w.indexPath(seg))
+			if w.isSpilled(seg) {
+				w.spillMu.Lock()
+				delete(w.spilled, seg)
+				w.spillMu.Unlock()
+			}
 		}
 	}
+	if removed {
+		// иначе после падения удалённые сегменты могут вернуться (безвредно: они до всех commit'ов)
+		_ = syncDir(w.dir)
+	}
+	w.refreshUsage()
 	return nil
 }
 
-func (w *WAL) Stats() (CommitPos, int, int64, error) {
+// Close — при остановке: fsync текущего сегмента и commit-файлов.
+func (w *WAL) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var firstErr error
+	for name := range w.commits {
+		if err := w.saveCommitLocked(name); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if w.curFile != nil {
+		w.syncMu.Lock()
+		serr := w.curFile.Sync()
+		if err := w.curFile.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		w.syncMu.Unlock()
+		w.markDurable(w.curSeg, w.curSize, serr)
+		if serr != nil && firstErr == nil {
+			firstErr = serr
+		}
+		w.curFile = nil
+		close(w.stop)
+	}
+	// commit-файлы и сегмент на диске — каталог можно отдавать следующему процессу
+	w.lock.release()
+	return firstErr
+}
+
+// sealedSize — размер закрытого сегмента (-1 — не знаем: тогда сегмент не считается пройденным).
+func (w *WAL) sealedSize(seg int) int64 {
+	if idx, ok := w.LoadIndex(seg); ok {
+		return idx.Size
+	}
+	st, err := os.Stat(w.segPath(seg))
+	if err != nil {
+		return -1
+	}
+	return st.Size()
+}
+
+// LagBytes — байт от commit курсора name до конца WAL (размеры закрытых сегментов — из индекса, без чтения).
+func (w *WAL) LagBytes(name string) int64 {
+	w.mu.Lock()
+	cp, curSeg, curSize := w.commits[name], w.curSeg, w.curSize
+	w.mu.Unlock()
+	if cp.Seg >= curSeg {
+		return max(0, curSize-cp.Off)
+	}
+	lag := curSize
+	for seg := cp.Seg; seg < curSeg; seg++ {
+		if size := w.sealedSize(seg); size > 0 {
+			lag += size
+		}
+	}
+	return max(0, lag-cp.Off)
+}
+
+// PendingRecords — записей от commit курсора name до конца WAL: число записей закрытых сегментов — из
+// индекса, текущего — из счётчика, без чтения сегментов. Сегмент, индекс которого ещё не построен, не считается.
+func (w *WAL) PendingRecords(name string) int {
+	w.mu.Lock()
+	cp, curSeg, curLine := w.commits[name], w.curSeg, w.curLine
+	w.mu.Unlock()
+	if cp.Seg >= curSeg {
+		return max(0, curLine-cp.Line)
+	}
+	n := curLine
+	for seg := cp.Seg; seg < curSeg; seg++ {
+		if idx, ok := w.LoadIndex(seg); ok {
+			n += idx.Records
+		}
+	}
+	return max(0, n-cp.Line)
+}
+
+// Stats: commit каждого курсора, число сегментов, их суммарный размер.
+func (w *WAL) Stats() (map[string]CommitPos, int, int64, error) {
 	segs, err := w.listSegs()
 	if err != nil {
-		return CommitPos{}, 0, 0, err
+		return nil, 0, 0, err
 	}
 	var total int64
 	for _, seg := range segs {
-		st, err := os.Stat(w.segPath(seg))
+		st, _, err := statSeg(w.segPath(seg))
 		if err == nil {
 			total += st.Size()
 		}
 	}
 	w.mu.Lock()
-	cp := w.commit
+	cps := make(map[string]CommitPos, len(w.commits))
+	for name, cp := range w.commits {
+		cps[name] = cp
+	}
 	w.mu.Unlock()
-	return cp, len(segs), total, nil
+	return cps, len(segs), total, nil
 }
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/* ---------------- WAL: сжатие закрытых сегментов ---------------- */
+
+// WAL_COMPRESS=zstd (по умолчанию none): закрытый сегмент после индекса сжимается в фоне в 000012.log.zst,
+// .log удаляется. Текущий сегмент не сжимается никогда. Читатели (курсоры sinks, индекс, seek) открывают .zst прозрачно
+// (openSegReader); позиции и индекс — в несжатых смещениях, так что commit'ы не меняются.
+// Reader курсора, успевший открыть .log, дочитывает его по открытому дескриптору.
+//
+// Зашифрованный сегмент сжимается до шифрования: записи расшифровываются, поток записей (та же длина,
+// те же смещения, см. packEncryptedFile) режется на блоки, каждый блок — кадр zstd под AES-GCM:
+//
+//	header сегмента как есть (key id, salt) | block: len u32 LE | last u8 | nonce [12] | AES-GCM(кадр zstd)
+//
+// Ключ блоков выводится из ключа сегмента и его salt (метка packedKeyLabel), AAD — заголовок,
+// номер блока и last: блоки не переставить, обрезанный файл не читается.
+
+const packedExt = ".zst"
+
+// statSeg — файл сегмента: path или сжатый path.zst. Возвращает реальный путь.
+func statSeg(path string) (os.FileInfo, string, error) {
+	st, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		if zst, zerr := os.Stat(path + packedExt); zerr == nil {
+			return zst, path + packedExt, nil
+		}
+	}
+	return st, path, err
+}
+
+func isPacked(path string) bool { return strings.HasSuffix(path, packedExt) }
+
+// compressSegment сжимает закрытый сегмент. Индекс уже есть: в него пишем размер .zst,
+// чтобы он остался валиден и после удаления .log.
+func (w *WAL) compressSegment(seg int) error {
+	w.packMu.Lock()
+	defer w.packMu.Unlock()
+
+	path := w.segPath(seg)
+	if _, err := os.Stat(path); err != nil {
+		return err // уже сжат или удалён Compact
+	}
+	idx, ok := w.LoadIndex(seg)
+	if !ok {
+		var err error
+		if idx, err = w.IndexSegment(seg); err != nil {
+			return err
+		}
+	}
+	zpath := path + packedExt
+	tmp := zpath + ".tmp"
+	var zsize int64
+	var err error
+	if idx.KeyID != 0 {
+		// шифротекст не сжимается: сжимаем открытые записи и шифруем блоки. Читатели видят
+		// поток с открытыми записями — crc индекса теперь по нему
+		zsize, idx.CRC32C, err = packEncryptedFile(path, tmp)
+	} else {
+		zsize, err = packFile(path, tmp)
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	idx.ZSize = zsize
+	if err := w.writeIndex(idx); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, zpath); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(zpath)); err != nil {
+		return err
+	}
+	crashPoint("compress.rename", nil)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	mWALCompressed.Inc()
+	if saved := idx.Size - zsize; saved > 0 { // крошечный сегмент zstd может и раздуть
+		mWALCompressSaved.Add(float64(saved))
+	}
+	w.refreshUsage()
+	return nil
+}
+
+func packFile(src, dst string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+
+	enc, err := zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, err
+	}
+	if _, err := io.Copy(enc, in); err != nil {
+		enc.Close()
+		return 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, err
+	}
+	st, err := out.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return st.Size(), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+func (w *WAL) maybeCompress(seg int) {
+	if !w.compress {
+		return
+	}
+	if err := w.compressSegment(seg); err != nil && !os.IsNotExist(err) {
+		log.Printf("WAL: compress segment %d: %v", seg, err)
+	}
+}
+
+const (
+	packedKeyLabel   = "pwal packed"
+	packedBlockSize  = 256 * 1024 // открытых байт на блок
+	packedBlockHdr   = 5
+	maxPackedBlockSz = 4 << 20
+)
+
+// packEncryptedFile сжимает зашифрованный сегмент. Каждая запись len | crc | nonce | шифротекст+tag
+// кладётся в поток как len | crc' | нули | открытое тело | нули той же длины (crc' — по такому телу):
+// смещения в потоке совпадают со смещениями в .log, а нули и открытые данные сжимаются.
+func packEncryptedFile(src, dst string) (int64, uint32, error) {
+	r, err := openSegReader(src)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	if r.aead == nil {
+		return 0, 0, fmt.Errorf("%s: not encrypted", src)
+	}
+	aead, err := walKeys.deriveAEAD(r.keyID, packedKeyLabel, r.aad[segHeaderLen:])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return 0, 0, err
+	}
+	defer enc.Close()
+
+	bw := bufio.NewWriterSize(out, 256*1024)
+	if _, err := bw.Write(r.aad); err != nil {
+		return 0, 0, err
+	}
+	crc := crc32.New(crcTable)
+	crc.Write(r.aad)
+	pw := &packedBlockWriter{w: bw, enc: enc, aead: aead, aad: r.aad}
+
+	ns, overhead := r.aead.NonceSize(), r.aead.Overhead()
+	var rec []byte
+	for {
+		raw, err := r.nextRaw()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, 0, err // битая запись: сегмент остаётся несжатым
+		}
+		plain, err := r.open(raw)
+		if err != nil {
+			return 0, 0, err
+		}
+		rec = append(rec[:0], make([]byte, recHeaderLen+len(raw))...)
+		body := rec[recHeaderLen:]
+		copy(body[ns:len(body)-overhead], plain)
+		binary.LittleEndian.PutUint32(rec, uint32(len(body)))
+		binary.LittleEndian.PutUint32(rec[4:], crc32.Checksum(body, crcTable))
+		crc.Write(rec)
+		if _, err := pw.Write(rec); err != nil {
+			return 0, 0, err
+		}
+	}
+	if err := pw.close(); err != nil {
+		return 0, 0, err
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, 0, err
+	}
+	if err := out.Sync(); err != nil {
+		return 0, 0, err
+	}
+	st, err := out.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	return st.Size(), crc.Sum32(), nil
+}
+
+// packedBlockWriter режет открытый поток на блоки packedBlockSize: zstd, затем AES-GCM.
+type packedBlockWriter struct {
+	w    io.Writer
+	enc  *zstd.Encoder
+	aead cipher.AEAD
+	aad  []byte
+	buf  []byte
+	n    uint64
+}
+
+func (p *packedBlockWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for len(p.buf) >= packedBlockSize {
+		if err := p.flush(p.buf[:packedBlockSize], false); err != nil {
+			return 0, err
+		}
+		p.buf = p.buf[:copy(p.buf, p.buf[packedBlockSize:])]
+	}
+	return len(b), nil
+}
+
+func (p *packedBlockWriter) close() error { return p.flush(p.buf, true) }
+
+func (p *packedBlockWriter) flush(chunk []byte, last bool) error {
+	frame := p.enc.EncodeAll(chunk, nil)
+	nonce := make([]byte, p.aead.NonceSize())
+	_, _ = rand.Read(nonce)
+	sealed := p.aead.Seal(nonce, nonce, frame, packedBlockAAD(p.aad, p.n, last))
+	p.n++
+
+	var hdr [packedBlockHdr]byte
+	binary.LittleEndian.PutUint32(hdr[:], uint32(len(sealed)))
+	if last {
+		hdr[4] = 1
+	}
+	if _, err := p.w.Write(hdr[:]); err != nil {
+		return err
+	}
+	_, err := p.w.Write(sealed)
+	return err
+}
+
+func packedBlockAAD(header []byte, n uint64, last bool) []byte {
+	aad := binary.LittleEndian.AppendUint64(bytes.Clone(header), n)
+	if last {
+		return append(aad, 1)
+	}
+	return append(aad, 0)
+}
+
+// errPackedTruncated — сжатый сегмент обрезан. Не io.EOF: закрытый сегмент не дописывается, его хвост — потеря.
+var errPackedTruncated = errors.New("packed segment truncated")
+
+// packedBlockReader — обратный packedBlockWriter: открытый поток зашифрованного сжатого сегмента.
+type packedBlockReader struct {
+	rd   *bufio.Reader
+	dec  *zstd.Decoder
+	aead cipher.AEAD
+	aad  []byte
+	buf  []byte
+	n    uint64
+	done bool
+}
+
+func (p *packedBlockReader) Read(b []byte) (int, error) {
+	for len(p.buf) == 0 {
+		if p.done {
+			return 0, io.EOF
+		}
+		if err := p.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(b, p.buf)
+	p.buf = p.buf[n:]
+	return n, nil
+}
+
+func (p *packedBlockReader) next() error {
+	var hdr [packedBlockHdr]byte
+	if _, err := io.ReadFull(p.rd, hdr[:]); err != nil {
+		return errPackedTruncated // последний блок так и не встретился
+	}
+	n, last := binary.LittleEndian.Uint32(hdr[:]), hdr[4] == 1
+	if n > maxPackedBlockSz || int(n) < p.aead.NonceSize()+p.aead.Overhead() {
+		return errBadFrame
+	}
+	sealed := make([]byte, n)
+	if _, err := io.ReadFull(p.rd, sealed); err != nil {
+		return errPackedTruncated
+	}
+	ns := p.aead.NonceSize()
+	frame, err := p.aead.Open(nil, sealed[:ns], sealed[ns:], packedBlockAAD(p.aad, p.n, last))
+	if err != nil {
+		return errDecrypt
+	}
+	if p.buf, err = p.dec.DecodeAll(frame, nil); err != nil {
+		return err
+	}
+	p.n++
+	p.done = last
+	return nil
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type segEntry struct {
+	ev  Event
+	off int64
+}
+
+func readSegment(t *testing.T, path string, from int64) ([]segEntry, error) {
+	t.Helper()
+	r, err := openSegReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if err := r.seek(from); err != nil {
+		t.Fatal(err)
+	}
+	var out []segEntry
+	for {
+		ev, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			return out, nil
+		}
+		if err != nil {
+			return out, err
+		}
+		out = append(out, segEntry{ev: ev, off: r.off})
+	}
+}
+
+func writeTestSegment(t *testing.T, path string, n int) {
+	t.Helper()
+	sw, err := createSegWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		ev := Event{
+			TS:        time.Unix(1700000000+int64(i), 0).UTC(),
+			EventID:   "event-" + strconv.Itoa(i),
+			DomainID:  42,
+			FileID:    i % 7,
+			EventName: "play",
+			VisitorIP: net.ParseIP("198.51.100." + strconv.Itoa(i%250)).To16(),
+		}
+		if err := sw.add(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPackEncryptedSegment(t *testing.T) {
+	withWALKeys(t, "3:"+testWALKey(3))
+	path := filepath.Join(t.TempDir(), "000001.log")
+	writeTestSegment(t, path, 20000) // больше одного блока
+
+	want, err := readSegment(t, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idx, err := buildSegmentIndex(path, 1, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	zpath := path + packedExt
+	zsize, crc, err := packEncryptedFile(path, zpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if zsize >= idx.Size/2 {
+		t.Errorf("packed %d bytes from %d: not compressed", zsize, idx.Size)
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+
+	packed, err := os.ReadFile(zpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(packed, []byte("event-1")) || bytes.Contains(packed, []byte("play")) {
+		t.Error("packed segment contains plaintext")
+	}
+
+	// те же события на тех же смещениях
+	got, err := readSegment(t, path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("%d events after pack, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].off != want[i].off || got[i].ev.EventID != want[i].ev.EventID || !bytes.Equal(got[i].ev.VisitorIP, want[i].ev.VisitorIP) {
+			t.Fatalf("event %d: %+v at %d, want %+v at %d", i, got[i].ev, got[i].off, want[i].ev, want[i].off)
+		}
+	}
+
+	// seek в середину
+	mid := want[len(want)/2]
+	tail, err := readSegment(t, path, mid.off)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tail) != len(want)-len(want)/2-1 || tail[0].ev.EventID != want[len(want)/2+1].ev.EventID {
+		t.Errorf("seek to %d: %d events, first %q", mid.off, len(tail), tail[0].ev.EventID)
+	}
+
+	chk := &SegmentIndex{Size: idx.Size}
+	if err := fileCRC(path, chk); err != nil || chk.CRC32C != crc {
+		t.Errorf("fileCRC of packed segment %08x (%v), pack returned %08x", chk.CRC32C, err, crc)
+	}
+
+	// обрезанный файл — ошибка, а не тихий конец сегмента
+	if err := os.Truncate(zpath, zsize-10); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readSegment(t, path, 0); err == nil {
+		t.Error("truncated packed segment read without error")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+/* ---------------- WAL: падения и восстановление ---------------- */
+
+// Порядок на диске, который переживает падение машины:
+//
+//	сегмент:  000012.log.tmp (заголовок) -> fsync -> rename -> fsync каталога
+//	commit:   commit.meta.tmp -> fsync -> rename -> fsync каталога
+//	квота:    rename в архив -> fsync обоих каталогов -> только потом commit'ы за сегмент
+//
+// При старте (openWAL): целый commit.*.tmp новее commit-файла и побеждает; битый commit-файл
+// (старые версии без fsync оставляли пустой) — как отсутствующий; остальные *.tmp удаляются;
+// commit на сегменте, которого нет, переезжает на ближайшую существующую позицию (recoverCommitsLocked).
+//
+// WAL_FAULT=<точка>[@N] — "падение" (os.Exit без Close) на N-м проходе точки, с откатом того,
+// что не пережило бы падения машины. Обычная сборка WAL_FAULT не читает: walFault задают только
+// тесты (TestMain) и сборка с -tags walfault (wal_fault.go) для `wal crashtest`.
+
+// faultPoints — точки по ходу жизни сегмента; wal crashtest проходит все.
+var faultPoints = []string{
+	"segment.create",  // заголовок нового сегмента записан, не fsync'нут
+	"segment.rename",  // сегмент переименован, каталог не fsync'нут
+	"append.write",    // батч записан, не fsync'нут
+	"commit.write",    // commit.tmp записан, не fsync'нут
+	"commit.sync",     // commit.tmp на диске, rename не сделан
+	"commit.rename",   // rename сделан, каталог не fsync'нут
+	"seal.index",      // сегмент закрыт ротацией, индекса ещё нет
+	"compress.rename", // .zst на месте, .log ещё не удалён
+	"quota.drop",      // сегмент унесён в архив, commit'ы ещё на нём
+	"compact.remove",  // часть пройденных сегментов удалена
+}
+
+const faultExitCode = 86
+
+var (
+	walFault     string // <точка>[@N]; пусто — точки падения ничего не делают
+	walFaultHits atomic.Int64
+)
+
+// crashPoint: WAL_FAULT указывает сюда — lose откатывает несинхронизированное (что потерялось бы
+// вместе с page cache), и процесс выходит как упавший.
+func crashPoint(name string, lose func()) {
+	if walFault == "" {
+		return
+	}
+	point, nth := walFault, int64(1)
+	if p, n, ok := strings.Cut(walFault, "@"); ok {
+		point = p
+		if v, err := strconv.ParseInt(n, 10, 64); err == nil && v > 0 {
+			nth = v
+		}
+	}
+	if point != name || walFaultHits.Add(1) != nth {
+		return
+	}
+	if lose != nil {
+		lose()
+	}
+	fmt.Fprintf(os.Stderr, "WAL: fault injection: crash at %s\n", walFault)
+	os.Exit(faultExitCode)
+}
+
+var errBadCommit = errors.New("bad commit file")
+
+func readCommitFile(path string) (CommitPos, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return CommitPos{}, err
+	}
+	var cp CommitPos
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return CommitPos{}, fmt.Errorf("%w %s: %v", errBadCommit, path, err)
+	}
+	return cp, nil
+}
+
+// writeFileSync — запись файла целиком с fsync (point — точка падения между записью и fsync).
+func writeFileSync(path string, b []byte, point string) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	crashPoint(point, func() { _ = f.Truncate(int64(len(b) / 2)) })
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// removeTmp — недописанные сегменты, индексы, .zst и commit'ы, брошенные падением.
+// commit.*.tmp к этому моменту уже прочитаны loadCommit и пересохранены.
+func (w *WAL) removeTmp() error {
+	dirs := []string{w.dir}
+	if w.quota.SpillDir != "" {
+		dirs = append(dirs, w.quota.SpillDir)
+	}
+	for _, dir := range dirs {
+		tmps, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmps {
+			log.Printf("WAL: removing %s left by a crash", tmp)
+			if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// recoverCommitsLocked — commit'ы после открытия хвоста. Сегмент мог не пережить падение
+// (создан, а каталог не fsync'нут) или уйти в архив квотой, пока commit'ы ещё на нём.
+func (w *WAL) recoverCommitsLocked() error {
+	segs, err := w.listSegs()
+	if err != nil {
+		return err
+	}
+	exists := make(map[int]bool, len(segs))
+	for _, seg := range segs {
+		exists[seg] = true
+	}
+	tail := CommitPos{Seg: w.curSeg, Line: w.curLine, Off: w.curSize}
+	for name, cp := range w.commits {
+		var fixed CommitPos
+		switch {
+		case cp.Seg > w.curSeg, cp.Seg == w.curSeg && cp.Off > w.curSize:
+			// хвост потерян: ставим на конец, иначе новые записи лягут ниже commit и курсор их пропустит
+			fixed = tail
+		case !exists[cp.Seg]:
+			// сегмента нет — продолжаем со следующего существующего
+			fixed = tail
+			for _, seg := range segs {
+				if seg > cp.Seg {
+					fixed = CommitPos{Seg: seg}
+					break
+				}
+			}
+		default:
+			continue
+		}
+		log.Printf("WAL: commit %q %+v points past the data on disk, moving to %+v", name, cp, fixed)
+		w.commits[name] = fixed
+		if err := w.saveCommitLocked(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
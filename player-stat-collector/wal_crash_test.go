@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMain: с WAL_CRASH_DIR тестовый бинарник — дочерний процесс TestWALCrashRecovery, а не тесты:
+// нагрузка wal crashtest-run с точкой падения из WAL_FAULT.
+func TestMain(m *testing.M) {
+	if dir := os.Getenv("WAL_CRASH_DIR"); dir != "" {
+		walFault = os.Getenv("WAL_FAULT")
+		os.Exit(cmdWALCrashRun([]string{"--dir", dir}))
+	}
+	os.Exit(m.Run())
+}
+
+// TestWALCrashRecovery — падение в каждой точке faultPoints (первый и второй проход), затем
+// восстановление обычным NewWAL: подтверждённые события и commit'ы на месте, без повторов.
+func TestWALCrashRecovery(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns a process per fault point")
+	}
+	for _, point := range faultPoints {
+		for _, hit := range []int{1, 2} {
+			fault := point + "@" + strconv.Itoa(hit)
+			t.Run(strings.ReplaceAll(fault, "@", "-"), func(t *testing.T) {
+				dir := filepath.Join(t.TempDir(), "wal")
+
+				var stdout, stderr bytes.Buffer
+				cmd := exec.Command(os.Args[0])
+				cmd.Env = append(os.Environ(), "WAL_FAULT="+fault, "WAL_CRASH_DIR="+dir)
+				cmd.Stdout, cmd.Stderr = &stdout, &stderr
+				err := cmd.Run()
+				var ee *exec.ExitError
+				if !errors.As(err, &ee) || ee.ExitCode() != faultExitCode {
+					t.Fatalf("writer did not crash at %s: %v\n%s", fault, err, stderr.String())
+				}
+
+				if err := verifyCrash(dir, parseCrashAcks(stdout.Bytes(), point)); err != nil {
+					t.Fatal(err)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+/* ---------------- WAL: шифрование ---------------- */
+
+// WAL_ENCRYPT_KEYS / WAL_ENCRYPT_KEYS_FILE — ключи AES-256 в виде id:base64 (id 1..65535; в env через
+// запятую, в файле по одному на строку). Новые сегменты шифруются ключом WAL_ENCRYPT_KEY_ID
+// (по умолчанию — с наибольшим id; 0 — не шифровать, ключи только для чтения):
+//
+//	header: "PWAL" | format u8 (=1) | flags u8 (0x01) | key id u16 LE | salt [16]
+//	record: len u32 LE | crc32c u32 LE | nonce [12] | AES-GCM(schema u8 | payload)
+//
+// Ключ сегмента — HMAC-SHA256(ключ, salt): у каждого сегмента свой, случайного nonce хватает с запасом.
+// AAD — заголовок сегмента: запись не расшифруется в чужом сегменте или с чужим key id.
+// crc — по зашифрованному телу: битые и оборванные записи находятся и без ключа.
+// Позиции и индекс — в смещениях файла, как у открытого сегмента. Шифротекст не сжимается, поэтому
+// WAL_COMPRESS сжимает открытые записи и шифрует уже кадры zstd (см. wal_compress.go).
+// IP и сырые записи WAL в dead-letter шифруются тем же активным ключом (DeadLetterEntry.Sealed).
+
+const (
+	segFlagEncrypted = 0x01
+	segSaltLen       = 16
+	segEncHeaderLen  = segHeaderLen + segSaltLen
+	walKeyLen        = 32
+)
+
+type walKeyRing struct {
+	keys   map[uint16][]byte
+	active uint16 // 0 — новые сегменты не шифруются
+}
+
+// walKeys — ключи процесса. Их читают все, кто открывает сегменты (курсоры sinks, индекс, офлайн-команды),
+// поэтому не опция WAL: сервис ставит их из loadConfig, команды — в runCommand.
+var walKeys walKeyRing
+
+func walKeysFromEnv() (walKeyRing, error) {
+	return loadWALKeys(env("WAL_ENCRYPT_KEYS", ""), env("WAL_ENCRYPT_KEYS_FILE", ""), env("WAL_ENCRYPT_KEY_ID", ""))
+}
+
+func loadWALKeys(list, file, active string) (walKeyRing, error) {
+	ring := walKeyRing{keys: map[uint16][]byte{}}
+	entries := splitList(list)
+	if file != "" {
+		st, err := os.Stat(file)
+		if err != nil {
+			return ring, err
+		}
+		if st.Mode().Perm()&0o077 != 0 {
+			log.Printf("WAL: key file %s is accessible by group/others (%v)", file, st.Mode().Perm())
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return ring, err
+		}
+		for _, line := range strings.Split(string(b), "\n") {
+			if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+				entries = append(entries, line)
+			}
+		}
+	}
+	for _, e := range entries {
+		idStr, key64, ok := strings.Cut(e, ":")
+		id, err := strconv.ParseUint(strings.TrimSpace(idStr), 10, 16)
+		if !ok || err != nil || id == 0 {
+			return ring, fmt.Errorf("WAL_ENCRYPT_KEYS: want id:base64 with id 1..65535, got %q", idStr)
+		}
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(key64))
+		if err != nil || len(key) != walKeyLen {
+			return ring, fmt.Errorf("WAL_ENCRYPT_KEYS: key %d: want %d bytes of base64", id, walKeyLen)
+		}
+		if _, dup := ring.keys[uint16(id)]; dup {
+			return ring, fmt.Errorf("WAL_ENCRYPT_KEYS: duplicate key id %d", id)
+		}
+		ring.keys[uint16(id)] = key
+		ring.active = max(ring.active, uint16(id))
+	}
+	if active != "" {
+		id, err := strconv.ParseUint(active, 10, 16)
+		if err != nil {
+			return ring, fmt.Errorf("WAL_ENCRYPT_KEY_ID: %v", err)
+		}
+		if _, ok := ring.keys[uint16(id)]; !ok && id != 0 {
+			return ring, fmt.Errorf("WAL_ENCRYPT_KEY_ID: no key %d in WAL_ENCRYPT_KEYS", id)
+		}
+		ring.active = uint16(id)
+	}
+	return ring, nil
+}
+
+// segmentAEAD — шифр сегмента по его заголовку (key id и salt).
+func (k walKeyRing) segmentAEAD(id uint16, salt []byte) (cipher.AEAD, error) {
+	return k.deriveAEAD(id, "pwal segment", salt)
+}
+
+// deriveAEAD — AES-GCM под ключом HMAC-SHA256(ключ id, label | salt). label разводит ключи
+// сегментов WAL и записей dead-letter.
+func (k walKeyRing) deriveAEAD(id uint16, label string, salt []byte) (cipher.AEAD, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("encrypted with key id %d, which is not in WAL_ENCRYPT_KEYS", id)
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+	mac.Write(salt)
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptedHeader — заголовок нового сегмента под активным ключом.
+func encryptedHeader(h []byte, id uint16) []byte {
+	h[5] |= segFlagEncrypted
+	binary.LittleEndian.PutUint16(h[6:], id)
+	salt := make([]byte, segSaltLen)
+	_, _ = rand.Read(salt)
+	return append(h, salt...)
+}
+
+// sealFrames шифрует готовые записи (appendRecord) под шифр текущего сегмента.
+// ends — концы записей в b, возвращаются пересчитанными под новый буфер.
+func sealFrames(aead cipher.AEAD, aad, b []byte, ends []int64) ([]byte, []int64) {
+	ns := aead.NonceSize()
+	out := make([]byte, 0, len(b)+len(ends)*(ns+aead.Overhead()))
+	newEnds := make([]int64, len(ends))
+	var off int64
+	for i, end := range ends {
+		body := b[off+recHeaderLen : end]
+		start := len(out)
+		nonce := make([]byte, ns)
+		_, _ = rand.Read(nonce)
+		out = append(out, make([]byte, recHeaderLen)...)
+		out = append(out, nonce...)
+		out = aead.Seal(out, nonce, body, aad)
+
+		sealed := out[start+recHeaderLen:]
+		binary.LittleEndian.PutUint32(out[start:], uint32(len(sealed)))
+		binary.LittleEndian.PutUint32(out[start+4:], crc32.Checksum(sealed, crcTable))
+		newEnds[i] = int64(len(out))
+		off = end
+	}
+	return out, newEnds
+}
+
+var errDecrypt = errors.New("record decrypt failed")
+
+// open расшифровывает тело записи: nonce | шифротекст. В сжатом сегменте тело уже открыто.
+func (r *segReader) open(raw []byte) ([]byte, error) {
+	ns := r.aead.NonceSize()
+	if len(raw) < ns+r.aead.Overhead() {
+		return nil, errDecrypt
+	}
+	if r.opened {
+		return raw[ns : len(raw)-r.aead.Overhead()], nil
+	}
+	plain, err := r.aead.Open(nil, raw[:ns], raw[ns:], r.aad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return plain, nil
+}
@@ -0,0 +1,11 @@
+//go:build walfault
+
+package main
+
+import "os"
+
+// Сборка для `wal crashtest`: точки падения включаются из окружения (WAL_FAULT, см. wal_crash.go).
+
+const walFaultBuild = true
+
+func init() { walFault = os.Getenv("WAL_FAULT") }
@@ -0,0 +1,7 @@
+//go:build !walfault
+
+package main
+
+// Обычная сборка: WAL_FAULT не читается, walFault задают только тесты.
+
+const walFaultBuild = false
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/* ---------------- WAL: формат сегмента ---------------- */
+
+// Бинарный сегмент (v1):
+//
+//	header: "PWAL" | format u8 (=1) | flags u8 | reserved u16 (зашифрованный — см. wal_crypt.go)
+//	record: len u32 LE | crc32c u32 LE | schema u8 | payload
+//
+// len — длина schema+payload, crc — по schema+payload. Payload схемы 1 — поля Event
+// varint'ами (см. appendEventV1). Позиция — (seg, line, off): номер записи в сегменте и
+// смещение конца этой записи в файле; читатель встаёт на off одним Seek.
+//
+// Старые сегменты — JSON-строки без заголовка. Их читаем как есть, но не дописываем:
+// после обновления WAL_DIR первая запись уходит в новый (бинарный) сегмент.
+
+const (
+	segMagic        = "PWAL"
+	segHeaderLen    = 8
+	segFormatV1     = 1
+	recHeaderLen    = 8
+	recSchemaV1     = 1
+	maxRecordLength = 1 << 20
+)
+
+// формат сегмента на диске
+const (
+	segJSON   = 0
+	segBinary = 1
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// errEmptyRecord — пустая строка в JSON-сегменте: запись есть (считается в позиции), события нет
+	errEmptyRecord = errors.New("empty record")
+	// errBadFrame — длина записи не лезет ни в какие рамки: дальше сегмент не разобрать
+	errBadFrame = errors.New("bad record frame")
+)
+
+// corruptRecordError — запись прочитана целиком (позиция двигается), но событие из неё не достать.
+type corruptRecordError struct {
+	raw    []byte
+	binary bool
+	err    error
+}
+
+func (e *corruptRecordError) Error() string { return e.err.Error() }
+func (e *corruptRecordError) Unwrap() error { return e.err }
+
+func segmentHeader() []byte {
+	h := make([]byte, segHeaderLen)
+	copy(h, segMagic)
+	h[4] = segFormatV1
+	if walKeys.active != 0 {
+		return encryptedHeader(h, walKeys.active)
+	}
+	return h
+}
+
+// createSegment создаёт пустой бинарный сегмент атомарно (tmp + rename):
+// читатель никогда не увидит файл без заголовка. fsync файла и каталога — до первой записи:
+// иначе после падения машины commit может указывать на сегмент, которого нет.
+func createSegment(path string) error {
+	tmp := path + ".tmp"
+	if err := writeFileSync(tmp, segmentHeader(), "segment.create"); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+	crashPoint("segment.rename", func() { _ = os.Rename(path, tmp) })
+	return syncDir(filepath.Dir(path))
+}
+
+// appendRecord дописывает в b запись с событием.
+func appendRecord(b []byte, ev Event) []byte {
+	start := len(b)
+	b = append(b, make([]byte, recHeaderLen)...)
+	b = append(b, recSchemaV1)
+	b = appendEventV1(b, ev)
+
+	body := b[start+recHeaderLen:]
+	binary.LittleEndian.PutUint32(b[start:], uint32(len(body)))
+	binary.LittleEndian.PutUint32(b[start+4:], crc32.Checksum(body, crcTable))
+	return b
+}
+
+func appendEventV1(b []byte, ev Event) []byte {
+	b = binary.AppendVarint(b, ev.TS.UnixNano())
+	b = appendBytes(b, []byte(ev.EventID))
+	b = binary.AppendVarint(b, int64(ev.UserID))
+	b = binary.AppendVarint(b, int64(ev.DomainID))
+	b = binary.AppendVarint(b, int64(ev.GeoID))
+	b = binary.AppendVarint(b, int64(ev.GeoGroupID))
+	b = binary.AppendVarint(b, int64(ev.DomainTypeID))
+	b = binary.AppendVarint(b, int64(ev.FileID))
+	b = appendBytes(b, ev.VisitorIP)
+	b = appendBytes(b, []byte(ev.EventName))
+	return b
+}
+
+func appendBytes(b, v []byte) []byte {
+	b = binary.AppendUvarint(b, uint64(len(v)))
+	return append(b, v...)
+}
+
+// decodeRecord разбирает schema+payload (без проверки crc).
+func decodeRecord(body []byte) (Event, error) {
+	if len(body) == 0 {
+		return Event{}, errors.New("empty record body")
+	}
+	switch body[0] {
+	case recSchemaV1:
+		return decodeEventV1(body[1:])
+	default:
+		return Event{}, fmt.Errorf("unknown record schema %d", body[0])
+	}
+}
+
+func decodeEventV1(p []byte) (Event, error) {
+	d := recDecoder{p: p}
+	var ev Event
+	ev.TS = time.Unix(0, d.varint()).UTC()
+	ev.EventID = string(d.bytes())
+	ev.UserID = int(d.varint())
+	ev.DomainID = int(d.varint())
+	ev.GeoID = int(d.varint())
+	ev.GeoGroupID = int(d.varint())
+	ev.DomainTypeID = int(d.varint())
+	ev.FileID = int(d.varint())
+	if ip := d.bytes(); len(ip) > 0 {
+		ev.VisitorIP = bytes.Clone(ip)
+	}
+	ev.EventName = string(d.bytes())
+	if d.err != nil {
+		return Event{}, d.err
+	}
+	if len(d.p) != 0 {
+		return Event{}, fmt.Errorf("record: %d trailing bytes", len(d.p))
+	}
+	return ev, nil
+}
+
+type recDecoder struct {
+	p   []byte
+	err error
+}
+
+func (d *recDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.p)
+	if n <= 0 {
+		d.err = errors.New("record: bad varint")
+		return 0
+	}
+	d.p = d.p[n:]
+	return v
+}
+
+func (d *recDecoder) bytes() []byte {
+	if d.err != nil {
+		return nil
+	}
+	l, n := binary.Uvarint(d.p)
+	if n <= 0 || l > uint64(len(d.p)-n) {
+		d.err = errors.New("record: bad length")
+		return nil
+	}
+	v := d.p[n : n+int(l)]
+	d.p = d.p[n+int(l):]
+	return v
+}
+
+/* ---------------- WAL: чтение сегмента ---------------- */
+
+// segReader читает записи сегмента любого формата по порядку.
+// Недописанная последняя запись (writer ещё пишет или torn tail после падения) — io.EOF,
+// а чтение откатывается на её начало: следующий Next попробует снова.
+//
+// Сжатый сегмент (000012.log.zst) читается так же: смещения — в несжатом потоке,
+// seek — распаковкой с пропуском. Сжимаются только закрытые сегменты, откатываться в них незачем.
+type segReader struct {
+	f      *os.File
+	dec    *zstd.Decoder // != nil — сегмент сжат
+	rd     *bufio.Reader
+	format int
+	off    int64 // конец последней целиком прочитанной записи
+
+	// зашифрованный сегмент (wal_crypt.go): key id, шифр и заголовок (AAD)
+	keyID uint16
+	aead  cipher.AEAD
+	aad   []byte
+	// сжатый зашифрованный сегмент: записи в потоке уже открыты (packEncryptedFile)
+	opened bool
+}
+
+// openSegReader открывает сегмент; нет path — пробует сжатый path.zst.
+func openSegReader(path string) (*segReader, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		if zf, zerr := os.Open(path + packedExt); zerr == nil {
+			return openPackedSegReader(path, zf)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	r := &segReader{f: f, rd: bufio.NewReaderSize(f, 256*1024), format: segJSON}
+	if err := r.readHeader(path); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func openPackedSegReader(path string, f *os.File) (*segReader, error) {
+	fr := bufio.NewReaderSize(f, 256*1024)
+	if h, _ := fr.Peek(segHeaderLen); len(h) == segHeaderLen && string(h[:len(segMagic)]) == segMagic {
+		return openPackedEncryptedSegReader(path, f, fr)
+	}
+	dec, err := zstd.NewReader(fr, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	r := &segReader{f: f, dec: dec, rd: bufio.NewReaderSize(dec, 256*1024), format: segJSON}
+	if err := r.readHeader(path); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// openPackedEncryptedSegReader — сжатый зашифрованный сегмент (см. packEncryptedFile): заголовок
+// открытый, дальше блоки. Читатель видит поток с теми же смещениями, что у .log, записи в нём открыты.
+func openPackedEncryptedSegReader(path string, f *os.File, fr *bufio.Reader) (*segReader, error) {
+	h, err := fr.Peek(segEncHeaderLen)
+	if err != nil || h[5] != segFlagEncrypted {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: bad packed segment header", path)
+	}
+	header := bytes.Clone(h)
+	_, _ = fr.Discard(len(header))
+	aead, err := walKeys.deriveAEAD(binary.LittleEndian.Uint16(header[6:]), packedKeyLabel, header[segHeaderLen:])
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	dec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	br := &packedBlockReader{rd: fr, dec: dec, aead: aead, aad: header}
+	rd := bufio.NewReaderSize(io.MultiReader(bytes.NewReader(header), br), 256*1024)
+	r := &segReader{f: f, dec: dec, rd: rd, format: segJSON, opened: true}
+	if err := r.readHeader(path); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *segReader) readHeader(path string) error {
+	h, err := r.rd.Peek(segHeaderLen)
+	if len(h) >= len(segMagic) && string(h[:len(segMagic)]) == segMagic {
+		if err != nil {
+			_ = r.Close()
+			return fmt.Errorf("%s: short segment header", path)
+		}
+		if h[4] != segFormatV1 {
+			_ = r.Close()
+			return fmt.Errorf("%s: unsupported segment format %d", path, h[4])
+		}
+		hlen := segHeaderLen
+		switch h[5] {
+		case 0:
+		case segFlagEncrypted:
+			hlen = segEncHeaderLen
+			if h, err = r.rd.Peek(hlen); err != nil {
+				_ = r.Close()
+				return fmt.Errorf("%s: short segment header", path)
+			}
+			r.keyID = binary.LittleEndian.Uint16(h[6:])
+			if r.aead, err = walKeys.segmentAEAD(r.keyID, h[segHeaderLen:]); err != nil {
+				_ = r.Close()
+				return fmt.Errorf("%s: %w", path, err)
+			}
+			r.aad = bytes.Clone(h)
+		default:
+			_ = r.Close()
+			return fmt.Errorf("%s: unsupported segment flags %#x", path, h[5])
+		}
+		_, _ = r.rd.Discard(hlen)
+		r.format = segBinary
+		r.off = int64(hlen)
+	}
+	return nil
+}
+
+func (r *segReader) Close() error {
+	if r.dec != nil {
+		r.dec.Close()
+	}
+	return r.f.Close()
+}
+
+// seek ставит чтение на смещение off (конец ранее прочитанной записи). off=0 — начало сегмента.
+func (r *segReader) seek(off int64) error {
+	if off <= r.off {
+		return nil
+	}
+	if r.dec != nil {
+		if _, err := r.rd.Discard(int(off - r.off)); err != nil {
+			return err
+		}
+		r.off = off
+		return nil
+	}
+	r.off = off
+	return r.rewind()
+}
+
+// rewind возвращает чтение на конец последней целой записи.
+func (r *segReader) rewind() error {
+	if r.dec != nil {
+		return nil // сжатый сегмент закрыт: недописанного хвоста в нём нет
+	}
+	if _, err := r.f.Seek(r.off, io.SeekStart); err != nil {
+		return err
+	}
+	r.rd.Reset(r.f)
+	return nil
+}
+
+// nextRaw — следующая запись без разбора события: строка JSON или schema+payload.
+// Ошибки: io.EOF (записей больше нет), errBadFrame, *corruptRecordError (crc не сошёлся,
+// запись при этом пройдена), прочие — ошибки чтения.
+func (r *segReader) nextRaw() ([]byte, error) {
+	if r.format == segJSON {
+		line, err := r.rd.ReadBytes('\n')
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				if len(line) > 0 {
+					// строка без '\n' — недописана
+					if err := r.rewind(); err != nil {
+						return nil, err
+					}
+				}
+				return nil, io.EOF
+			}
+			return nil, err
+		}
+		r.off += int64(len(line))
+		return line, nil
+	}
+
+	var hdr [recHeaderLen]byte
+	if _, err := io.ReadFull(r.rd, hdr[:]); err != nil {
+		return nil, r.eof(err)
+	}
+	n := binary.LittleEndian.Uint32(hdr[:4])
+	if n == 0 || n > maxRecordLength {
+		if err := r.rewind(); err != nil {
+			return nil, err
+		}
+		return nil, errBadFrame
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r.rd, body); err != nil {
+		return nil, r.eof(err)
+	}
+	r.off += recHeaderLen + int64(n)
+	if crc32.Checksum(body, crcTable) != binary.LittleEndian.Uint32(hdr[4:]) {
+		return body, &corruptRecordError{raw: body, binary: true, err: errors.New("record crc mismatch")}
+	}
+	return body, nil
+}
+
+func (r *segReader) eof(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		if err := r.rewind(); err != nil {
+			return err
+		}
+		return io.EOF
+	}
+	return err
+}
+
+// Next — следующее событие. Кроме ошибок nextRaw: errEmptyRecord и *corruptRecordError,
+// если событие не разбирается (в обоих случаях запись пройдена).
+func (r *segReader) Next() (Event, error) {
+	raw, err := r.nextRaw()
+	if err != nil {
+		return Event{}, err
+	}
+	var ev Event
+	if r.format == segJSON {
+		trim := bytes.TrimSpace(raw)
+		if len(trim) == 0 {
+			return Event{}, errEmptyRecord
+		}
+		if err := json.Unmarshal(trim, &ev); err != nil {
+			return Event{}, &corruptRecordError{raw: trim, err: err}
+		}
+		return ev, nil
+	}
+	body := raw
+	if r.aead != nil {
+		// в dead-letter уходит запись как на диске: расшифрованную (с IP) не выносим
+		if body, err = r.open(raw); err != nil {
+			return Event{}, &corruptRecordError{raw: raw, binary: true, err: err}
+		}
+	}
+	if ev, err = decodeRecord(body); err != nil {
+		return Event{}, &corruptRecordError{raw: raw, binary: true, err: err}
+	}
+	return ev, nil
+}
+
+// skip пропускает n записей. Возвращает, сколько реально пропущено (меньше n — сегмент кончился).
+func (r *segReader) skip(n int) (int, error) {
+	for i := 0; i < n; i++ {
+		_, err := r.nextRaw()
+		var ce *corruptRecordError
+		switch {
+		case err == nil, errors.As(err, &ce):
+		case errors.Is(err, io.EOF), errors.Is(err, errBadFrame):
+			return i, nil
+		default:
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// recoverSegment открывает сегмент при старте: считает записи и обрезает недописанный хвост
+// (запись, оборванную падением процесса/машины), чтобы новые записи не легли после мусора.
+// from — известная целая позиция в сегменте (commit): проверяем только то, что после неё.
+func recoverSegment(path string, from CommitPos) (format int, records int, size int64, err error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if from.Off > st.Size() {
+		log.Printf("WAL: %s is shorter (%d bytes) than position %+v, scanning from start", path, st.Size(), from)
+		from = CommitPos{}
+	}
+
+	r, err := openSegReader(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if err := r.seek(from.Off); err != nil {
+		_ = r.Close()
+		return 0, 0, 0, err
+	}
+	records, err = r.skip(int(^uint(0) >> 1))
+	records += from.Line
+	format, size = r.format, r.off
+	_ = r.Close()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	if st.Size() > size {
+		if format == segBinary {
+			torn, err := tornTail(path, size, st.Size())
+			if err != nil {
+				return 0, 0, 0, err
+			}
+			if !torn {
+				// за битой рамкой могут быть целые записи: обрезать молча нельзя
+				return format, records, size, &corruptTailError{path: path, off: size, size: st.Size()}
+			}
+		}
+		log.Printf("WAL: torn tail in %s: %d records, truncating %d bytes", path, records, st.Size()-size)
+		if err := os.Truncate(path, size); err != nil {
+			return 0, 0, 0, err
+		}
+		mWALTornTail.Inc()
+	}
+	return format, records, size, nil
+}
+
+// corruptTailError — чтение сегмента остановила битая рамка записи, а не оборванная запись:
+// байты [off, size) — не недописанный хвост, в них могут быть подтверждённые записи.
+type corruptTailError struct {
+	path      string
+	off, size int64
+}
+
+func (e *corruptTailError) Error() string {
+	return fmt.Sprintf("%s: bad record frame at offset %d, %d bytes after it are not a torn write", e.path, e.off, e.size-e.off)
+}
+
+// tornTail — байты сегмента [off, end) похожи на недописанную последнюю запись: их меньше,
+// чем заголовок плюс заявленное в нём тело, или там одни нули (файл вырос, а данные не доехали
+// до диска — так бывает после отключения питания).
+func tornTail(path string, off, end int64) (bool, error) {
+	if end-off < recHeaderLen {
+		return true, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	var hdr [recHeaderLen]byte
+	if _, err := f.ReadAt(hdr[:], off); err != nil {
+		return false, err
+	}
+	if n := binary.LittleEndian.Uint32(hdr[:4]); n > 0 && n <= maxRecordLength && off+recHeaderLen+int64(n) > end {
+		return true, nil
+	}
+
+	buf := make([]byte, 64*1024)
+	rd := io.NewSectionReader(f, off, end-off)
+	for {
+		k, err := rd.Read(buf)
+		for _, b := range buf[:k] {
+			if b != 0 {
+				return false, nil
+			}
+		}
+		if errors.Is(err, io.EOF) {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+}
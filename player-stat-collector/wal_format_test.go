@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func openFormatTestWAL(dir, archive string) (*WAL, error) {
+	return NewWAL(WALOptions{
+		Dir:          dir,
+		SegmentMaxMB: 64,
+		FsyncEvery:   time.Second,
+		IndexEvery:   100,
+		Quota:        WALQuota{ArchiveDir: archive},
+		Cursors:      []WALCursor{{Name: "mysql"}},
+	})
+}
+
+// writeFormatTestSegment пишет n событий в сегмент 1 и закрывает WAL; возвращает позиции записей.
+func writeFormatTestSegment(t *testing.T, dir string, n int) []AppendPos {
+	t.Helper()
+	w, err := openFormatTestWAL(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	evs := make([]Event, n)
+	for i := range evs {
+		evs[i] = Event{TS: time.Unix(1700000000, 0).UTC(), EventID: "event-00" + strconv.Itoa(i), DomainID: 1, FileID: i + 1, EventName: "play"}
+	}
+	pos, err := w.AppendBatch(evs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return pos
+}
+
+func readFormatTestWAL(t *testing.T, w *WAL) []Event {
+	t.Helper()
+	r := newCursorReader(w, "mysql", nil)
+	defer r.close()
+	return r.read(nil, 100)
+}
+
+// Недописанная последняя запись (или хвост из нулей) обрезается, записи до неё на месте.
+func TestRecoverSegmentTornTail(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		tail []byte
+	}{
+		{"short header", []byte{10, 0, 0}},
+		{"short body", append(binary.LittleEndian.AppendUint32(nil, 100), make([]byte, 4+20)...)},
+		{"zeros", make([]byte, 4096)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir, archive := t.TempDir(), t.TempDir()
+			pos := writeFormatTestSegment(t, dir, 3)
+			seg := filepath.Join(dir, "000001.log")
+			f, err := os.OpenFile(seg, os.O_WRONLY|os.O_APPEND, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := f.Write(tc.tail); err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+
+			w, err := openFormatTestWAL(dir, archive)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer w.Close()
+			if st, _ := os.Stat(seg); st.Size() != pos[2].Off {
+				t.Errorf("segment is %d bytes, want truncated to %d", st.Size(), pos[2].Off)
+			}
+			if evs := readFormatTestWAL(t, w); len(evs) != 3 {
+				t.Errorf("read %d events, want 3", len(evs))
+			}
+			if ents, _ := os.ReadDir(archive); len(ents) != 0 {
+				t.Errorf("torn tail archived: %v", ents)
+			}
+		})
+	}
+}
+
+// Битая рамка в середине сегмента — не оборванная запись: хвост за ней уходит в архив
+// целиком, без архива WAL не открывается.
+func TestRecoverSegmentCorruptFrame(t *testing.T) {
+	dir, archive := t.TempDir(), t.TempDir()
+	pos := writeFormatTestSegment(t, dir, 5)
+	seg := filepath.Join(dir, "000001.log")
+	data, err := os.ReadFile(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// длина третьей записи — за пределами maxRecordLength
+	bad := pos[1].Off
+	binary.LittleEndian.PutUint32(data[bad:], 0xffffffff)
+	if err := os.WriteFile(seg, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if w, err := openFormatTestWAL(dir, ""); err == nil {
+		_ = w.Close()
+		t.Fatal("wal with a bad frame mid-segment and no archive opened")
+	}
+	if st, _ := os.Stat(seg); st.Size() != int64(len(data)) {
+		t.Fatalf("segment is %d bytes after refused start, want untouched %d", st.Size(), len(data))
+	}
+
+	w, err := openFormatTestWAL(dir, archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if evs := readFormatTestWAL(t, w); len(evs) != 2 {
+		t.Errorf("read %d events, want 2 before the bad frame", len(evs))
+	}
+	if st, _ := os.Stat(seg); st.Size() != bad {
+		t.Errorf("segment is %d bytes, want truncated to %d", st.Size(), bad)
+	}
+	saved, err := os.ReadFile(filepath.Join(archive, "shard-00-000001.log.tail-"+strconv.FormatInt(bad, 10)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saved, data[bad:]) {
+		t.Errorf("archived %d bytes, want the %d bytes after the bad frame", len(saved), len(data)-int(bad))
+	}
+
+	// дальше сегмент дописывается как обычно
+	if _, err := w.AppendBatch([]Event{{TS: time.Unix(1700000001, 0).UTC(), DomainID: 1, FileID: 9, EventName: "play"}}); err != nil {
+		t.Fatal(err)
+	}
+	if evs := readFormatTestWAL(t, w); len(evs) != 1 || evs[0].FileID != 9 {
+		t.Errorf("after append read %+v, want the appended file_id 9", evs)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+/* ---------------- WAL: передача хвоста между инстансами ---------------- */
+
+// Архив передачи (wal export) — tar:
+//
+//	manifest.json — id архива, откуда, по каждому шарду: диапазон from..to, число событий, sha256 файла
+//	shard-00.log  — события шарда в формате сегмента WAL (зашифрован, если у источника есть активный ключ)
+//
+// Импорт (POST /admin/wal/import) проверяет sha256 и число событий, дописывает события в свой WAL
+// (event_id сохраняются), делает fsync и только потом запоминает id в WAL_DIR/imports/<id>.json.
+// Тот же архив второй раз не импортируется; упали между записью и отметкой — повтор даст дубли,
+// их гасит event_id в sink'ах.
+
+const handoffManifestName = "manifest.json"
+
+type handoffManifest struct {
+	ID      string         `json:"id"`
+	Created time.Time      `json:"created"`
+	Host    string         `json:"host"`
+	WALDir  string         `json:"wal_dir"`
+	Cursor  string         `json:"cursor,omitempty"` // пусто — от самого отстающего курсора
+	Events  int            `json:"events"`
+	Shards  []handoffShard `json:"shards"`
+}
+
+type handoffShard struct {
+	Shard   int                  `json:"shard"`
+	File    string               `json:"file"`
+	From    CommitPos            `json:"from"`
+	To      CommitPos            `json:"to"`
+	Events  int                  `json:"events"`
+	Skipped int                  `json:"skipped,omitempty"` // битые записи источника, в архив не попали
+	Size    int64                `json:"size"`
+	SHA256  string               `json:"sha256"`
+	Commits map[string]CommitPos `json:"commits"` // commit'ы курсоров источника на момент выгрузки
+}
+
+func newHandoffID() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// segWriter пишет события в отдельный файл формата сегмента — тем же ключом, что и WAL.
+type segWriter struct {
+	f    *os.File
+	aead cipher.AEAD
+	aad  []byte
+	buf  []byte
+	ends []int64
+}
+
+func createSegWriter(path string) (*segWriter, error) {
+	if err := createSegment(path); err != nil {
+		return nil, err
+	}
+	hr, err := openSegReader(path)
+	if err != nil {
+		return nil, err
+	}
+	sw := &segWriter{aead: hr.aead, aad: hr.aad}
+	_ = hr.Close()
+	if sw.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+		return nil, err
+	}
+	return sw, nil
+}
+
+func (s *segWriter) add(ev Event) error {
+	s.buf = appendRecord(s.buf, ev)
+	s.ends = append(s.ends, int64(len(s.buf)))
+	if len(s.buf) >= 1<<20 {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *segWriter) flush() error {
+	b := s.buf
+	if s.aead != nil && len(b) > 0 {
+		b, _ = sealFrames(s.aead, s.aad, b, s.ends)
+	}
+	_, err := s.f.Write(b)
+	s.buf, s.ends = s.buf[:0], s.ends[:0]
+	return err
+}
+
+func (s *segWriter) close() error {
+	err := s.flush()
+	if err == nil {
+		err = s.f.Sync()
+	}
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func fileSHA256(path string) (string, int64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+// writeHandoffArchive собирает tar: manifest, затем файлы шардов из dir.
+func writeHandoffArchive(out io.Writer, m handoffManifest, dir string) error {
+	tw := tar.NewWriter(out)
+	mb, _ := json.MarshalIndent(m, "", "  ")
+	if err := tw.WriteHeader(&tar.Header{Name: handoffManifestName, Mode: 0o644, Size: int64(len(mb)), ModTime: m.Created}); err != nil {
+		return err
+	}
+	if _, err := tw.Write(mb); err != nil {
+		return err
+	}
+	for _, sh := range m.Shards {
+		f, err := os.Open(filepath.Join(dir, sh.File))
+		if err != nil {
+			return err
+		}
+		err = tw.WriteHeader(&tar.Header{Name: sh.File, Mode: 0o600, Size: sh.Size, ModTime: m.Created})
+		if err == nil {
+			_, err = io.Copy(tw, f)
+		}
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+/* ---------------- import ---------------- */
+
+var (
+	errHandoffImported = errors.New("archive already imported")
+	errHandoffBad      = errors.New("bad handoff archive")
+)
+
+// handoffImporter — импорт архивов в запущенный WAL. Импорты идут по одному.
+type handoffImporter struct {
+	mu  sync.Mutex
+	wal *ShardedWAL
+	dir string // WAL_DIR/imports: отметки импортированных id и распаковка
+}
+
+type handoffResult struct {
+	ID     string `json:"id"`
+	Status string `json:"status"` // imported | already_imported
+	Events int    `json:"events"`
+}
+
+func (hi *handoffImporter) markPath(id string) string {
+	return filepath.Join(hi.dir, id+".json")
+}
+
+// Import читает архив из r: manifest, файлы шардов (sha256), проверочное чтение, запись в WAL, отметка.
+func (hi *handoffImporter) Import(ctx context.Context, r io.Reader) (handoffResult, error) {
+	hi.mu.Lock()
+	defer hi.mu.Unlock()
+
+	tr := tar.NewReader(r)
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != handoffManifestName {
+		return handoffResult{}, fmt.Errorf("%w: %s must come first", errHandoffBad, handoffManifestName)
+	}
+	var m handoffManifest
+	if err := json.NewDecoder(io.LimitReader(tr, 1<<20)).Decode(&m); err != nil {
+		return handoffResult{}, fmt.Errorf("%w: manifest: %v", errHandoffBad, err)
+	}
+	if _, err := hex.DecodeString(m.ID); err != nil || len(m.ID) != 32 {
+		return handoffResult{}, fmt.Errorf("%w: bad archive id %q", errHandoffBad, m.ID)
+	}
+	res := handoffResult{ID: m.ID, Events: m.Events}
+	if _, err := os.Stat(hi.markPath(m.ID)); err == nil {
+		res.Status = "already_imported"
+		return res, errHandoffImported
+	}
+
+	// распаковка с проверкой sha256 и размера каждого файла
+	if err := os.MkdirAll(hi.dir, 0o755); err != nil {
+		return res, err
+	}
+	tmp, err := os.MkdirTemp(hi.dir, "tmp-"+m.ID+"-")
+	if err != nil {
+		return res, err
+	}
+	defer os.RemoveAll(tmp)
+	want := make(map[string]handoffShard, len(m.Shards))
+	for _, sh := range m.Shards {
+		if sh.File != filepath.Base(sh.File) || sh.File == handoffManifestName {
+			return res, fmt.Errorf("%w: bad file name %q", errHandoffBad, sh.File)
+		}
+		want[sh.File] = sh
+	}
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return res, fmt.Errorf("%w: %v", errHandoffBad, err)
+		}
+		sh, ok := want[hdr.Name]
+		if !ok {
+			return res, fmt.Errorf("%w: unexpected file %q", errHandoffBad, hdr.Name)
+		}
+		if err := spoolChecked(filepath.Join(tmp, sh.File), tr, sh); err != nil {
+			return res, err
+		}
+		delete(want, hdr.Name)
+	}
+	for name := range want {
+		return res, fmt.Errorf("%w: %s is missing", errHandoffBad, name)
+	}
+
+	// проверочное чтение: всё расшифровывается и разбирается, событий столько, сколько в manifest.
+	// До первой записи в WAL: битый архив не оставляет в нём половину событий
+	for _, sh := range m.Shards {
+		n := 0
+		if err := readHandoffShard(filepath.Join(tmp, sh.File), func(evs []Event) error { n += len(evs); return nil }, 1000); err != nil {
+			return res, err
+		}
+		if n != sh.Events {
+			return res, fmt.Errorf("%w: %s has %d events, manifest says %d", errHandoffBad, sh.File, n, sh.Events)
+		}
+	}
+
+	for _, sh := range m.Shards {
+		err := readHandoffShard(filepath.Join(tmp, sh.File), func(evs []Event) error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			_, err := hi.wal.AppendBatch(evs)
+			return err
+		}, 1000)
+		if err != nil {
+			return res, fmt.Errorf("append %s: %w", sh.File, err)
+		}
+	}
+	if err := hi.wal.Sync(); err != nil {
+		return res, err
+	}
+	hi.wal.Notify()
+
+	mark, _ := json.MarshalIndent(struct {
+		Imported time.Time `json:"imported"`
+		handoffManifest
+	}{time.Now().UTC(), m}, "", "  ")
+	path := hi.markPath(m.ID)
+	if err := writeFileSync(path+".tmp", mark, ""); err != nil {
+		return res, err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return res, err
+	}
+	if err := syncDir(hi.dir); err != nil {
+		return res, err
+	}
+	log.Printf("WAL: imported handoff archive %s from %s (%s): %d events", m.ID, m.Host, m.WALDir, m.Events)
+	res.Status = "imported"
+	return res, nil
+}
+
+func spoolChecked(path string, r io.Reader, sh handoffShard) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	switch {
+	case err != nil:
+		return fmt.Errorf("%w: %s: %v", errHandoffBad, sh.File, err)
+	case n != sh.Size:
+		return fmt.Errorf("%w: %s: %d bytes, manifest says %d", errHandoffBad, sh.File, n, sh.Size)
+	case hex.EncodeToString(h.Sum(nil)) != sh.SHA256:
+		return fmt.Errorf("%w: %s: sha256 mismatch", errHandoffBad, sh.File)
+	}
+	return nil
+}
+
+// readHandoffShard отдаёт события файла шарда пачками по batch. Битая запись — ошибка:
+// sha256 сошёлся, значит, не тот ключ или архив собран не нами.
+func readHandoffShard(path string, fn func([]Event) error, batch int) error {
+	r, err := openSegReader(path)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errHandoffBad, err)
+	}
+	defer r.Close()
+	evs := make([]Event, 0, batch)
+	for {
+		ev, err := r.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %s record %d: %v", errHandoffBad, filepath.Base(path), r.off, err)
+		}
+		if evs = append(evs, ev); len(evs) == batch {
+			if err := fn(evs); err != nil {
+				return err
+			}
+			evs = evs[:0]
+		}
+	}
+	if len(evs) > 0 {
+		return fn(evs)
+	}
+	return nil
+}
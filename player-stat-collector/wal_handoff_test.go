@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// handoffTestArchive — архив wal export с одним шардом из n событий и его id; fix правит manifest перед упаковкой.
+func handoffTestArchive(t *testing.T, n int, fix func(*handoffManifest)) ([]byte, string) {
+	t.Helper()
+	work := t.TempDir()
+	path := filepath.Join(work, "shard-00.log")
+	sw, err := createSegWriter(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < n; i++ {
+		ev := Event{TS: time.Unix(1700000000, 0).UTC(), EventID: "handoff-" + strconv.Itoa(i), DomainID: 1, FileID: i + 1, EventName: "play"}
+		if err := sw.add(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.close(); err != nil {
+		t.Fatal(err)
+	}
+	sum, size, err := fileSHA256(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := handoffManifest{
+		ID:      newHandoffID(),
+		Created: time.Now().UTC(),
+		Host:    "node-a",
+		Events:  n,
+		Shards:  []handoffShard{{Shard: 0, File: "shard-00.log", Events: n, Size: size, SHA256: sum}},
+	}
+	if fix != nil {
+		fix(&m)
+	}
+	var buf bytes.Buffer
+	if err := writeHandoffArchive(&buf, m, work); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), m.ID
+}
+
+func newTestImporter(t *testing.T) (*handoffImporter, *WAL) {
+	t.Helper()
+	dir := t.TempDir()
+	sw := newShardTestWAL(t, dir, 1)
+	return &handoffImporter{wal: sw, dir: filepath.Join(dir, "imports")}, sw.Shard(0)
+}
+
+// eventIDs — event_id событий WAL, ещё не прочитанных курсором mysql.
+func eventIDs(t *testing.T, w *WAL) []string {
+	t.Helper()
+	var ids []string
+	for _, ev := range readFormatTestWAL(t, w) {
+		ids = append(ids, ev.EventID)
+	}
+	return ids
+}
+
+// Повтор того же архива — already_imported, события в WAL не дублируются.
+func TestHandoffImportIdempotent(t *testing.T) {
+	hi, w := newTestImporter(t)
+	archive, _ := handoffTestArchive(t, 5, nil)
+
+	res, err := hi.Import(context.Background(), bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != "imported" || res.Events != 5 {
+		t.Fatalf("first import %+v", res)
+	}
+	if _, err := os.Stat(hi.markPath(res.ID)); err != nil {
+		t.Fatalf("mark: %v", err)
+	}
+
+	res2, err := hi.Import(context.Background(), bytes.NewReader(archive))
+	if !errors.Is(err, errHandoffImported) || res2.Status != "already_imported" || res2.ID != res.ID {
+		t.Fatalf("second import %+v, %v; want already_imported", res2, err)
+	}
+	if ids := eventIDs(t, w); len(ids) != 5 || ids[0] != "handoff-0" || ids[4] != "handoff-4" {
+		t.Errorf("wal has %v, want handoff-0..4 once", ids)
+	}
+}
+
+// Файл шарда не сошёлся с manifest — архив отвергнут до записи в WAL, отметки нет.
+func TestHandoffImportChecksumMismatch(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		fix  func(*handoffManifest)
+	}{
+		{"sha256", func(m *handoffManifest) { m.Shards[0].SHA256 = "00" + m.Shards[0].SHA256[2:] }},
+		{"events", func(m *handoffManifest) { m.Shards[0].Events++ }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			hi, w := newTestImporter(t)
+			archive, _ := handoffTestArchive(t, 3, tc.fix)
+			res, err := hi.Import(context.Background(), bytes.NewReader(archive))
+			if !errors.Is(err, errHandoffBad) {
+				t.Fatalf("import: %v, want errHandoffBad", err)
+			}
+			if ids := eventIDs(t, w); len(ids) != 0 {
+				t.Errorf("rejected archive wrote %v to the wal", ids)
+			}
+			if _, err := os.Stat(hi.markPath(res.ID)); !os.IsNotExist(err) {
+				t.Errorf("rejected archive marked as imported: %v", err)
+			}
+			if left, _ := filepath.Glob(filepath.Join(hi.dir, "tmp-*")); len(left) != 0 {
+				t.Errorf("spool left behind: %v", left)
+			}
+		})
+	}
+}
+
+// Обрыв до отметки. Архив оборван на распаковке — в WAL ничего, повтор импортирует целиком.
+// События записаны, а отметка нет — повтор импортирует снова: дубли с теми же event_id (их гасят sink'и).
+func TestHandoffImportInterrupted(t *testing.T) {
+	t.Run("during spool", func(t *testing.T) {
+		hi, w := newTestImporter(t)
+		archive, _ := handoffTestArchive(t, 4, nil)
+		// обрыв посреди файла шарда: заголовок tar — 512 байт, дальше данные
+		cut := bytes.Index(archive, []byte("shard-00.log")) + 512 + 10
+		if _, err := hi.Import(context.Background(), bytes.NewReader(archive[:cut])); !errors.Is(err, errHandoffBad) {
+			t.Fatalf("truncated import: %v, want errHandoffBad", err)
+		}
+		if ids := eventIDs(t, w); len(ids) != 0 {
+			t.Fatalf("truncated archive wrote %v to the wal", ids)
+		}
+		res, err := hi.Import(context.Background(), bytes.NewReader(archive))
+		if err != nil || res.Status != "imported" {
+			t.Fatalf("retry: %+v, %v", res, err)
+		}
+		if ids := eventIDs(t, w); len(ids) != 4 {
+			t.Errorf("after retry wal has %v, want 4 events", ids)
+		}
+	})
+
+	t.Run("before mark", func(t *testing.T) {
+		hi, w := newTestImporter(t)
+		archive, id := handoffTestArchive(t, 4, nil)
+		// отметку не записать: на месте её .tmp — непустой каталог
+		if err := os.MkdirAll(filepath.Join(hi.markPath(id)+".tmp", "x"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := hi.Import(context.Background(), bytes.NewReader(archive)); err == nil {
+			t.Fatalf("import with unwritable mark succeeded: %+v", res)
+		}
+		if _, err := os.Stat(hi.markPath(id)); !os.IsNotExist(err) {
+			t.Fatalf("mark written: %v", err)
+		}
+
+		if err := os.RemoveAll(hi.markPath(id) + ".tmp"); err != nil {
+			t.Fatal(err)
+		}
+		if res, err := hi.Import(context.Background(), bytes.NewReader(archive)); err != nil || res.Status != "imported" {
+			t.Fatalf("retry: %+v, %v", res, err)
+		}
+		ids := eventIDs(t, w)
+		if len(ids) != 8 {
+			t.Fatalf("wal has %d events, want 4 from the interrupted import and 4 from the retry", len(ids))
+		}
+		for i := 0; i < 4; i++ {
+			if ids[i] != ids[i+4] {
+				t.Errorf("event %d: %s and %s, want the retry to keep event_id", i, ids[i], ids[i+4])
+			}
+		}
+	})
+}
@@ -0,0 +1,361 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+/* ---------------- WAL: индекс сегмента ---------------- */
+
+// Рядом с закрытым сегментом лежит 000012.idx (JSON): сколько записей, время первого/последнего
+// события, метки (line, off, ts) каждые WAL_INDEX_EVERY записей и crc32c всего сегмента.
+// Пишется при ротации (в фоне: закрытый сегмент больше не меняется), при старте достраивается
+// для сегментов без индекса. Индекс — только ускоритель: нет или не сходится с размером файла —
+// пересобираем из сегмента.
+//
+// По меткам позиция (seg, line) или время находятся Seek'ом до ближайшей метки и коротким
+// чтением вперёд, без чтения всего сегмента.
+
+const segIndexVersion = 1
+
+type SegmentIndex struct {
+	Version int       `json:"version"`
+	Seg     int       `json:"seg"`
+	Format  int       `json:"format"` // segJSON | segBinary
+	Size    int64     `json:"size"`
+	Records int       `json:"records"`
+	FirstTS time.Time `json:"first_ts"`
+	LastTS  time.Time `json:"last_ts"`
+	CRC32C  uint32    `json:"crc32c"`           // весь файл сегмента (несжатый)
+	ZSize   int64     `json:"zsize,omitempty"`  // размер .log.zst, если сегмент сжат
+	KeyID   int       `json:"key_id,omitempty"` // зашифрован этим ключом
+
+	Every int         `json:"every"`
+	Marks []indexMark `json:"marks"` // позиция после каждой Every-й записи
+}
+
+type indexMark struct {
+	Line int       `json:"line"`
+	Off  int64     `json:"off"`
+	TS   time.Time `json:"ts"` // ts последней записи до метки
+}
+
+// indexPath — рядом с сегментом (в т.ч. в spill-каталоге).
+func (w *WAL) indexPath(seg int) string {
+	return strings.TrimSuffix(w.segPath(seg), ".log") + ".idx"
+}
+
+// buildSegmentIndex читает сегмент целиком. Только для закрытых сегментов.
+func buildSegmentIndex(path string, seg, every int) (*SegmentIndex, error) {
+	r, err := openSegReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	idx := &SegmentIndex{Version: segIndexVersion, Seg: seg, Format: r.format, KeyID: int(r.keyID), Every: every}
+	var lastTS time.Time
+	for {
+		ev, err := r.Next()
+		var ce *corruptRecordError
+		switch {
+		case err == nil:
+			if idx.FirstTS.IsZero() {
+				idx.FirstTS = ev.TS
+			}
+			idx.LastTS, lastTS = ev.TS, ev.TS
+		case errors.Is(err, errEmptyRecord), errors.As(err, &ce):
+		case errors.Is(err, io.EOF), errors.Is(err, errBadFrame):
+			idx.Size = r.off
+			// сегмент уже сжат: без ZSize LoadIndex не признает индекс своим
+			if st, real, err := statSeg(path); err == nil && isPacked(real) {
+				idx.ZSize = st.Size()
+			}
+			return idx, fileCRC(path, idx)
+		default:
+			return nil, err
+		}
+		idx.Records++
+		if every > 0 && idx.Records%every == 0 {
+			idx.Marks = append(idx.Marks, indexMark{Line: idx.Records, Off: r.off, TS: lastTS})
+		}
+	}
+}
+
+func fileCRC(path string, idx *SegmentIndex) error {
+	r, err := openSegReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	h := crc32.New(crcTable)
+	var src io.Reader = r.f
+	size := idx.Size
+	switch {
+	case r.opened:
+		// сжатый зашифрованный: блоки не перечитать с начала через dec — берём поток читателя за заголовком
+		h.Write(r.aad)
+		src, size = r.rd, idx.Size-r.off
+	default:
+		// с начала файла, вместе с заголовком
+		if _, err := r.f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if r.dec != nil {
+			if err := r.dec.Reset(r.f); err != nil {
+				return err
+			}
+			src = r.dec
+		}
+	}
+	if _, err := io.CopyN(h, src, size); err != nil {
+		return err
+	}
+	idx.CRC32C = h.Sum32()
+	return nil
+}
+
+func (w *WAL) writeIndex(idx *SegmentIndex) error {
+	b, err := json.Marshal(idx)
+	if err != nil {
+		return err
+	}
+	path := w.indexPath(idx.Seg)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadIndex читает индекс сегмента; ok=false — индекса нет или он не от этого файла.
+func (w *WAL) LoadIndex(seg int) (*SegmentIndex, bool) {
+	b, err := os.ReadFile(w.indexPath(seg))
+	if err != nil {
+		return nil, false
+	}
+	var idx SegmentIndex
+	if err := json.Unmarshal(b, &idx); err != nil || idx.Version != segIndexVersion || idx.Seg != seg {
+		return nil, false
+	}
+	st, path, err := statSeg(w.segPath(seg))
+	if err != nil {
+		return nil, false
+	}
+	if isPacked(path) {
+		if st.Size() != idx.ZSize {
+			return nil, false
+		}
+	} else if st.Size() != idx.Size {
+		return nil, false
+	}
+	return &idx, true
+}
+
+// IndexSegment строит и сохраняет индекс закрытого сегмента.
+func (w *WAL) IndexSegment(seg int) (*SegmentIndex, error) {
+	idx, err := buildSegmentIndex(w.segPath(seg), seg, w.indexEvery)
+	if err != nil {
+		return nil, err
+	}
+	if err := w.writeIndex(idx); err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// IndexSegments достраивает индексы закрытых сегментов, у которых их нет (после обновления,
+// падения между ротацией и записью индекса). Вызывается в фоне при старте.
+func (w *WAL) IndexSegments() error {
+	segs, err := w.listSegs()
+	if err != nil {
+		return err
+	}
+	cur := w.currentSeg()
+	for _, seg := range segs {
+		if seg >= cur {
+			break
+		}
+		if _, ok := w.LoadIndex(seg); !ok {
+			idx, err := w.IndexSegment(seg)
+			if err != nil {
+				if os.IsNotExist(err) {
+					continue // удалён Compact
+				}
+				return fmt.Errorf("index segment %d: %w", seg, err)
+			}
+			log.Printf("WAL: indexed segment %d: %d records", seg, idx.Records)
+		}
+		// закрыт, но не сжат (выключали WAL_COMPRESS или упали до сжатия)
+		w.maybeCompress(seg)
+	}
+	return nil
+}
+
+func (w *WAL) currentSeg() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.curSeg
+}
+
+// sealSegment — сегмент закрыт ротацией: индекс (и сжатие) — в фоне.
+func (w *WAL) sealSegment(seg int) {
+	go func() {
+		crashPoint("seal.index", nil)
+		if _, err := w.IndexSegment(seg); err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("WAL: index segment %d: %v", seg, err)
+			}
+			return
+		}
+		w.maybeCompress(seg)
+	}()
+}
+
+// seekLine — позиция сразу после line-й записи сегмента: от ближайшей метки индекса, без него — с начала.
+func (w *WAL) seekLine(seg, line int) (CommitPos, error) {
+	from := CommitPos{Seg: seg}
+	if idx, ok := w.LoadIndex(seg); ok {
+		i := sort.Search(len(idx.Marks), func(i int) bool { return idx.Marks[i].Line > line })
+		if i > 0 {
+			from.Line, from.Off = idx.Marks[i-1].Line, idx.Marks[i-1].Off
+		}
+	}
+	if from.Line == line {
+		return from, nil
+	}
+
+	r, err := openSegReader(w.segPath(seg))
+	if err != nil {
+		return from, err
+	}
+	defer r.Close()
+	if err := r.seek(from.Off); err != nil {
+		return from, err
+	}
+	n, err := r.skip(line - from.Line)
+	if err != nil {
+		return from, err
+	}
+	return CommitPos{Seg: seg, Line: from.Line + n, Off: r.off}, nil
+}
+
+// SeekTime — позиция перед первым событием с ts >= t (по закрытым сегментам с индексом
+// и текущему). ts в WAL почти монотонны (время приёма), так что это «примерно с момента t».
+func (w *WAL) SeekTime(t time.Time) (CommitPos, error) {
+	segs, err := w.listSegs()
+	if err != nil {
+		return CommitPos{}, err
+	}
+	for _, seg := range segs {
+		from := CommitPos{Seg: seg}
+		if idx, ok := w.LoadIndex(seg); ok {
+			if idx.Records > 0 && idx.LastTS.Before(t) {
+				continue // сегмент целиком раньше t
+			}
+			i := sort.Search(len(idx.Marks), func(i int) bool { return !idx.Marks[i].TS.Before(t) })
+			if i > 0 {
+				from.Line, from.Off = idx.Marks[i-1].Line, idx.Marks[i-1].Off
+			}
+		}
+		cp, found, err := scanToTime(w.segPath(seg), from, t)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return CommitPos{}, err
+		}
+		if found {
+			return cp, nil
+		}
+	}
+	// всё раньше t — конец WAL
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return CommitPos{Seg: w.curSeg, Line: w.curLine, Off: w.curSize}, nil
+}
+
+func scanToTime(path string, from CommitPos, t time.Time) (CommitPos, bool, error) {
+	r, err := openSegReader(path)
+	if err != nil {
+		return from, false, err
+	}
+	defer r.Close()
+	if err := r.seek(from.Off); err != nil {
+		return from, false, err
+	}
+	cp := from
+	for {
+		ev, err := r.Next()
+		var ce *corruptRecordError
+		switch {
+		case err == nil:
+			if !ev.TS.Before(t) {
+				return cp, true, nil
+			}
+		case errors.Is(err, errEmptyRecord), errors.As(err, &ce):
+		case errors.Is(err, io.EOF), errors.Is(err, errBadFrame):
+			return cp, false, nil
+		default:
+			return cp, false, err
+		}
+		cp.Line++
+		cp.Off = r.off
+	}
+}
+
+// SegmentInfo — строка /debug/wal: что лежит в сегменте.
+type SegmentInfo struct {
+	Seg     int       `json:"seg"`
+	Size    int64     `json:"size"`
+	Records int       `json:"records"`
+	FirstTS time.Time `json:"first_ts,omitzero"`
+	LastTS  time.Time `json:"last_ts,omitzero"`
+	Active  bool      `json:"active,omitempty"`
+	Indexed bool      `json:"indexed"`
+	Spilled bool      `json:"spilled,omitempty"` // лежит в WAL_SPILL_DIR
+	ZSize   int64     `json:"zsize,omitempty"`   // сжат: размер на диске
+	KeyID   int       `json:"key_id,omitempty"`  // зашифрован этим ключом (по индексу)
+}
+
+// Segments — сводка по сегментам. Закрытые — из индексов (без индекса — только размер),
+// текущий — из памяти writer'а.
+func (w *WAL) Segments() ([]SegmentInfo, error) {
+	segs, err := w.listSegs()
+	if err != nil {
+		return nil, err
+	}
+	w.mu.Lock()
+	cur := SegmentInfo{Seg: w.curSeg, Size: w.curSize, Records: w.curLine, FirstTS: w.curFirstTS, LastTS: w.curLastTS, Active: true, KeyID: int(w.curKeyID)}
+	w.mu.Unlock()
+
+	cur.Spilled = w.isSpilled(cur.Seg)
+
+	out := make([]SegmentInfo, 0, len(segs))
+	for _, seg := range segs {
+		if seg == cur.Seg {
+			out = append(out, cur)
+			continue
+		}
+		if idx, ok := w.LoadIndex(seg); ok {
+			out = append(out, SegmentInfo{Seg: seg, Size: idx.Size, Records: idx.Records, FirstTS: idx.FirstTS, LastTS: idx.LastTS, Indexed: true, Spilled: w.isSpilled(seg), ZSize: idx.ZSize, KeyID: idx.KeyID})
+			continue
+		}
+		if st, path, err := statSeg(w.segPath(seg)); err == nil {
+			si := SegmentInfo{Seg: seg, Size: st.Size(), Records: -1, Spilled: w.isSpilled(seg)}
+			if isPacked(path) {
+				si.Size, si.ZSize = -1, st.Size()
+			}
+			out = append(out, si)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestWAL(t *testing.T, dir string) *WAL {
+	t.Helper()
+	w, err := NewWAL(WALOptions{
+		Dir:          dir,
+		SegmentMaxMB: 64,
+		FsyncEvery:   time.Second,
+		IndexEvery:   100,
+		Cursors:      []WALCursor{{Name: "mysql"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+// Индекс, построенный по уже сжатому сегменту, должен приниматься LoadIndex (ZSize заполнен),
+// иначе сегмент переиндексируется на каждом старте, а Compact и квота не знают его размер.
+func TestIndexPackedSegment(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys string
+	}{
+		{"plain", ""},
+		{"encrypted", "1:" + testWALKey(1)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			withWALKeys(t, tc.keys)
+			dir := t.TempDir()
+			path := filepath.Join(dir, "000001.log")
+			writeTestSegment(t, path, 500)
+			st, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.keys == "" {
+				_, err = packFile(path, path+packedExt)
+			} else {
+				_, _, err = packEncryptedFile(path, path+packedExt)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Remove(path); err != nil {
+				t.Fatal(err)
+			}
+			zst, err := os.Stat(path + packedExt)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := newTestWAL(t, dir)
+			if w.currentSeg() != 2 {
+				t.Fatalf("writing to segment %d, want 2", w.currentSeg())
+			}
+			idx, err := w.IndexSegment(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if idx.Records != 500 || idx.Size != st.Size() || idx.ZSize != zst.Size() {
+				t.Fatalf("index records=%d size=%d zsize=%d, want 500/%d/%d", idx.Records, idx.Size, idx.ZSize, st.Size(), zst.Size())
+			}
+			if _, ok := w.LoadIndex(1); !ok {
+				t.Fatal("LoadIndex rejects index built from packed segment")
+			}
+			if got := w.sealedSize(1); got != st.Size() {
+				t.Errorf("sealedSize %d, want %d", got, st.Size())
+			}
+
+			chk := &SegmentIndex{Size: idx.Size}
+			if err := fileCRC(w.segPath(1), chk); err != nil || chk.CRC32C != idx.CRC32C {
+				t.Errorf("crc32c %08x (%v), index has %08x", chk.CRC32C, err, idx.CRC32C)
+			}
+		})
+	}
+}
+
+// PendingRecords по индексам и счётчику текущего сегмента сходится с чтением WAL.
+func TestPendingRecords(t *testing.T) {
+	w := newTestWAL(t, t.TempDir())
+	w.mu.Lock()
+	w.segMaxBytes = 512
+	w.mu.Unlock()
+
+	var pos []AppendPos
+	for i := 0; i < 40; i++ {
+		p, err := w.AppendBatch([]Event{{TS: time.Unix(1700000000+int64(i), 0).UTC(), EventName: "play", FileID: i}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos = append(pos, p...)
+	}
+	if err := w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.IndexSegments(); err != nil {
+		t.Fatal(err)
+	}
+	if w.currentSeg() < 3 {
+		t.Fatalf("only %d segments, want rotations", w.currentSeg())
+	}
+
+	for _, at := range []int{-1, 0, 17, 39} {
+		cp := CommitPos{Seg: 1}
+		if at >= 0 {
+			cp = CommitPos(pos[at])
+		}
+		if err := w.SetCommit("mysql", cp); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := w.PendingRecords("mysql"), 40-(at+1); got != want {
+			t.Errorf("commit after event %d: pending %d, want %d", at, got, want)
+		}
+	}
+}
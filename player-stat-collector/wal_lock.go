@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+/* ---------------- WAL: блокировка каталога ---------------- */
+
+// Два процесса на одном WAL_DIR (rolling deploy на общем томе) дописывали бы одни и те же
+// сегменты и перетирали commit-файлы. NewWAL берёт advisory flock на WAL_DIR/LOCK и держит его
+// до Close; занят — сервис не стартует (или ждёт WAL_LOCK_WAIT — для передачи каталога
+// от старого процесса новому). В самом файле — кто держит: pid, host, с какого времени.
+// Файл не удаляется: блокировка снимается вместе с процессом, даже если он упал.
+
+const walLockFile = "LOCK"
+
+var errWALLocked = errors.New("wal dir is locked by another process")
+
+type walLockHolder struct {
+	PID   int       `json:"pid"`
+	Host  string    `json:"host"`
+	Since time.Time `json:"since"`
+}
+
+type walLock struct {
+	f *os.File
+}
+
+// lockWALDir берёт блокировку dir. wait > 0 — ждём освобождения не дольше wait.
+func lockWALDir(dir string, wait time.Duration) (*walLock, error) {
+	path := filepath.Join(dir, walLockFile)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(wait)
+	logged := false
+	for {
+		ok, err := tryLockFile(f)
+		if err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("wal: lock %s: %w", path, err)
+		}
+		if ok {
+			break
+		}
+		holder := readLockHolder(f)
+		if !time.Now().Before(deadline) {
+			_ = f.Close()
+			return nil, fmt.Errorf("%w: %s held by %s", errWALLocked, path, holder)
+		}
+		if !logged {
+			log.Printf("WAL: %s held by %s, waiting up to %s", path, holder, wait)
+			logged = true
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	b, _ := json.Marshal(walLockHolder{PID: os.Getpid(), Host: hostname(), Since: time.Now().UTC()})
+	if err := f.Truncate(0); err == nil {
+		_, err = f.WriteAt(append(b, '\n'), 0)
+	}
+	if err != nil {
+		log.Printf("WAL: write lock holder to %s: %v", path, err)
+	}
+	return &walLock{f: f}, nil
+}
+
+func readLockHolder(f *os.File) string {
+	b, err := io.ReadAll(io.NewSectionReader(f, 0, 4096))
+	if err != nil {
+		return "unknown process"
+	}
+	var h walLockHolder
+	if json.Unmarshal(b, &h) != nil || h.PID == 0 {
+		return "unknown process"
+	}
+	return fmt.Sprintf("pid %d on %s since %s", h.PID, h.Host, h.Since.Format(time.RFC3339))
+}
+
+func (l *walLock) release() {
+	if l == nil || l.f == nil {
+		return
+	}
+	_ = unlockFile(l.f)
+	_ = l.f.Close()
+	l.f = nil
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+)
+
+// flock нет: только предупреждаем, файл LOCK всё равно показывает, кто запущен.
+var lockWarnOnce sync.Once
+
+func tryLockFile(f *os.File) (bool, error) {
+	lockWarnOnce.Do(func() { log.Printf("WAL: no flock on this platform, WAL_DIR is not protected from a second process") })
+	return true, nil
+}
+
+func unlockFile(f *os.File) error { return nil }
@@ -0,0 +1,88 @@
+//go:build unix
+
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func lockTestOpts(dir string, wait time.Duration) WALOptions {
+	opts := shardTestOpts(dir)
+	opts.LockWait = wait
+	return opts
+}
+
+// flock — на открытый файл, а не на процесс: второй NewWAL того же процесса тоже не проходит.
+func TestWALLockSecondOpenFails(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(lockTestOpts(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := os.ReadFile(filepath.Join(dir, walLockFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"pid":`+strconv.Itoa(os.Getpid())) {
+		t.Errorf("LOCK has %q, want holder pid %d", b, os.Getpid())
+	}
+
+	if w2, err := NewWAL(lockTestOpts(dir, 0)); !errors.Is(err, errWALLocked) {
+		if w2 != nil {
+			_ = w2.Close()
+		}
+		t.Fatalf("second NewWAL: %v, want errWALLocked", err)
+	} else if !strings.Contains(err.Error(), "pid "+strconv.Itoa(os.Getpid())) {
+		t.Errorf("error %q does not name the holder", err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	w2, err := NewWAL(lockTestOpts(dir, 0))
+	if err != nil {
+		t.Fatalf("NewWAL after Close: %v", err)
+	}
+	_ = w2.Close()
+}
+
+// WAL_LOCK_WAIT: новый процесс дожидается, пока старый отпустит каталог, но не дольше wait.
+func TestWALLockWait(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(lockTestOpts(dir, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	if w2, err := NewWAL(lockTestOpts(dir, 300*time.Millisecond)); !errors.Is(err, errWALLocked) {
+		if w2 != nil {
+			_ = w2.Close()
+		}
+		t.Fatalf("NewWAL with lock held past wait: %v, want errWALLocked", err)
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("gave up after %s, want at least WAL_LOCK_WAIT", waited)
+	}
+
+	start = time.Now()
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		_ = w.Close()
+	}()
+	w2, err := NewWAL(lockTestOpts(dir, 5*time.Second))
+	if err != nil {
+		t.Fatalf("NewWAL waiting for release: %v", err)
+	}
+	if waited := time.Since(start); waited < 300*time.Millisecond {
+		t.Errorf("lock taken after %s, before the holder closed", waited)
+	}
+	_ = w2.Close()
+}
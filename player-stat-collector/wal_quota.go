@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/* ---------------- WAL: квота ---------------- */
+
+// WAL_QUOTA_MB / WAL_QUOTA_SEGMENTS ограничивают WAL_DIR (делятся поровну между шардами),
+// иначе при долгом отвале MySQL сегменты копятся, пока не кончится том, и тогда 500 на всё.
+// Что делать при превышении — WAL_QUOTA_POLICY:
+//   - reject      — не принимаем события не из WAL_QUOTA_KEEP_EVENTS (503), важные пишем дальше
+//   - drop_oldest — самый старый закрытый сегмент уезжает в архив dead-letter (deadletter/wal-archive),
+//     курсоры перепрыгивают его; в dead-letter запись wal_quota_dropped с путём архива
+//   - spill       — новые сегменты пишутся в WAL_SPILL_DIR (другой том), пока WAL_DIR не освободится
+//
+// При заполнении больше WAL_QUOTA_READY_PCT /readyz отвечает 503 — балансировщик уводит трафик заранее.
+
+const (
+	quotaReject     = "reject"
+	quotaDropOldest = "drop_oldest"
+	quotaSpill      = "spill"
+)
+
+type WALQuota struct {
+	MaxBytes    int64
+	MaxSegments int
+	Policy      string
+	KeepEvents  []string // reject: эти события принимаем и сверх квоты
+
+	SpillDir   string // spill
+	ArchiveDir string // drop_oldest; сюда же при старте уходит хвост сегмента за битой рамкой
+
+	// drop_oldest: сегмент уехал в архив (для записи в dead-letter)
+	OnDrop func(shard, seg int, archive string, records int)
+}
+
+func (q WALQuota) enabled() bool { return q.MaxBytes > 0 || q.MaxSegments > 0 }
+
+// quotaRatio — заполнение WAL_DIR шарда относительно квоты (1 — квота выбрана).
+func (w *WAL) quotaRatio() float64 {
+	var r float64
+	if w.quota.MaxBytes > 0 {
+		r = float64(w.usedBytes.Load()) / float64(w.quota.MaxBytes)
+	}
+	if w.quota.MaxSegments > 0 {
+		r = max(r, float64(w.usedSegs.Load())/float64(w.quota.MaxSegments))
+	}
+	return r
+}
+
+func (w *WAL) overQuota() bool {
+	return w.quota.enabled() && w.quotaRatio() >= 1
+}
+
+// refreshUsage пересчитывает занятое в WAL_DIR (spill-сегменты квоту не занимают).
+func (w *WAL) refreshUsage() {
+	if !w.quota.enabled() {
+		return
+	}
+	segs, err := w.listSegs()
+	if err != nil {
+		return
+	}
+	var total int64
+	var n int
+	for _, seg := range segs {
+		if w.isSpilled(seg) {
+			continue
+		}
+		if st, _, err := statSeg(w.segPath(seg)); err == nil {
+			total += st.Size()
+			n++
+		}
+	}
+	w.usedBytes.Store(total)
+	w.usedSegs.Store(int64(n))
+	mWALQuotaUsed.WithLabelValues(strconv.Itoa(w.shard)).Set(w.quotaRatio())
+}
+
+func (w *WAL) isSpilled(seg int) bool {
+	if w.quota.SpillDir == "" {
+		return false
+	}
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	return w.spilled[seg]
+}
+
+// loadSpilled — какие сегменты лежат в WAL_SPILL_DIR (при старте).
+func (w *WAL) loadSpilled() error {
+	if w.quota.SpillDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(w.quota.SpillDir, 0o755); err != nil {
+		return err
+	}
+	segs, err := listSegFiles(w.quota.SpillDir)
+	if err != nil {
+		return err
+	}
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+	for _, seg := range segs {
+		w.spilled[seg] = true
+	}
+	return nil
+}
+
+func listSegFiles(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var segs []int
+	seen := make(map[int]bool, len(entries))
+	for _, e := range entries {
+		// 000012.log или сжатый 000012.log.zst (пока сжимается — оба)
+		base, ok := strings.CutSuffix(strings.TrimSuffix(e.Name(), packedExt), ".log")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(base); err == nil && !seen[n] {
+			seen[n] = true
+			segs = append(segs, n)
+		}
+	}
+	return segs, nil
+}
+
+// enforceQuotaLocked — перед записью: квота выбрана, применяем политику.
+// reject решается раньше, в хендлере (ShardedWAL.Shed): сюда доходят только важные события.
+func (w *WAL) enforceQuotaLocked() error {
+	if !w.overQuota() {
+		return nil
+	}
+	switch w.quota.Policy {
+	case quotaSpill:
+		// текущий сегмент в WAL_DIR и уже не пустой — дальше пишем в spill
+		if !w.isSpilled(w.curSeg) && w.curLine > 0 {
+			return w.openSeg(w.curSeg + 1)
+		}
+	case quotaDropOldest:
+		for w.overQuota() {
+			dropped, err := w.dropOldestLocked()
+			if err != nil {
+				return err
+			}
+			if !dropped {
+				break // остался только текущий сегмент
+			}
+		}
+	}
+	return nil
+}
+
+// dropOldestLocked уносит самый старый закрытый сегмент в архив и переставляет курсоры за него.
+func (w *WAL) dropOldestLocked() (bool, error) {
+	segs, err := w.listSegs()
+	if err != nil {
+		return false, err
+	}
+	if len(segs) < 2 || segs[0] >= w.curSeg {
+		return false, nil
+	}
+	seg := segs[0]
+
+	records := -1
+	if idx, ok := w.LoadIndex(seg); ok {
+		records = idx.Records
+	}
+	if err := os.MkdirAll(w.quota.ArchiveDir, 0o755); err != nil {
+		return false, err
+	}
+	_, path, err := statSeg(w.segPath(seg))
+	if err != nil {
+		return false, err
+	}
+	archive := filepath.Join(w.quota.ArchiveDir, fmt.Sprintf("shard-%02d-%s", w.shard, filepath.Base(path)))
+	if err := os.Rename(path, archive); err != nil {
+		return false, err
+	}
+	// перенос — на диск до commit'ов: иначе сегмент вернётся после падения уже позади курсоров
+	// и Compact удалит его мимо архива
+	if err := syncDir(w.quota.ArchiveDir); err != nil {
+		return false, err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return false, err
+	}
+	_ = os.Remove(w.indexPath(seg))
+	crashPoint("quota.drop", nil)
+
+	for name, cp := range w.commits {
+		if cp.Seg <= seg {
+			w.commits[name] = CommitPos{Seg: seg + 1}
+			if err := w.saveCommitLocked(name); err != nil {
+				return true, err
+			}
+		}
+	}
+	log.Printf("WAL: quota exceeded, shard %d segment %d (%d records) moved to %s", w.shard, seg, records, archive)
+	mWALQuotaDropped.Inc()
+	if w.quota.OnDrop != nil {
+		w.quota.OnDrop(w.shard, seg, archive, records)
+	}
+	w.refreshUsage()
+	return true, nil
+}
+
+// Shed — событие не принимаем: политика reject, квота выбрана, событие не из WAL_QUOTA_KEEP_EVENTS.
+// Политика и KEEP_EVENTS у всех шардов одни (NewShardedWAL раздаёт им одни opts), поэтому берём их
+// у шарда 0; заполнение — по всем шардам (overQuota): шард для события ещё не выбран.
+func (sw *ShardedWAL) Shed(ev Event) bool {
+	w := sw.shards[0]
+	if w.quota.Policy != quotaReject || w.keepEvents[ev.EventName] || !sw.overQuota() {
+		return false
+	}
+	mWALQuotaRejected.Inc()
+	return true
+}
+
+// overQuota: шарды заполняются поровну (round robin), считаем по самому заполненному.
+func (sw *ShardedWAL) overQuota() bool {
+	return sw.QuotaRatio() >= 1
+}
+
+// QuotaRatio — заполнение квоты самым заполненным шардом (0, если квоты нет).
+func (sw *ShardedWAL) QuotaRatio() float64 {
+	var r float64
+	for _, w := range sw.shards {
+		if w.quota.enabled() {
+			r = max(r, w.quotaRatio())
+		}
+	}
+	return r
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// newQuotaTestWAL — один шард; сегмент закрывается, как только в нём больше segBytes.
+func newQuotaTestWAL(t *testing.T, q WALQuota, segBytes int64) *ShardedWAL {
+	t.Helper()
+	opts := shardTestOpts(t.TempDir())
+	opts.Quota = q
+	sw, err := NewShardedWAL(opts, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sw.Close() })
+	sw.Shard(0).segMaxBytes = segBytes
+	return sw
+}
+
+func quotaTestEvent(name string, fileID int) Event {
+	return Event{TS: time.Unix(1700000000, 0).UTC(), DomainID: 1, FileID: fileID, EventName: name}
+}
+
+// reject: сверх квоты /log и /batch отвечают отказом на всё, кроме WAL_QUOTA_KEEP_EVENTS.
+func TestWALQuotaReject(t *testing.T) {
+	sw := newQuotaTestWAL(t, WALQuota{MaxBytes: 256, Policy: quotaReject, KeepEvents: []string{"pay"}}, 1<<20)
+	for i := 1; sw.QuotaRatio() < 1; i++ {
+		if sw.Shed(quotaTestEvent("play", i)) {
+			t.Fatalf("play shed at quota ratio %.2f", sw.QuotaRatio())
+		}
+		if _, err := sw.AppendBatch([]Event{quotaTestEvent("play", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rejected := testutil.ToFloat64(mWALQuotaRejected)
+	dl, err := NewDeadLetter(t.TempDir(), 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rejects := newRejectQueue(dl, 16, 0)
+	t.Cleanup(rejects.Close)
+	dc := NewDomainCache(nil, time.Minute)
+	dc.m["example.com"] = DomainRow{ID: 1, Domain: "example.com"}
+
+	logH := handleLog(sw, dc, nil, rejects)
+	for _, tc := range []struct {
+		event string
+		code  int
+	}{
+		{"play", http.StatusServiceUnavailable},
+		{"pay", http.StatusAccepted},
+	} {
+		rec := httptest.NewRecorder()
+		logH(rec, httptest.NewRequest(http.MethodGet, "/log?event="+tc.event+"&domain=example.com&file_id=7", nil))
+		if rec.Code != tc.code {
+			t.Errorf("/log %s: %d %q, want %d", tc.event, rec.Code, rec.Body, tc.code)
+		}
+		if tc.code == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("/log %s: 503 without Retry-After", tc.event)
+		}
+	}
+
+	batchH := handleBatch(sw, dc, nil, rejects, 1<<20, 10)
+	rec := httptest.NewRecorder()
+	batchH(rec, httptest.NewRequest(http.MethodPost, "/batch", strings.NewReader(
+		`[{"event":"play","domain":"example.com","file_id":1},{"event":"pay","domain":"example.com","file_id":2}]`)))
+	var resp batchResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("/batch %d %q: %v", rec.Code, rec.Body, err)
+	}
+	if len(resp.Results) != 2 || resp.Results[0].Error != "wal quota exceeded" || !resp.Results[1].OK {
+		t.Errorf("/batch results %+v, want play rejected by quota and pay accepted", resp.Results)
+	}
+
+	if got := testutil.ToFloat64(mWALQuotaRejected) - rejected; got != 2 {
+		t.Errorf("ingest_wal_quota_rejected_total grew by %v, want 2", got)
+	}
+}
+
+type dropRecord struct {
+	seg     int
+	archive string
+}
+
+// drop_oldest: старый сегмент уезжает в архив, commit'ы и читатель перепрыгивают его.
+func TestWALQuotaDropOldest(t *testing.T) {
+	archive := t.TempDir()
+	var mu sync.Mutex
+	var drops []dropRecord
+	sw := newQuotaTestWAL(t, WALQuota{
+		MaxSegments: 3,
+		Policy:      quotaDropOldest,
+		ArchiveDir:  archive,
+		OnDrop: func(shard, seg int, path string, records int) {
+			mu.Lock()
+			defer mu.Unlock()
+			drops = append(drops, dropRecord{seg, path})
+		},
+	}, 1) // каждый append — в новый сегмент
+	w := sw.Shard(0)
+
+	// курсор прочитал и закоммитил первое событие сегмента 2
+	for i := 1; i <= 2; i++ {
+		if _, err := sw.AppendBatch([]Event{quotaTestEvent("play", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := newCursorReader(w, "mysql", nil)
+	defer r.close()
+	first := r.read(nil, 1)
+	if len(first) != 1 {
+		t.Fatalf("read %d events, want 1", len(first))
+	}
+	if err := w.SetCommit("mysql", first[0].next); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 3; i <= 5; i++ {
+		if _, err := sw.AppendBatch([]Event{quotaTestEvent("play", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	mu.Lock()
+	got := append([]dropRecord(nil), drops...)
+	mu.Unlock()
+	if len(got) == 0 {
+		t.Fatal("no segment dropped over quota")
+	}
+	segs, err := w.listSegs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range got {
+		want := filepath.Join(archive, fmt.Sprintf("shard-%02d-%06d.log", w.shard, d.seg))
+		if d.archive != want {
+			t.Errorf("segment %d archived to %s, want %s", d.seg, d.archive, want)
+		}
+		if _, err := os.Stat(d.archive); err != nil {
+			t.Errorf("archive: %v", err)
+		}
+		if len(segs) > 0 && d.seg >= segs[0] {
+			t.Errorf("dropped segment %d still listed in %v", d.seg, segs)
+		}
+	}
+	if len(segs) > 3 {
+		t.Errorf("%d segments left, quota is 3", len(segs))
+	}
+
+	lastDropped := got[len(got)-1].seg
+	if cp := w.Commit("mysql"); cp.Seg <= lastDropped {
+		t.Errorf("commit %v still in dropped segment %d", cp, lastDropped)
+	}
+	// читатель стоял в унесённом сегменте: догоняет commit и дочитывает оставшееся
+	rest := r.read(nil, 10)
+	if len(rest) == 0 || rest[len(rest)-1].FileID != 5 {
+		t.Fatalf("after drop read %+v, want up to file_id 5", rest)
+	}
+	for _, ev := range rest {
+		if ev.next.Seg <= lastDropped {
+			t.Errorf("read event %d from dropped segment %d", ev.FileID, ev.next.Seg)
+		}
+	}
+}
+
+// spill: сверх квоты новые сегменты пишутся в WAL_SPILL_DIR, квоту WAL_DIR они не занимают.
+func TestWALQuotaSpill(t *testing.T) {
+	spill := t.TempDir()
+	sw := newQuotaTestWAL(t, WALQuota{MaxSegments: 2, Policy: quotaSpill, SpillDir: spill}, 1)
+	w := sw.Shard(0)
+	for i := 1; i <= 5; i++ {
+		if _, err := sw.AppendBatch([]Event{quotaTestEvent("play", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	spilled, err := listSegFiles(spill)
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, err := listSegFiles(w.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spilled) == 0 {
+		t.Fatal("nothing spilled over quota")
+	}
+	if len(local) > 2 {
+		t.Errorf("%d segments in WAL_DIR, quota is 2", len(local))
+	}
+	if used := w.usedSegs.Load(); used != int64(len(local)) {
+		t.Errorf("quota counts %d segments, want only the %d in WAL_DIR", used, len(local))
+	}
+
+	evs := readFormatTestWAL(t, w)
+	if len(evs) != 5 {
+		t.Fatalf("read %d events across WAL_DIR and spill, want 5", len(evs))
+	}
+	for i, ev := range evs {
+		if ev.FileID != i+1 {
+			t.Errorf("event %d: file_id %d, want %d", i, ev.FileID, i+1)
+		}
+	}
+}
@@ -1,216 +1,232 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
-	"context"
-	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"os"
-	"time"
 )
 
-type WALTailer struct {
+/* ---------------- WAL: чтение курсора sink'а ---------------- */
+
+// walSource — события для flusher'а sink'а прямо из WAL: по cursorReader на шард, шарды по кругу.
+// В памяти — только батч flusher'а (не больше BATCH_MAX): пока sink не принял батч, дальше не читаем.
+// Позиция чтения (ReadPos) — конец прочитанного в батч, commit — конец записанного sink'ом.
+type walSource struct {
+	readers []*cursorReader
+	wake    chan struct{} // подписан на все шарды: Notify после append
+	next    int
+}
+
+func newWALSource(wal *ShardedWAL, name string, dl *DeadLetter) *walSource {
+	s := &walSource{wake: make(chan struct{}, 1)}
+	for _, w := range wal.Shards() {
+		s.readers = append(s.readers, newCursorReader(w, name, dl))
+		w.Subscribe(s.wake)
+	}
+	return s
+}
+
+// Fill дочитывает в buf до max событий из того, что уже есть в WAL. Источник не кончается: done всегда false.
+func (s *walSource) Fill(buf []Event, max int) ([]Event, bool) {
+	n := len(s.readers)
+	for i := 0; i < n && len(buf) < max; i++ {
+		buf = s.readers[(s.next+i)%n].read(buf, max)
+	}
+	// следующий раз начинаем со следующего шарда: ни один не ждёт, пока другой дочитается
+	s.next = (s.next + 1) % n
+	return buf, false
+}
+
+func (s *walSource) Ready() <-chan struct{} { return s.wake }
+
+func (s *walSource) Close() {
+	for _, r := range s.readers {
+		r.close()
+	}
+}
+
+// cursorReader читает один шард WAL с позиции чтения курсора name.
+type cursorReader struct {
 	wal  *WAL
-	file *os.File
-	rd   *bufio.Reader
+	name string      // курсор (sink), для которого читаем
+	dl   *DeadLetter // != nil только у одного sink'а: битые записи пишем в dead-letter один раз
+	r    *segReader
 
 	seg  int
 	line int
-
-	// pending: событие уже прочитано из WAL, но не получилось отправить в очередь
-	hasPending bool
-	pending    Event
+	off  int64
 }
 
-func NewWALTailer(w *WAL) *WALTailer {
-	w.readMu.Lock()
-	pos := w.readPos
-	w.readMu.Unlock()
+func newCursorReader(w *WAL, name string, dl *DeadLetter) *cursorReader {
+	pos := w.ReadPos(name)
 
-	return &WALTailer{
+	return &cursorReader{
 		wal:  w,
+		name: name,
+		dl:   dl,
 		seg:  pos.Seg,
 		line: pos.Line,
+		off:  pos.Off,
 	}
 }
 
-func (t *WALTailer) close() {
-	if t.file != nil {
-		_ = t.file.Close()
-		t.file = nil
-		t.rd = nil
+func (t *cursorReader) close() {
+	if t.r != nil {
+		_ = t.r.Close()
+		t.r = nil
 	}
 }
 
-func (t *WALTailer) openIfNeeded() error {
-	if t.file != nil {
+func (t *cursorReader) openIfNeeded() error {
+	if t.r != nil {
 		return nil
 	}
-	path := t.wal.segPath(t.seg)
-	f, err := os.Open(path)
+	r, err := openSegReader(t.wal.segPath(t.seg))
 	if err != nil {
 		if os.IsNotExist(err) {
+			if t.skipDropped() {
+				return t.openIfNeeded()
+			}
 			return nil // сегмента ещё нет
 		}
 		return err
 	}
-	t.file = f
-	t.rd = bufio.NewReaderSize(f, 256*1024)
+	t.r = r
 
-	// skip already-read lines
-	for i := 0; i < t.line; i++ {
-		_, err := t.rd.ReadBytes('\n')
-		if err != nil {
-			if errors.Is(err, io.EOF) {
-				return nil
-			}
-			t.close()
-			return err
-		}
+	// встаём сразу за последней прочитанной записью
+	if err := r.seek(t.off); err != nil {
+		t.close()
+		return err
 	}
 	return nil
 }
 
-func (t *WALTailer) tryAdvanceToNextSeg() bool {
-	nextPath := t.wal.segPath(t.seg + 1)
-	if _, err := os.Stat(nextPath); err == nil {
-		t.close()
-		t.seg++
-		t.line = 0
-		t.wal.readMu.Lock()
-		t.wal.readPos = CommitPos{Seg: t.seg, Line: t.line}
-		t.wal.readMu.Unlock()
-		return true
-	}
-	return false
-}
+// errSegmentDone — сегмент дочитан, и уже есть следующий.
+var errSegmentDone = errors.New("segment done")
 
-// pushPending пытается отправить pending в очередь.
-// Возвращает true если pending отправлен (или его не было), false если очередь всё ещё полная.
-func (t *WALTailer) pushPending(out chan<- Event) bool {
-	if !t.hasPending {
-		return true
+// next читает следующее событие текущего сегмента.
+func (t *cursorReader) next() (Event, error) {
+	ev, err := t.r.Next()
+	if !errors.Is(err, io.EOF) {
+		return ev, err
 	}
-	select {
-	case out <- t.pending:
-		t.hasPending = false
-		return true
-	default:
-		return false
+	if _, _, serr := statSeg(t.wal.segPath(t.seg + 1)); serr != nil {
+		return ev, err
 	}
+	// следующий сегмент уже есть, значит в текущий больше не пишут. Но между нашим EOF
+	// и ротацией writer мог успеть дописать — перечитываем ещё раз, прежде чем уйти.
+	ev, err = t.r.Next()
+	if errors.Is(err, io.EOF) {
+		return ev, errSegmentDone
+	}
+	return ev, err
 }
 
-// readNextRawLine читает следующую строку из текущего сегмента.
-// Возвращает (lineBytes, ok, err):
-// - ok=false => сейчас нечего читать (EOF без следующего сегмента / сегмента нет)
-// - err!=nil => ошибка чтения
-func (t *WALTailer) readNextRawLine() ([]byte, bool, error) {
-	if err := t.openIfNeeded(); err != nil {
-		return nil, false, err
-	}
-	if t.file == nil {
-		return nil, false, nil
+// skipDropped — commit курсора ушёл за текущий сегмент (его унесла квота drop_oldest):
+// догоняем commit. Непрочитанное из унесённого сегмента уже в архиве.
+func (t *cursorReader) skipDropped() bool {
+	cp := t.wal.Commit(t.name)
+	if cp.Seg <= t.seg {
+		return false
 	}
+	log.Printf("wal reader %s: segment %d dropped by quota, skipping to %d:%d", t.name, t.seg, cp.Seg, cp.Line)
+	t.close()
+	t.advance(cp)
+	return true
+}
 
-	lineBytes, err := t.rd.ReadBytes('\n')
-	if err != nil {
-		if errors.Is(err, io.EOF) {
-			// Если есть следующий сегмент — переключимся и продолжим
-			if t.tryAdvanceToNextSeg() {
-				return nil, true, nil // ok=true: "продвинулись", можно пробовать читать дальше
-			}
-			return nil, false, nil
-		}
-		t.close()
-		return nil, false, err
-	}
-	return lineBytes, true, nil
+func (t *cursorReader) advanceToNextSeg() {
+	t.close()
+	t.advance(CommitPos{Seg: t.seg + 1})
 }
 
-// readOneAndQueue читает одну строку из WAL и пытается поставить в очередь.
-// Строго без потерь: если очередь полная — кладёт в pending и вернёт false.
-func (t *WALTailer) readOneAndQueue(out chan<- Event) bool {
-	// сначала пробуем отправить pending
-	if !t.pushPending(out) {
-		return false
-	}
+// advance — всё до позиции p прочитано (в батче flusher'а или пропущено).
+func (t *cursorReader) advance(p CommitPos) {
+	t.seg, t.line, t.off = p.Seg, p.Line, p.Off
+	t.wal.setReadPos(t.name, p)
+}
 
-	raw, ok, err := t.readNextRawLine()
-	if err != nil {
-		log.Printf("wal tailer read error: %v", err)
-		return false
+// read дописывает в buf события шарда, пока их не станет max или WAL не кончится.
+func (t *cursorReader) read(buf []Event, max int) []Event {
+	t.skipDropped()
+	for len(buf) < max {
+		ev, has, ok := t.readOne()
+		if !ok {
+			break
+		}
+		if has {
+			buf = append(buf, ev)
+		}
 	}
-	if !ok {
-		return false // нечего читать сейчас
+	return buf
+}
+
+// readOne читает одну запись. ok=false — читать пока нечего (или ошибка чтения: повторим на следующем Fill).
+// has=false — запись пройдена без события (пустая, битая, конец сегмента).
+func (t *cursorReader) readOne() (ev Event, has, ok bool) {
+	if err := t.openIfNeeded(); err != nil {
+		log.Printf("wal reader open error: %v", err)
+		return Event{}, false, false
 	}
-	if raw == nil {
-		// это кейс "перешли на следующий сегмент" — продолжим
-		return true
+	if t.r == nil {
+		return Event{}, false, false // сегмента ещё нет
 	}
 
-	trim := bytes.TrimSpace(raw)
-	if len(trim) == 0 {
-		// пустая строка: считаем как прочитанную
-		t.line++
-		t.wal.readMu.Lock()
-		t.wal.readPos = CommitPos{Seg: t.seg, Line: t.line}
-		t.wal.readMu.Unlock()
-		return true
-	}
-
-	var ev Event
-	if err := json.Unmarshal(trim, &ev); err != nil {
-		// битая строка: пропускаем, но позицию двигаем
-		t.line++
-		t.wal.readMu.Lock()
-		t.wal.readPos = CommitPos{Seg: t.seg, Line: t.line}
-		t.wal.readMu.Unlock()
-		return true
-	}
-
-	// попытка отправки (если не вышло — pending)
-	select {
-	case out <- ev:
-		t.line++
-		t.wal.readMu.Lock()
-		t.wal.readPos = CommitPos{Seg: t.seg, Line: t.line}
-		t.wal.readMu.Unlock()
-		return true
-	default:
-		// очередь полная — не теряем событие
-		t.hasPending = true
-		t.pending = ev
-		return false
+	ev, err := t.next()
+	pos := CommitPos{Seg: t.seg, Line: t.line + 1}
+	if t.r != nil {
+		pos.Off = t.r.off
 	}
-}
+	var ce *corruptRecordError
+	switch {
+	case err == nil:
 
-func (t *WALTailer) drain(out chan<- Event) {
-	for {
-		// если очередь заполнена — даже pending не отправится
-		if len(out) >= cap(out) && !t.hasPending {
-			return
-		}
-		if ok := t.readOneAndQueue(out); !ok {
-			return
+	case errors.Is(err, io.EOF):
+		return Event{}, false, false // нечего читать сейчас
+
+	case errors.Is(err, errSegmentDone), errors.Is(err, errBadFrame):
+		if errors.Is(err, errBadFrame) {
+			log.Printf("wal reader: bad record frame in segment %d after record %d, skipping rest of segment", t.seg, t.line)
 		}
-	}
-}
+		// переходим на следующий сегмент — продолжим
+		t.advanceToNextSeg()
+		return Event{}, false, true
 
-func (t *WALTailer) Run(ctx context.Context, out chan<- Event, notify <-chan struct{}) {
-	defer t.close()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-notify:
-			t.drain(out)
-		case <-time.After(1 * time.Second):
-			// страховка: если notify потерялся
-			t.drain(out)
+	case errors.Is(err, errEmptyRecord):
+		// пустая строка: считаем как прочитанную
+		t.advance(pos)
+		return Event{}, false, true
+
+	case errors.As(err, &ce):
+		// битая запись: в dead-letter и пропускаем, но позицию двигаем
+		if t.dl != nil {
+			dle := DeadLetterEntry{
+				Reason: reasonCorruptWALLine,
+				Error:  ce.Error(),
+				WALPos: fmt.Sprintf("%d:%d", t.seg, t.line+1),
+			}
+			if ce.binary {
+				dle.Reason = reasonCorruptWALRecord
+				dle.RawRecord = ce.raw
+			} else {
+				dle.Raw = string(ce.raw)
+			}
+			if err := t.dl.Write(dle, true); err != nil {
+				log.Printf("deadletter write failed: %v", err)
+			}
 		}
+		t.advance(pos)
+		return Event{}, false, true
+
+	default:
+		log.Printf("wal reader read error: %v", err)
+		t.close()
+		return Event{}, false, false
 	}
+
+	ev.shard, ev.next = t.wal.shard, pos
+	t.advance(pos)
+	return ev, true, true
 }
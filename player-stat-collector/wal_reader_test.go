@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"testing"
+)
+
+// newReaderTestWAL — шарды с курсорами mysql и clickhouse; segBytes=1 — каждый батч в свой сегмент.
+func newReaderTestWAL(t *testing.T, n int, segBytes int64) *ShardedWAL {
+	t.Helper()
+	opts := shardTestOpts(t.TempDir())
+	opts.Cursors = []WALCursor{{Name: "mysql"}, {Name: "clickhouse"}}
+	sw, err := NewShardedWAL(opts, n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sw.Close() })
+	for _, w := range sw.Shards() {
+		w.segMaxBytes = segBytes
+	}
+	return sw
+}
+
+func appendReaderTestEvents(t *testing.T, sw *ShardedWAL, from, to, perBatch int) {
+	t.Helper()
+	for i := from; i <= to; i += perBatch {
+		var batch []Event
+		for j := i; j < i+perBatch && j <= to; j++ {
+			batch = append(batch, shardTestBatch(j)...)
+		}
+		if _, err := sw.AppendBatch(batch); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func fileIDs(evs []Event) []int {
+	ids := make([]int, 0, len(evs))
+	for _, ev := range evs {
+		ids = append(ids, ev.FileID)
+	}
+	return ids
+}
+
+func wantFileIDs(t *testing.T, what string, evs []Event, from, to int) {
+	t.Helper()
+	got := fileIDs(evs)
+	ok := len(got) == to-from+1
+	for i := 0; ok && i < len(got); i++ {
+		ok = got[i] == from+i
+	}
+	if !ok {
+		t.Errorf("%s: file_id %v, want %d..%d in order", what, got, from, to)
+	}
+}
+
+// Читатель переходит через ротацию: и по уже закрытым сегментам, и стоя на EOF текущего,
+// когда writer открыл следующий.
+func TestCursorReaderAcrossRotation(t *testing.T) {
+	sw := newReaderTestWAL(t, 1, 1)
+	w := sw.Shard(0)
+	appendReaderTestEvents(t, sw, 1, 6, 2)
+
+	r := newCursorReader(w, "mysql", nil)
+	defer r.close()
+	evs := r.read(nil, 100)
+	wantFileIDs(t, "closed segments", evs, 1, 6)
+	if len(evs) != 6 {
+		t.Fatalf("read %d events, want 6", len(evs))
+	}
+	last := evs[5].next.Seg
+	if first := evs[0].next.Seg; last != first+2 {
+		t.Fatalf("events in segments %d..%d, want three segments", first, last)
+	}
+	for i := 1; i < len(evs); i++ {
+		if !evs[i-1].next.Less(evs[i].next) {
+			t.Errorf("position %v after %v", evs[i].next, evs[i-1].next)
+		}
+	}
+
+	// читатель на EOF последнего сегмента; следующий append уходит в новый
+	if evs := r.read(nil, 100); len(evs) != 0 {
+		t.Fatalf("read %v past the end of the wal", fileIDs(evs))
+	}
+	appendReaderTestEvents(t, sw, 7, 8, 2)
+	evs = r.read(nil, 100)
+	wantFileIDs(t, "after rotation", evs, 7, 8)
+	if len(evs) > 0 && evs[0].next.Seg != last+1 {
+		t.Errorf("event 7 in segment %d, want %d", evs[0].next.Seg, last+1)
+	}
+	if got := w.ReadPos("mysql"); len(evs) > 0 && got != evs[len(evs)-1].next {
+		t.Errorf("read position %v, want %v", got, evs[len(evs)-1].next)
+	}
+}
+
+// Сжатые .log.zst читаются прозрачно, в том числе с середины: позиция чтения — смещение в открытом потоке.
+func TestCursorReaderCompressedSegments(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys string
+	}{
+		{"plain", ""},
+		{"encrypted", "5:" + testWALKey(5)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.keys != "" {
+				withWALKeys(t, tc.keys)
+			}
+			sw := newReaderTestWAL(t, 1, 1)
+			w := sw.Shard(0)
+			appendReaderTestEvents(t, sw, 1, 9, 3) // три сегмента по 3 события
+
+			r := newCursorReader(w, "mysql", nil)
+			evs := r.read(nil, 4) // стоим посреди второго сегмента
+			r.close()
+			wantFileIDs(t, "before compress", evs, 1, 4)
+			if len(evs) != 4 {
+				t.Fatalf("read %d events, want 4", len(evs))
+			}
+
+			for seg := evs[0].next.Seg; seg <= evs[3].next.Seg; seg++ {
+				if err := w.compressSegment(seg); err != nil {
+					t.Fatalf("compress segment %d: %v", seg, err)
+				}
+				if _, err := os.Stat(w.segPath(seg)); !os.IsNotExist(err) {
+					t.Errorf("segment %d: .log left after compress: %v", seg, err)
+				}
+				if _, err := os.Stat(w.segPath(seg) + packedExt); err != nil {
+					t.Errorf("segment %d: %v", seg, err)
+				}
+			}
+
+			r = newCursorReader(w, "mysql", nil)
+			defer r.close()
+			wantFileIDs(t, "mysql from the middle of a .zst", r.read(nil, 100), 5, 9)
+
+			ch := newCursorReader(w, "clickhouse", nil)
+			defer ch.close()
+			wantFileIDs(t, "clickhouse from the start", ch.read(nil, 100), 1, 9)
+		})
+	}
+}
+
+// У каждого sink'а свой курсор: чтение и commit одного не двигают другой, в том числе после рестарта.
+func TestWALSourceCursorsIndependent(t *testing.T) {
+	sw := newReaderTestWAL(t, 2, 1)
+	appendReaderTestEvents(t, sw, 1, 8, 1) // по кругу: шард 0 — нечётные, шард 1 — чётные
+
+	mysql := newWALSource(sw, "mysql", nil)
+	ch := newWALSource(sw, "clickhouse", nil)
+	mb, _ := mysql.Fill(nil, 6)
+	cb, _ := ch.Fill(nil, 2)
+	if len(mb) != 6 || len(cb) != 2 {
+		t.Fatalf("mysql read %v, clickhouse read %v; want 6 and 2", fileIDs(mb), fileIDs(cb))
+	}
+	if err := sw.SetCommit("mysql", batchCommits(mb)); err != nil {
+		t.Fatal(err)
+	}
+	for _, w := range sw.Shards() {
+		if got := w.Commit("clickhouse"); got.Line != 0 {
+			t.Errorf("shard %d: clickhouse commit %v moved by mysql", w.shard, got)
+		}
+	}
+
+	// каждый дочитывает своё: вместе с первым батчем — все 8 событий ровно по разу
+	mb, _ = mysql.Fill(mb, 100)
+	cb, _ = ch.Fill(cb, 100)
+	mysql.Close()
+	ch.Close()
+	for name, evs := range map[string][]Event{"mysql": mb, "clickhouse": cb} {
+		ids := fileIDs(evs)
+		sort.Ints(ids)
+		ok := len(ids) == 8
+		for i := 0; ok && i < len(ids); i++ {
+			ok = ids[i] == i+1
+		}
+		if !ok {
+			t.Errorf("%s read %v, want 1..8 once", name, ids)
+		}
+	}
+
+	// после рестарта чтение начинается с commit: mysql — после своих 6, clickhouse — с начала
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts := shardTestOpts(sw.Shard(0).dir)
+	opts.Cursors = []WALCursor{{Name: "mysql"}, {Name: "clickhouse"}}
+	sw2, err := NewShardedWAL(opts, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sw2.Close()
+	mysql, ch = newWALSource(sw2, "mysql", nil), newWALSource(sw2, "clickhouse", nil)
+	defer mysql.Close()
+	defer ch.Close()
+	if evs, _ := mysql.Fill(nil, 100); len(evs) != 2 {
+		t.Errorf("mysql after restart read %v, want the 2 uncommitted", fileIDs(evs))
+	}
+	if evs, _ := ch.Fill(nil, 100); len(evs) != 8 {
+		t.Errorf("clickhouse after restart read %v, want all 8", fileIDs(evs))
+	}
+}
@@ -0,0 +1,509 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+/* ---------------- WAL: реплики соседей ---------------- */
+
+// Приём репликации (POST /repl/append, sink_peer.go). Реплика узла X — отдельный WAL на каждый
+// его шард: WAL_DIR/replica/X/wal (шард 0), .../wal/shard-NN, с одним курсором "promote".
+//
+//	replica.json — epoch узла, позиции его WAL, до которых всё принято (повтор батча не дублирует),
+//	               время promote
+//
+// Пока X жив, реплика подрезается по X-Repl-Flushed: в памяти пары "позиция X -> позиция реплики"
+// за каждым принятым батчем, commit "promote" встаёт на последнюю пару, которую X уже разнёс.
+// После рестарта peer'а пары копятся заново, до первого батча реплика не подрезается.
+//
+// Promote (X умер) дописывает непрошедшее в свой WAL (event_id сохраняются) — дальше обычные sink'и.
+// После promote батчи X отвергаются 409, пока реплику не сбросят (POST /admin/repl/reset).
+// Новый epoch (WAL_DIR у X пересоздан) — остаток старой реплики сначала уходит в promote.
+
+const (
+	replicaCursor    = "promote"
+	replicaStateFile = "replica.json"
+	replicaBatch     = 1000
+)
+
+var (
+	errReplPromoted = errors.New("replica is promoted")
+	errReplUnknown  = errors.New("no replica for this source")
+	errReplActive   = errors.New("replica is not promoted: reset would drop its unflushed events (force=1)")
+)
+
+type replicaState struct {
+	Epoch    string            `json:"epoch"`
+	Received map[int]CommitPos `json:"received"` // по шардам X
+	Promoted *time.Time        `json:"promoted,omitempty"`
+}
+
+type replicaMark struct {
+	primary CommitPos
+	replica CommitPos
+}
+
+type replicaSource struct {
+	mu       sync.Mutex
+	name     string
+	dir      string
+	state    replicaState
+	shards   map[int]*WAL
+	marks    map[int][]replicaMark
+	lastSeen time.Time
+}
+
+// replicaSet — реплики всех источников. wal — свой WAL: туда уходит promote.
+type replicaSet struct {
+	mu      sync.Mutex
+	dir     string // WAL_DIR/replica
+	opts    WALOptions
+	wal     *ShardedWAL
+	sources map[string]*replicaSource
+}
+
+func newReplicaSet(walDir string, opts WALOptions, wal *ShardedWAL) *replicaSet {
+	// реплике не нужны ни квота, ни group commit: ack и так после fsync
+	o := WALOptions{
+		SegmentMaxMB: opts.SegmentMaxMB,
+		FsyncEvery:   opts.FsyncEvery,
+		IndexEvery:   opts.IndexEvery,
+		RotateEvery:  opts.RotateEvery,
+		IdleSeal:     opts.IdleSeal,
+		Compress:     opts.Compress,
+		Cursors:      []WALCursor{{Name: replicaCursor}},
+	}
+	return &replicaSet{dir: filepath.Join(walDir, "replica"), opts: o, wal: wal, sources: map[string]*replicaSource{}}
+}
+
+// source открывает реплику name (create — создать, если её нет).
+func (rs *replicaSet) source(name string, create bool) (*replicaSource, error) {
+	if !validReplSource(name) {
+		return nil, fmt.Errorf("bad source name %q", name)
+	}
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	if src, ok := rs.sources[name]; ok {
+		return src, nil
+	}
+	src := &replicaSource{
+		name:   name,
+		dir:    filepath.Join(rs.dir, name),
+		state:  replicaState{Received: map[int]CommitPos{}},
+		shards: map[int]*WAL{},
+		marks:  map[int][]replicaMark{},
+	}
+	b, err := os.ReadFile(filepath.Join(src.dir, replicaStateFile))
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(b, &src.state); err != nil {
+			return nil, fmt.Errorf("%s: %v", replicaStateFile, err)
+		}
+		if src.state.Received == nil {
+			src.state.Received = map[int]CommitPos{}
+		}
+	case !os.IsNotExist(err):
+		return nil, err
+	case !create:
+		if _, err := os.Stat(src.dir); os.IsNotExist(err) {
+			return nil, errReplUnknown
+		}
+	}
+	// шарды, которые уже есть на диске: promote должен увидеть все
+	for shard := 0; ; shard++ {
+		if _, err := os.Stat(shardDir(src.walDir(), shard)); os.IsNotExist(err) {
+			break
+		}
+		if _, err := src.shard(shard, rs.opts); err != nil {
+			src.close()
+			return nil, err
+		}
+	}
+	rs.sources[name] = src
+	return src, nil
+}
+
+func (src *replicaSource) walDir() string { return filepath.Join(src.dir, "wal") }
+
+// shard — WAL реплики шарда X (открывает при первом обращении).
+func (src *replicaSource) shard(shard int, opts WALOptions) (*WAL, error) {
+	if w, ok := src.shards[shard]; ok {
+		return w, nil
+	}
+	opts.Shard = shard
+	opts.Dir = shardDir(src.walDir(), shard)
+	w, err := NewWAL(opts)
+	if err != nil {
+		return nil, fmt.Errorf("replica %s shard %d: %w", src.name, shard, err)
+	}
+	src.shards[shard] = w
+	return w, nil
+}
+
+func (src *replicaSource) saveState() error {
+	b, _ := json.MarshalIndent(src.state, "", "  ")
+	path := filepath.Join(src.dir, replicaStateFile)
+	if err := os.MkdirAll(src.dir, 0o755); err != nil {
+		return err
+	}
+	if err := writeFileSync(path+".tmp", b, ""); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return syncDir(src.dir)
+}
+
+func (src *replicaSource) close() {
+	for shard, w := range src.shards {
+		if err := w.Close(); err != nil {
+			log.Printf("repl: close replica %s shard %d: %v", src.name, shard, err)
+		}
+	}
+}
+
+type replAppendResult struct {
+	Accepted int `json:"accepted"`
+	Skipped  int `json:"skipped"` // уже были в реплике (повтор батча)
+}
+
+// Append пишет кадры источника в реплику: новые — дописывает, fsync, запоминает принятые позиции (по шардам).
+func (rs *replicaSet) Append(ctx context.Context, name, epoch string, flushed []ShardPos, frames []replFrame) (replAppendResult, error) {
+	var res replAppendResult
+	src, err := rs.source(name, true)
+	if err != nil {
+		return res, err
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	src.lastSeen = time.Now()
+	if src.state.Promoted != nil {
+		return res, errReplPromoted
+	}
+
+	dirty := false
+	if epoch != src.state.Epoch {
+		if src.state.Epoch != "" {
+			// WAL_DIR источника новый: старые позиции ничего не значат, остаток реплики — в свой WAL
+			n, err := src.promoteLocked(ctx, rs.wal)
+			if err != nil {
+				return res, fmt.Errorf("promote previous epoch: %w", err)
+			}
+			log.Printf("repl: %s has a new WAL (epoch %s -> %s), %d events of the old one promoted", name, src.state.Epoch, epoch, n)
+		}
+		src.state.Epoch = epoch
+		src.state.Received = map[int]CommitPos{}
+		src.marks = map[int][]replicaMark{}
+		dirty = true
+	}
+
+	byShard := map[int][]Event{}
+	last := map[int]CommitPos{}
+	for _, f := range frames {
+		prev, ok := last[f.shard]
+		if !ok {
+			prev = src.state.Received[f.shard]
+		}
+		if !prev.Less(f.pos) {
+			res.Skipped++
+			continue
+		}
+		byShard[f.shard] = append(byShard[f.shard], f.ev)
+		last[f.shard] = f.pos
+	}
+
+	shards := make([]int, 0, len(byShard))
+	for shard := range byShard {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	// шард за шардом: ack — только когда реплика шарда на диске, принятое сохраняется сразу —
+	// ошибка на следующем шарде не заставит источник повторить уже записанное
+	for _, shard := range shards {
+		w, err := src.shard(shard, rs.opts)
+		if err != nil {
+			return res, err
+		}
+		pos, err := w.AppendBatch(byShard[shard])
+		if err != nil {
+			return res, err
+		}
+		if err := w.Sync(); err != nil {
+			return res, err
+		}
+		src.state.Received[shard] = last[shard]
+		src.marks[shard] = append(src.marks[shard], replicaMark{primary: last[shard], replica: CommitPos(pos[len(pos)-1])})
+		if err := src.saveState(); err != nil {
+			return res, err
+		}
+		res.Accepted += len(pos)
+		mReplReceived.WithLabelValues(name).Add(float64(len(pos)))
+		dirty = false
+	}
+	if dirty {
+		if err := src.saveState(); err != nil {
+			return res, err
+		}
+	}
+	src.trimLocked(flushed)
+	return res, nil
+}
+
+// trimLocked двигает commit "promote" за то, что источник уже разнёс по своим sink'ам.
+func (src *replicaSource) trimLocked(flushed []ShardPos) {
+	for _, sp := range flushed {
+		marks := src.marks[sp.Shard]
+		i := sort.Search(len(marks), func(i int) bool { return sp.Pos.Less(marks[i].primary) })
+		if i == 0 {
+			continue
+		}
+		w := src.shards[sp.Shard]
+		if w == nil {
+			continue
+		}
+		if err := w.SetCommit(replicaCursor, marks[i-1].replica); err != nil {
+			log.Printf("repl: replica %s shard %d: commit: %v", src.name, sp.Shard, err)
+			continue
+		}
+		src.marks[sp.Shard] = marks[i:]
+		_ = w.Compact()
+	}
+}
+
+// promoteLocked дописывает реплику от commit "promote" до конца в свой WAL.
+// Commit двигается после каждой пачки и fsync своего WAL: прерванный promote продолжится с места.
+func (src *replicaSource) promoteLocked(ctx context.Context, to *ShardedWAL) (int, error) {
+	shards := make([]int, 0, len(src.shards))
+	for shard := range src.shards {
+		shards = append(shards, shard)
+	}
+	sort.Ints(shards)
+	total := 0
+	for _, shard := range shards {
+		w := src.shards[shard]
+		batch := make([]Event, 0, replicaBatch)
+		var end CommitPos
+		var werr error
+		flush := func() error {
+			if len(batch) > 0 {
+				if _, err := to.AppendBatch(batch); err != nil {
+					return err
+				}
+				if err := to.Sync(); err != nil {
+					return err
+				}
+				total += len(batch)
+				batch = batch[:0]
+			}
+			return w.SetCommit(replicaCursor, end)
+		}
+		if _, err := w.scanFrom(w.Commit(replicaCursor), func(pos CommitPos, ev Event, rerr error) bool {
+			if werr = ctx.Err(); werr != nil {
+				return false
+			}
+			end = pos
+			if rerr != nil {
+				log.Printf("repl: replica %s shard %d %d:%d: skipping corrupt record: %v", src.name, shard, pos.Seg, pos.Line, rerr)
+				return true
+			}
+			if batch = append(batch, ev); len(batch) == replicaBatch {
+				werr = flush()
+			}
+			return werr == nil
+		}); err != nil {
+			return total, err
+		}
+		if werr != nil {
+			return total, werr
+		}
+		if end != (CommitPos{}) {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+		_ = w.Compact()
+	}
+	to.Notify()
+	return total, nil
+}
+
+type replPromoteResult struct {
+	Source string `json:"source"`
+	Events int    `json:"events"`
+}
+
+// Promote — источник умер: его непрошедшие события становятся своими.
+func (rs *replicaSet) Promote(ctx context.Context, name string) (replPromoteResult, error) {
+	res := replPromoteResult{Source: name}
+	src, err := rs.source(name, false)
+	if err != nil {
+		return res, err
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	// сразу запрещаем приём: источник, вернувшийся посреди promote, не должен дописывать реплику
+	if src.state.Promoted == nil {
+		now := time.Now().UTC()
+		src.state.Promoted = &now
+		if err := src.saveState(); err != nil {
+			return res, err
+		}
+	}
+	res.Events, err = src.promoteLocked(ctx, rs.wal)
+	mReplPromoted.WithLabelValues(name).Add(float64(res.Events))
+	if err != nil {
+		return res, err
+	}
+	log.Printf("repl: replica %s promoted: %d events appended to the WAL", name, res.Events)
+	return res, nil
+}
+
+// Reset удаляет реплику источника: после promote (источник вернулся) или force.
+func (rs *replicaSet) Reset(name string, force bool) error {
+	src, err := rs.source(name, false)
+	if err != nil {
+		return err
+	}
+	src.mu.Lock()
+	defer src.mu.Unlock()
+	if src.state.Promoted == nil && !force {
+		return errReplActive
+	}
+	src.close()
+	rs.mu.Lock()
+	delete(rs.sources, name)
+	rs.mu.Unlock()
+	log.Printf("repl: replica %s reset", name)
+	return os.RemoveAll(src.dir)
+}
+
+type replicaStatus struct {
+	Source   string            `json:"source"`
+	Epoch    string            `json:"epoch"`
+	LastSeen *time.Time        `json:"last_seen,omitempty"` // с рестарта этого инстанса
+	Promoted *time.Time        `json:"promoted,omitempty"`
+	Received map[int]CommitPos `json:"received"`
+	Commit   map[int]CommitPos `json:"commit"` // commit "promote" реплики
+	Pending  map[int]int       `json:"pending_events"`
+}
+
+// Status — реплики на диске. Под src.mu — только снимок состояния: /repl/append не ждёт подсчёта pending.
+func (rs *replicaSet) Status() ([]replicaStatus, error) {
+	entries, err := os.ReadDir(rs.dir)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	out := []replicaStatus{}
+	for _, e := range entries {
+		if !e.IsDir() || !validReplSource(e.Name()) {
+			continue
+		}
+		src, err := rs.source(e.Name(), false)
+		if err != nil {
+			return nil, err
+		}
+		src.mu.Lock()
+		st := replicaStatus{
+			Source:   src.name,
+			Epoch:    src.state.Epoch,
+			Promoted: src.state.Promoted,
+			Received: make(map[int]CommitPos, len(src.state.Received)),
+			Commit:   map[int]CommitPos{},
+			Pending:  map[int]int{},
+		}
+		for shard, cp := range src.state.Received {
+			st.Received[shard] = cp
+		}
+		if !src.lastSeen.IsZero() {
+			t := src.lastSeen.UTC()
+			st.LastSeen = &t
+		}
+		shards := make(map[int]*WAL, len(src.shards))
+		for shard, w := range src.shards {
+			shards[shard] = w
+		}
+		src.mu.Unlock()
+
+		for shard, w := range shards {
+			st.Commit[shard] = w.Commit(replicaCursor)
+			st.Pending[shard] = w.PendingRecords(replicaCursor)
+		}
+		out = append(out, st)
+	}
+	return out, nil
+}
+
+func (rs *replicaSet) Close() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, src := range rs.sources {
+		src.mu.Lock()
+		src.close()
+		src.mu.Unlock()
+	}
+	rs.sources = map[string]*replicaSource{}
+}
+
+// POST /repl/append (Authorization: Bearer $REPL_TOKEN) — см. sink_peer.go.
+func handleReplAppend(rs *replicaSet, maxBody int64) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxBody))
+		if err != nil {
+			var mbe *http.MaxBytesError
+			if errors.As(err, &mbe) {
+				http.Error(w, "body too large", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, "read body failed", http.StatusBadRequest)
+			return
+		}
+		frames, err := parseReplFrames(body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var flushed []ShardPos
+		if v := r.Header.Get(hdrReplFlushed); v != "" {
+			if err := json.Unmarshal([]byte(v), &flushed); err != nil {
+				http.Error(w, "bad "+hdrReplFlushed, http.StatusBadRequest)
+				return
+			}
+		}
+		source, epoch := r.Header.Get(hdrReplSource), r.Header.Get(hdrReplEpoch)
+		if !validReplSource(source) || epoch == "" {
+			http.Error(w, "bad "+hdrReplSource+" or "+hdrReplEpoch, http.StatusBadRequest)
+			return
+		}
+
+		res, err := rs.Append(r.Context(), source, epoch, flushed, frames)
+		switch {
+		case err == nil:
+		case errors.Is(err, errReplPromoted):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		default:
+			mWALAppendErr.Inc()
+			http.Error(w, "replica write failed: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Ошибка на одном шарде не откатывает принятое на предыдущих: повтор батча их не дублирует.
+func TestReplicaAppendPartialFailure(t *testing.T) {
+	walDir := t.TempDir()
+	opts := WALOptions{SegmentMaxMB: 64, FsyncEvery: time.Second, IndexEvery: 100}
+	rs := newReplicaSet(walDir, opts, nil)
+	t.Cleanup(rs.Close)
+
+	src, err := rs.source("node-b", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// шард 1 не открыть: на месте каталога файл
+	blocker := shardDir(src.walDir(), 1)
+	if err := os.MkdirAll(filepath.Dir(blocker), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(blocker, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts := time.Unix(1700000000, 0).UTC()
+	var frames []replFrame
+	for i := 1; i <= 3; i++ {
+		frames = append(frames, replFrame{shard: 0, pos: CommitPos{Seg: 1, Line: i, Off: int64(i * 100)}, ev: Event{TS: ts, EventName: "play", FileID: i}})
+	}
+	frames = append(frames, replFrame{shard: 1, pos: CommitPos{Seg: 1, Line: 1, Off: 100}, ev: Event{TS: ts, EventName: "play", FileID: 4}})
+
+	if _, err := rs.Append(context.Background(), "node-b", "epoch-1", nil, frames); err == nil {
+		t.Fatal("append with unwritable shard 1 succeeded")
+	}
+	if err := os.Remove(blocker); err != nil {
+		t.Fatal(err)
+	}
+
+	// принятое шардом 0 уже в replica.json: переживает и рестарт
+	rs2 := newReplicaSet(walDir, opts, nil)
+	t.Cleanup(rs2.Close)
+	rs.Close()
+	res, err := rs2.Append(context.Background(), "node-b", "epoch-1", nil, frames)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Skipped != 3 || res.Accepted != 1 {
+		t.Fatalf("retry: accepted %d, skipped %d; want 1/3", res.Accepted, res.Skipped)
+	}
+
+	st, err := rs2.Status()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(st) != 1 || st[0].Pending[0] != 3 || st[0].Pending[1] != 1 {
+		t.Fatalf("status %+v, want pending 3 on shard 0 and 1 on shard 1", st)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+/* ---------------- WAL: ротация по времени ---------------- */
+
+// По размеру сегмент на тихом инстансе может не закрыться неделями, и Compact его не удалит,
+// хотя всё в нём давно закоммичено. Поэтому ещё два правила (по умолчанию выключены, 0):
+//   - WAL_ROTATE_EVERY (например 1h) — сегмент с записями живёт не дольше этого, дальше пишем в новый
+//   - WAL_IDLE_SEAL_AFTER (например 5m) — записей нет столько — сегмент закрываем (fsync, индекс), следующий пустой
+//
+// Закрытый сегмент больше не меняется: индексируется, удаляется Compact'ом, как только его прошли все курсоры.
+
+// rotateDueLocked — текущий сегмент пора закрыть по времени (пустой не закрываем никогда).
+// Возвращает причину для метрики, "" — не пора.
+func (w *WAL) rotateDueLocked(now time.Time) string {
+	if w.curFile == nil || w.curLine == 0 {
+		return ""
+	}
+	if w.rotateEvery > 0 && now.Sub(w.curOpened) >= w.rotateEvery {
+		return "age"
+	}
+	if w.idleSeal > 0 && now.Sub(w.lastAppend) >= w.idleSeal {
+		return "idle"
+	}
+	return ""
+}
+
+// rotateLocked закрывает текущий сегмент и открывает следующий.
+func (w *WAL) rotateLocked(reason string) error {
+	seg := w.curSeg
+	if err := w.openSeg(seg + 1); err != nil {
+		return err
+	}
+	mWALRotations.WithLabelValues(reason).Inc()
+	if reason != "size" {
+		log.Printf("WAL: shard %d segment %d sealed (%s)", w.shard, seg, reason)
+	}
+	return nil
+}
+
+// sealDue — проверка таймером: к тихому сегменту Append может не прийти вовсе.
+func (w *WAL) sealDue() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if reason := w.rotateDueLocked(time.Now()); reason != "" {
+		if err := w.rotateLocked(reason); err != nil {
+			log.Printf("WAL: seal segment %d: %v", w.curSeg, err)
+		}
+	}
+}
+
+func (w *WAL) runSealer() {
+	every := w.rotateEvery
+	if every == 0 || (w.idleSeal > 0 && w.idleSeal < every) {
+		every = w.idleSeal
+	}
+	// проверяем в несколько раз чаще порога, но не чаще раза в секунду
+	t := time.NewTicker(min(max(every/4, time.Second), time.Minute))
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-t.C:
+			w.sealDue()
+		}
+	}
+}
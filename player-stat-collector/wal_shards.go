@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+/* ---------------- WAL: шарды ---------------- */
+
+// ShardedWAL — WAL_SHARDS независимых WAL: у каждого свой mu, свои сегменты, fsync и commit-курсоры.
+// Запросы раскладываются по шардам round robin (батч /batch целиком в один шард), flusher sink'а
+// читает свой курсор во всех шардах по очереди и коммитит позицию каждого шарда отдельно.
+//
+// Шард 0 — сам WAL_DIR (WAL_SHARDS=1 — ровно как раньше), шард i — WAL_DIR/shard-NN.
+// Уменьшать WAL_SHARDS, пока в лишних шардах есть данные, нельзя: сервис не стартует.
+
+type ShardedWAL struct {
+	shards []*WAL
+	rr     atomic.Uint64
+
+	// replWait != nil (REPL_MODE=sync): AppendDurable ждёт ack peer'а за записанным (sink_peer.go)
+	replWait func(ctx context.Context, w *WAL, pos CommitPos)
+}
+
+// ShardPos — позиция WAL в конкретном шарде.
+type ShardPos struct {
+	Shard int
+	Pos   CommitPos
+}
+
+// ShardCommitStore — внешний store позиций (MySQLCommitStore): по CommitStore на шард.
+type ShardCommitStore interface {
+	ShardStore(shard int) CommitStore
+}
+
+func shardDir(dir string, shard int) string {
+	if shard == 0 {
+		return dir
+	}
+	return filepath.Join(dir, fmt.Sprintf("shard-%02d", shard))
+}
+
+func NewShardedWAL(opts WALOptions, n int) (*ShardedWAL, error) {
+	if n < 1 {
+		return nil, fmt.Errorf("wal: bad shard count %d", n)
+	}
+	// шард за пределами n с данными — их никто не дочитает
+	for i := n; ; i++ {
+		dir := shardDir(opts.Dir, i)
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			break
+		}
+		segs, err := (&WAL{dir: dir}).listSegs()
+		if err != nil {
+			return nil, err
+		}
+		if len(segs) > 0 {
+			return nil, fmt.Errorf("wal: %s has %d segments but WAL_SHARDS=%d; drain it with more shards first", dir, len(segs), n)
+		}
+	}
+
+	sw := &ShardedWAL{shards: make([]*WAL, n)}
+	for i := range sw.shards {
+		o := opts
+		o.Shard = i
+		o.Dir = shardDir(opts.Dir, i)
+		// квота WAL_DIR — на все шарды, делим поровну
+		o.Quota.MaxBytes = opts.Quota.MaxBytes / int64(n)
+		if opts.Quota.MaxSegments > 0 {
+			o.Quota.MaxSegments = max(1, opts.Quota.MaxSegments/n)
+		}
+		if opts.Quota.SpillDir != "" {
+			o.Quota.SpillDir = shardDir(opts.Quota.SpillDir, i)
+		}
+		w, err := NewWAL(o)
+		if err != nil {
+			sw.Close()
+			return nil, fmt.Errorf("shard %d: %w", i, err)
+		}
+		sw.shards[i] = w
+	}
+	return sw, nil
+}
+
+func (sw *ShardedWAL) Shards() []*WAL { return sw.shards }
+
+func (sw *ShardedWAL) Shard(i int) *WAL { return sw.shards[i] }
+
+// pick — следующий шард по кругу.
+func (sw *ShardedWAL) pick() *WAL {
+	if len(sw.shards) == 1 {
+		return sw.shards[0]
+	}
+	return sw.shards[(sw.rr.Add(1)-1)%uint64(len(sw.shards))]
+}
+
+func (sw *ShardedWAL) AppendBatch(evs []Event) ([]AppendPos, error) {
+	return sw.pick().AppendBatch(evs)
+}
+
+func (sw *ShardedWAL) AppendDurable(ctx context.Context, evs []Event) ([]AppendPos, error) {
+	w := sw.pick()
+	pos, err := w.AppendDurable(ctx, evs)
+	if err == nil && sw.replWait != nil && len(pos) > 0 {
+		sw.replWait(ctx, w, CommitPos(pos[len(pos)-1]))
+	}
+	return pos, err
+}
+
+// Notify будит читателей всех шардов: какой шард получил запись, не важно — лишнее чтение дёшево.
+func (sw *ShardedWAL) Notify() {
+	for _, w := range sw.shards {
+		w.Notify()
+	}
+}
+
+func (sw *ShardedWAL) Compact() error {
+	for i, w := range sw.shards {
+		if err := w.Compact(); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (sw *ShardedWAL) IndexSegments() error {
+	for i, w := range sw.shards {
+		if err := w.IndexSegments(); err != nil {
+			return fmt.Errorf("shard %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func (sw *ShardedWAL) Sync() error {
+	for _, w := range sw.shards {
+		if err := w.Sync(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SetCommit двигает commit курсора name в каждом шарде из next.
+func (sw *ShardedWAL) SetCommit(name string, next []ShardPos) error {
+	for _, sp := range next {
+		if err := sw.shards[sp.Shard].SetCommit(name, sp.Pos); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// LagBytes — сколько байт WAL по всем шардам ещё не закоммичено курсором name.
+func (sw *ShardedWAL) LagBytes(name string) int64 {
+	var total int64
+	for _, w := range sw.shards {
+		total += w.LagBytes(name)
+	}
+	return total
+}
+
+// Stats: сегментов и байт по всем шардам.
+func (sw *ShardedWAL) Stats() (int, int64, error) {
+	var segs int
+	var total int64
+	for _, w := range sw.shards {
+		_, n, b, err := w.Stats()
+		if err != nil {
+			return 0, 0, err
+		}
+		segs += n
+		total += b
+	}
+	return segs, total, nil
+}
+
+func (sw *ShardedWAL) Close() error {
+	var firstErr error
+	for _, w := range sw.shards {
+		if w == nil {
+			continue
+		}
+		if err := w.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// batchCommits — позиции, до которых батч подтверждает каждый шард (последнее событие шарда в батче).
+func batchCommits(batch []Event) []ShardPos {
+	var out []ShardPos
+	for i := len(batch) - 1; i >= 0; i-- {
+		seen := false
+		for _, sp := range out {
+			if sp.Shard == batch[i].shard {
+				seen = true
+				break
+			}
+		}
+		if !seen {
+			out = append(out, ShardPos{Shard: batch[i].shard, Pos: batch[i].next})
+		}
+	}
+	return out
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func shardTestOpts(dir string) WALOptions {
+	return WALOptions{
+		Dir:          dir,
+		SegmentMaxMB: 64,
+		FsyncEvery:   time.Second,
+		IndexEvery:   100,
+		Cursors:      []WALCursor{{Name: "mysql"}},
+	}
+}
+
+func newShardTestWAL(t *testing.T, dir string, n int) *ShardedWAL {
+	t.Helper()
+	sw, err := NewShardedWAL(shardTestOpts(dir), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = sw.Close() })
+	return sw
+}
+
+func shardTestBatch(fileID int) []Event {
+	return []Event{{TS: time.Unix(1700000000, 0).UTC(), DomainID: 1, FileID: fileID, EventName: "play"}}
+}
+
+// Append'ы ложатся в шарды по кругу, батч — целиком в один шард.
+func TestShardedWALRoundRobin(t *testing.T) {
+	dir := t.TempDir()
+	sw := newShardTestWAL(t, dir, 3)
+	if _, err := os.Stat(shardDir(dir, 2)); err != nil {
+		t.Fatalf("shard 2 dir: %v", err)
+	}
+
+	for i := 1; i <= 6; i++ {
+		if _, err := sw.AppendBatch(shardTestBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	two := append(shardTestBatch(7), shardTestBatch(8)...)
+	if _, err := sw.AppendBatch(two); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]int{{1, 4, 7, 8}, {2, 5}, {3, 6}}
+	for i, w := range sw.Shards() {
+		evs := readFormatTestWAL(t, w)
+		if len(evs) != len(want[i]) {
+			t.Fatalf("shard %d has %d events, want %v", i, len(evs), want[i])
+		}
+		for j, ev := range evs {
+			if ev.FileID != want[i][j] || ev.shard != i {
+				t.Errorf("shard %d event %d: file_id %d shard %d, want file_id %d", i, j, ev.FileID, ev.shard, want[i][j])
+			}
+		}
+	}
+}
+
+// Commit у каждого шарда свой: batchCommits даёт позицию последнего события шарда в батче,
+// SetCommit двигает только названные шарды, и позиции переживают рестарт.
+func TestShardedWALCommitPerShard(t *testing.T) {
+	dir := t.TempDir()
+	sw := newShardTestWAL(t, dir, 2)
+	for i := 1; i <= 5; i++ {
+		if _, err := sw.AppendBatch(shardTestBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	src := newWALSource(sw, "mysql", nil)
+	batch, _ := src.Fill(nil, 3)
+	src.Close()
+	if len(batch) != 3 {
+		t.Fatalf("read %d events, want 3", len(batch))
+	}
+	next := batchCommits(batch)
+	last := map[int]CommitPos{}
+	for _, ev := range batch {
+		last[ev.shard] = ev.next
+	}
+	if len(next) != len(last) {
+		t.Fatalf("batchCommits %v, want one position per shard %v", next, last)
+	}
+	for _, sp := range next {
+		if sp.Pos != last[sp.Shard] {
+			t.Errorf("shard %d commit %v, want its last event %v", sp.Shard, sp.Pos, last[sp.Shard])
+		}
+	}
+
+	if err := sw.SetCommit("mysql", next[:1]); err != nil {
+		t.Fatal(err)
+	}
+	moved, other := next[0].Shard, 1-next[0].Shard
+	if got := sw.Shard(moved).Commit("mysql"); got != next[0].Pos {
+		t.Errorf("shard %d commit %v, want %v", moved, got, next[0].Pos)
+	}
+	if got := sw.Shard(other).Commit("mysql"); got.Line != 0 {
+		t.Errorf("shard %d commit moved to %v by another shard's position", other, got)
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sw2 := newShardTestWAL(t, dir, 2)
+	if got := sw2.Shard(moved).Commit("mysql"); got != next[0].Pos {
+		t.Errorf("after restart shard %d commit %v, want %v", moved, got, next[0].Pos)
+	}
+	if got := sw2.Shard(other).Commit("mysql"); got.Line != 0 {
+		t.Errorf("after restart shard %d commit %v, want start", other, got)
+	}
+}
+
+// WAL_DIR от одиночного WAL открывается шардом 0: данные и commit на месте, новые шарды — рядом.
+func TestShardedWALReopensSingleDirAsShard0(t *testing.T) {
+	dir := t.TempDir()
+	w, err := NewWAL(shardTestOpts(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := w.AppendBatch(append(shardTestBatch(1), shardTestBatch(2)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.SetCommit("mysql", CommitPos(pos[0])); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	sw := newShardTestWAL(t, dir, 2)
+	if sw.Shard(0).dir != dir {
+		t.Fatalf("shard 0 dir %s, want WAL_DIR %s", sw.Shard(0).dir, dir)
+	}
+	if got := sw.Shard(0).Commit("mysql"); got != CommitPos(pos[0]) {
+		t.Errorf("shard 0 commit %v, want %v", got, pos[0])
+	}
+	evs := readFormatTestWAL(t, sw.Shard(0))
+	if len(evs) != 1 || evs[0].FileID != 2 {
+		t.Errorf("shard 0 unread %+v, want file_id 2", evs)
+	}
+	if evs := readFormatTestWAL(t, sw.Shard(1)); len(evs) != 0 {
+		t.Errorf("new shard 1 has %d events", len(evs))
+	}
+}
+
+// Шард с данными за пределами WAL_SHARDS — никто его не дочитает: не стартуем.
+func TestShardedWALRefusesFewerShardsWithData(t *testing.T) {
+	dir := t.TempDir()
+	sw, err := NewShardedWAL(shardTestOpts(dir), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if _, err := sw.AppendBatch(shardTestBatch(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if sw, err := NewShardedWAL(shardTestOpts(dir), 1); err == nil {
+		_ = sw.Close()
+		t.Fatal("WAL_SHARDS=1 opened with data in shard-01")
+	}
+}
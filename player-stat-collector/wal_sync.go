@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+/* ---------------- WAL: group commit ---------------- */
+
+// Для событий из WAL_SYNC_EVENTS (например pay) ответ уходит только после fsync сегмента.
+// Конкурентные Append'ы объединяются: syncer ждёт WAL_SYNC_GROUP_WAIT, пока подтянутся
+// соседние запросы, и делает один fsync на всех, кто успел дописать. Остальные события
+// по-прежнему синкаются по таймеру WAL_FSYNC_EVERY.
+//
+// fsync идёт без w.mu (Append'ы не стоят), файл от закрытия при ротации защищает syncMu.
+// Порядок блокировок: mu -> syncMu, mu -> durMu.
+
+var errWALSyncTimeout = errors.New("wal sync timeout")
+
+type syncWaiter struct {
+	seg  int
+	off  int64
+	done chan error
+}
+
+// markDurable: всё до (seg, off) на диске (err == nil) — отпускаем дождавшихся.
+// err != nil — fsync не удался, все ждущие получают ошибку.
+func (w *WAL) markDurable(seg int, off int64, err error) {
+	w.durMu.Lock()
+	defer w.durMu.Unlock()
+
+	if err == nil && (seg > w.durSeg || (seg == w.durSeg && off > w.durOff)) {
+		w.durSeg, w.durOff = seg, off
+	}
+	rest := w.waiters[:0]
+	for _, wt := range w.waiters {
+		switch {
+		case err != nil:
+			wt.done <- err
+		case w.durableLocked(wt.seg, wt.off):
+			wt.done <- nil
+		default:
+			rest = append(rest, wt)
+		}
+	}
+	w.waiters = rest
+}
+
+func (w *WAL) durableLocked(seg int, off int64) bool {
+	return seg < w.durSeg || (seg == w.durSeg && off <= w.durOff)
+}
+
+// WaitDurable ждёт, пока запись pos окажется на диске (или отменят ctx).
+func (w *WAL) WaitDurable(ctx context.Context, pos AppendPos) error {
+	w.durMu.Lock()
+	if w.durableLocked(pos.Seg, pos.Off) {
+		w.durMu.Unlock()
+		return nil
+	}
+	done := make(chan error, 1)
+	w.waiters = append(w.waiters, syncWaiter{seg: pos.Seg, off: pos.Off, done: done})
+	w.durMu.Unlock()
+
+	select {
+	case w.syncKick <- struct{}{}:
+	default: // syncer уже разбужен, попадём в его группу
+	}
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		// waiter останется в списке до следующего fsync: done буферизован, никто не зависнет
+		return errWALSyncTimeout
+	}
+}
+
+func (w *WAL) needsSync(evs []Event) bool {
+	if w.syncEvents["*"] {
+		return len(evs) > 0
+	}
+	for _, ev := range evs {
+		if w.syncEvents[ev.EventName] {
+			return true
+		}
+	}
+	return false
+}
+
+// AppendDurable — AppendBatch, а если среди событий есть события из WAL_SYNC_EVENTS —
+// ещё и ожидание fsync не дольше WAL_SYNC_TIMEOUT. errWALSyncTimeout: события в WAL,
+// но на диск пока не гарантированно — клиенту 503, повтор с тем же event_id дублей не даст.
+func (w *WAL) AppendDurable(ctx context.Context, evs []Event) ([]AppendPos, error) {
+	pos, err := w.AppendBatch(evs)
+	if err != nil || !w.needsSync(evs) {
+		return pos, err
+	}
+
+	ctxTO, cancel := context.WithTimeout(ctx, w.syncTimeout)
+	defer cancel()
+	start := time.Now()
+	err = w.WaitDurable(ctxTO, pos[len(pos)-1])
+	mWALSyncWait.Observe(time.Since(start).Seconds())
+	if errors.Is(err, errWALSyncTimeout) {
+		mWALSyncTimeouts.Inc()
+	}
+	return pos, err
+}
+
+func (w *WAL) runSyncer() {
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-w.syncKick:
+		}
+		if w.syncGroupWait > 0 {
+			// собираем группу: за это время допишут и встанут в очередь соседние запросы
+			time.Sleep(w.syncGroupWait)
+		}
+		w.syncOnce()
+	}
+}
+
+func (w *WAL) syncOnce() {
+	w.mu.Lock()
+	f, seg, off := w.curFile, w.curSeg, w.curSize
+	if f == nil {
+		w.mu.Unlock()
+		w.markDurable(seg, off, errWALClosed)
+		return
+	}
+	w.syncMu.Lock()
+	w.mu.Unlock()
+
+	err := f.Sync()
+	w.syncMu.Unlock()
+	mWALGroupSyncs.Inc()
+	w.markDurable(seg, off, err)
+}
+
+// Sync — fsync текущего сегмента сейчас, без группы (import: всё записанное — на диск до ответа).
+// Закрытые сегменты fsync'нуты ротацией.
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	f, seg, off := w.curFile, w.curSeg, w.curSize
+	if f == nil {
+		w.mu.Unlock()
+		return errWALClosed
+	}
+	w.syncMu.Lock()
+	w.mu.Unlock()
+
+	err := f.Sync()
+	w.syncMu.Unlock()
+	w.markDurable(seg, off, err)
+	return err
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newSyncTestWAL(t *testing.T, groupWait, timeout time.Duration) *WAL {
+	t.Helper()
+	w, err := NewWAL(WALOptions{
+		Dir:           t.TempDir(),
+		SegmentMaxMB:  64,
+		FsyncEvery:    time.Hour, // fsync только от group commit
+		IndexEvery:    100,
+		SyncEvents:    []string{"pay"},
+		SyncGroupWait: groupWait,
+		SyncTimeout:   timeout,
+		Cursors:       []WALCursor{{Name: "mysql"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = w.Close() })
+	return w
+}
+
+func syncTestEvent(name string) []Event {
+	return []Event{{TS: time.Unix(1700000000, 0).UTC(), DomainID: 1, FileID: 1, EventName: name}}
+}
+
+// Конкурентные pay ждут один общий fsync; play ответ на fsync не ждёт.
+func TestWALGroupCommitReleasesWaiters(t *testing.T) {
+	w := newSyncTestWAL(t, 50*time.Millisecond, 5*time.Second)
+
+	syncs := testutil.ToFloat64(mWALGroupSyncs)
+	if _, err := w.AppendDurable(context.Background(), syncTestEvent("play")); err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(mWALGroupSyncs) - syncs; got != 0 {
+		t.Fatalf("play caused %v fsyncs", got)
+	}
+
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := range errs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, errs[i] = w.AppendDurable(context.Background(), syncTestEvent("pay"))
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("append %d: %v", i, err)
+		}
+	}
+	got := testutil.ToFloat64(mWALGroupSyncs) - syncs
+	if got < 1 || got >= n {
+		t.Errorf("%v fsyncs for %d concurrent pay appends, want grouped", got, n)
+	}
+
+	w.durMu.Lock()
+	defer w.durMu.Unlock()
+	if len(w.waiters) != 0 {
+		t.Errorf("%d waiters left after fsync", len(w.waiters))
+	}
+	if w.durSeg != w.curSeg || w.durOff != w.curSize {
+		t.Errorf("durable %d:%d, want end of segment %d:%d", w.durSeg, w.durOff, w.curSeg, w.curSize)
+	}
+}
+
+// Ошибка fsync достаётся всем, кто ждал, а не только первому.
+func TestWALGroupCommitFsyncError(t *testing.T) {
+	w := newSyncTestWAL(t, 20*time.Millisecond, 5*time.Second)
+
+	var pos []AppendPos
+	for i := 0; i < 4; i++ {
+		p, err := w.AppendBatch(syncTestEvent("pay"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos = append(pos, p...)
+	}
+	// закрытый под WAL файл: f.Sync в syncOnce вернёт ошибку
+	w.mu.Lock()
+	_ = w.curFile.Close()
+	w.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(pos))
+	for i, p := range pos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = w.WaitDurable(context.Background(), p)
+		}()
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil || errors.Is(err, errWALSyncTimeout) {
+			t.Errorf("waiter %d: %v, want fsync error", i, err)
+		}
+	}
+}
+
+// fsync не успел за WAL_SYNC_TIMEOUT: errWALSyncTimeout, событие при этом в WAL.
+func TestWALGroupCommitTimeout(t *testing.T) {
+	w := newSyncTestWAL(t, 0, 50*time.Millisecond)
+
+	timeouts := testutil.ToFloat64(mWALSyncTimeouts)
+	w.syncMu.Lock() // syncer встанет на syncMu, fsync не начнётся
+	pos, err := w.AppendDurable(context.Background(), syncTestEvent("pay"))
+	w.syncMu.Unlock()
+	if !errors.Is(err, errWALSyncTimeout) {
+		t.Fatalf("append: %v, want errWALSyncTimeout", err)
+	}
+	if len(pos) != 1 {
+		t.Fatalf("positions %v, want the appended record", pos)
+	}
+	if got := testutil.ToFloat64(mWALSyncTimeouts) - timeouts; got != 1 {
+		t.Errorf("ingest_wal_sync_timeouts_total grew by %v, want 1", got)
+	}
+
+	// отпущенный syncer доделывает fsync: повтор ожидания уже не ждёт таймаута
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := w.WaitDurable(ctx, pos[0]); err != nil {
+		t.Errorf("wait after fsync resumed: %v", err)
+	}
+}